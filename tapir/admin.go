@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/server"
+	"io"
+	"net/http"
+	"time"
+)
+
+// adminStatus is the status of the replica returned by the admin API
+type adminStatus struct {
+	Self            string   `json:"self"`
+	ViewID          int      `json:"view_id"`
+	State           string   `json:"state"`
+	Members         []string `json:"members"`
+	CompletedViewID int      `json:"completed_view_id"`
+	MinClusterSize  int      `json:"min_cluster_size"`
+	// ClusterSizeError is why operations are rejected, when the view is below the minimum cluster size
+	ClusterSizeError string `json:"cluster_size_error,omitempty"`
+	Ready            bool   `json:"ready"`
+	NotReady         string `json:"not_ready,omitempty"`
+}
+
+type adminPeer struct {
+	Member          string    `json:"member"`
+	LastMessageTime time.Time `json:"last_message_time"`
+	ViewID          int       `json:"view_id"`
+}
+
+type adminMembers struct {
+	ViewID  int      `json:"view_id"`
+	Members []string `json:"members"`
+}
+
+// adminDuration is the body of the settings that are durations, such as "250ms"
+type adminDuration struct {
+	Value string `json:"value"`
+}
+
+// adminDrop is the body of the drop requests, the number of messages to drop before processing
+type adminDrop struct {
+	Count int `json:"count"`
+}
+
+// adminPartition is the body of the partition and heal requests, a rule such as "a,b | c" or "a,b -> c"
+type adminPartition struct {
+	Rule string `json:"rule"`
+}
+
+// adminFaults are the network faults of the connections with a peer, or of every connection without faults of its own
+type adminFaults struct {
+	Latency      string  `json:"latency"`
+	Jitter       string  `json:"jitter"`
+	Distribution string  `json:"distribution"`
+	Drop         float64 `json:"drop"`
+	Duplicate    float64 `json:"duplicate"`
+	Reorder      float64 `json:"reorder"`
+	Direction    string  `json:"direction"`
+}
+
+type adminAllFaults struct {
+	Default adminFaults            `json:"default"`
+	Peers   map[string]adminFaults `json:"peers"`
+}
+
+type adminReclaimed struct {
+	Entries int `json:"entries"`
+	Bytes   int `json:"bytes"`
+}
+
+type adminCompaction struct {
+	// RecordTruncatedBefore is the view before which finalized record entries could be truncated
+	RecordTruncatedBefore int                 `json:"record_truncated_before"`
+	RecordEntries         adminReclaimed      `json:"record_entries"`
+	Tombstones            adminReclaimed      `json:"tombstones"`
+	Duration              string              `json:"duration"`
+	Totals                adminCompactorStats `json:"totals"`
+}
+
+type adminCompactorStats struct {
+	Runs          int            `json:"runs"`
+	Errors        int            `json:"errors"`
+	RecordEntries adminReclaimed `json:"record_entries"`
+	Tombstones    adminReclaimed `json:"tombstones"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// adminHandler serves the admin API, which mirrors the server REPL, and the health checks
+func adminHandler(srv *server.Server) *http.ServeMux {
+	tp := srv.TestProperties()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := srv.Ready(); err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, adminError{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		status := srv.Status()
+		response := adminStatus{
+			Self:            status.Self,
+			ViewID:          status.View.ViewID(),
+			State:           viewState(status.View.ViewState),
+			Members:         status.View.Members(),
+			CompletedViewID: status.CompletedViewID,
+			MinClusterSize:  status.MinClusterSize,
+			Ready:           true,
+		}
+		if status.ClusterSizeError != nil {
+			response.ClusterSizeError = status.ClusterSizeError.Error()
+		}
+		if err := srv.Ready(); err != nil {
+			response.Ready, response.NotReady = false, err.Error()
+		}
+		writeJSON(w, http.StatusOK, response)
+	})
+	mux.HandleFunc("GET /peers", func(w http.ResponseWriter, r *http.Request) {
+		peers := make([]adminPeer, 0)
+		for _, peer := range srv.Peers() {
+			peers = append(peers, adminPeer{Member: peer.Member, LastMessageTime: peer.LastMessageTime, ViewID: peer.ViewID})
+		}
+		writeJSON(w, http.StatusOK, peers)
+	})
+	mux.HandleFunc("GET /members", func(w http.ResponseWriter, r *http.Request) {
+		view := srv.Status().View
+		writeJSON(w, http.StatusOK, adminMembers{ViewID: view.ViewID(), Members: view.Members()})
+	})
+	handleDuration(mux, "/latency", tp.GetLatency, tp.SetLatency, nil)
+	handleDuration(mux, "/timeout", tp.GetTimeout, tp.SetTimeout, nil)
+	handleDuration(mux, "/view-change-period", tp.GetViewChangePeriod, tp.SetViewChangePeriod, func(period time.Duration) error {
+		// 0 disables periodic view changes, shorter periods would change views on every iteration
+		if period > 0 && period < time.Millisecond {
+			return errors.New("must be 0 to disable periodic view changes, or at least 1ms")
+		}
+		return nil
+	})
+	handleDrop(mux, "/drop/ping", tp.AddDropPing)
+	handleDrop(mux, "/drop/replica", tp.AddDropReplica)
+	handleDrop(mux, "/drop/client", tp.AddDropClient)
+	mux.HandleFunc("GET /partitions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, tp.Partitions())
+	})
+	mux.HandleFunc("POST /partition", func(w http.ResponseWriter, r *http.Request) {
+		var body adminPartition
+		if err := readJSON(r, &body); err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+		rule, err := server.ParsePartitionRule(body.Rule)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+		// The rule is named after its normalised form, so it can be healed by sending it again
+		tp.AddPartition(rule.String(), rule)
+		writeJSON(w, http.StatusOK, adminPartition{Rule: rule.String()})
+	})
+	mux.HandleFunc("POST /heal", func(w http.ResponseWriter, r *http.Request) {
+		// Without a body every partition is removed
+		var body adminPartition
+		if err := readJSON(r, &body); err != nil && !errors.Is(err, io.EOF) {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+		if body.Rule == "" {
+			tp.Heal()
+			writeJSON(w, http.StatusOK, tp.Partitions())
+			return
+		}
+		rule, err := server.ParsePartitionRule(body.Rule)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+		if !tp.RemovePartition(rule.String()) {
+			writeJSON(w, http.StatusNotFound, adminError{Error: fmt.Sprintf("no partition '%s'", rule.String())})
+			return
+		}
+		writeJSON(w, http.StatusOK, tp.Partitions())
+	})
+	mux.HandleFunc("GET /faults", func(w http.ResponseWriter, r *http.Request) {
+		faults := adminAllFaults{Default: newAdminFaults(tp.GetFaults()), Peers: make(map[string]adminFaults)}
+		for _, peer := range tp.FaultyPeers() {
+			if peerFaults, ok := tp.GetPeerFaults(peer); ok {
+				faults.Peers[peer] = newAdminFaults(peerFaults)
+			}
+		}
+		writeJSON(w, http.StatusOK, faults)
+	})
+	handleFaults(mux, "/faults", func(r *http.Request, faults server.NetworkFaults) {
+		tp.SetFaults(faults)
+	})
+	handleFaults(mux, "/faults/{peer}", func(r *http.Request, faults server.NetworkFaults) {
+		tp.SetPeerFaults(r.PathValue("peer"), faults)
+	})
+	mux.HandleFunc("DELETE /faults", func(w http.ResponseWriter, r *http.Request) {
+		tp.SetFaults(server.NetworkFaults{})
+		writeJSON(w, http.StatusOK, newAdminFaults(tp.GetFaults()))
+	})
+	mux.HandleFunc("DELETE /faults/{peer}", func(w http.ResponseWriter, r *http.Request) {
+		peer := r.PathValue("peer")
+		if !tp.ClearPeerFaults(peer) {
+			writeJSON(w, http.StatusNotFound, adminError{Error: fmt.Sprintf("no faults for peer '%s'", peer)})
+			return
+		}
+		faults, _ := tp.GetPeerFaults(peer)
+		writeJSON(w, http.StatusOK, newAdminFaults(faults))
+	})
+	mux.HandleFunc("POST /compact", func(w http.ResponseWriter, r *http.Request) {
+		compaction, err := srv.Compact()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, adminError{Error: fmt.Sprintf("error compacting: %v", err)})
+			return
+		}
+		stats := srv.CompactorStats()
+		writeJSON(w, http.StatusOK, adminCompaction{
+			RecordTruncatedBefore: srv.Status().CompletedViewID,
+			RecordEntries:         adminReclaimed(compaction.RecordEntries),
+			Tombstones:            adminReclaimed(compaction.Tombstones),
+			Duration:              compaction.Duration.String(),
+			Totals: adminCompactorStats{
+				Runs:          stats.Runs,
+				Errors:        stats.Errors,
+				RecordEntries: adminReclaimed(stats.RecordEntries),
+				Tombstones:    adminReclaimed(stats.Tombstones),
+			},
+		})
+	})
+	return mux
+}
+
+func newAdminFaults(faults server.NetworkFaults) adminFaults {
+	return adminFaults{
+		Latency:      faults.Latency.String(),
+		Jitter:       faults.Jitter.String(),
+		Distribution: faults.Distribution.String(),
+		Drop:         faults.DropRate,
+		Duplicate:    faults.DuplicateRate,
+		Reorder:      faults.ReorderRate,
+		Direction:    faults.Direction.String(),
+	}
+}
+
+// networkFaults parses the faults, the fields that aren't set are left at their zero value
+func (f adminFaults) networkFaults() (server.NetworkFaults, error) {
+	var faults server.NetworkFaults
+	var err error
+	if f.Latency != "" {
+		if faults.Latency, err = parseNonNegativeDuration(f.Latency); err != nil {
+			return faults, fmt.Errorf("invalid latency: %w", err)
+		}
+	}
+	if f.Jitter != "" {
+		if faults.Jitter, err = parseNonNegativeDuration(f.Jitter); err != nil {
+			return faults, fmt.Errorf("invalid jitter: %w", err)
+		}
+	}
+	if f.Distribution != "" {
+		if faults.Distribution, err = server.ParseJitterDistribution(f.Distribution); err != nil {
+			return faults, err
+		}
+	}
+	if f.Direction != "" {
+		if faults.Direction, err = server.ParseFaultDirection(f.Direction); err != nil {
+			return faults, err
+		}
+	}
+	rates := []struct {
+		name string
+		rate float64
+		set  *float64
+	}{{"drop", f.Drop, &faults.DropRate}, {"duplicate", f.Duplicate, &faults.DuplicateRate}, {"reorder", f.Reorder, &faults.ReorderRate}}
+	for _, r := range rates {
+		if err := checkRate(r.rate); err != nil {
+			return faults, fmt.Errorf("invalid %s: %w", r.name, err)
+		}
+		*r.set = r.rate
+	}
+	return faults, nil
+}
+
+// handleFaults replaces the faults on PUT
+func handleFaults(mux *http.ServeMux, path string, set func(r *http.Request, faults server.NetworkFaults)) {
+	mux.HandleFunc("PUT "+path, func(w http.ResponseWriter, r *http.Request) {
+		var body adminFaults
+		if err := readJSON(r, &body); err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+		faults, err := body.networkFaults()
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+		set(r, faults)
+		writeJSON(w, http.StatusOK, newAdminFaults(faults))
+	})
+}
+
+// viewState is the name of the state of the view
+func viewState(state server.ViewState) string {
+	switch {
+	case state.Changing != nil:
+		return "changing"
+	case state.Recovery != nil:
+		return "recovering"
+	default:
+		return "normal"
+	}
+}
+
+// handleDuration serves the setting on GET and changes it on PUT, if check is set it validates the new value
+func handleDuration(mux *http.ServeMux, path string, get func() time.Duration, set func(time.Duration), check func(time.Duration) error) {
+	mux.HandleFunc("GET "+path, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, adminDuration{Value: get().String()})
+	})
+	mux.HandleFunc("PUT "+path, func(w http.ResponseWriter, r *http.Request) {
+		var body adminDuration
+		if err := readJSON(r, &body); err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+		value, err := parseNonNegativeDuration(body.Value)
+		if err == nil && check != nil {
+			err = check(value)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: fmt.Sprintf("invalid duration %q: %v", body.Value, err)})
+			return
+		}
+		set(value)
+		writeJSON(w, http.StatusOK, adminDuration{Value: get().String()})
+	})
+}
+
+func parseNonNegativeDuration(s string) (time.Duration, error) {
+	value, err := time.ParseDuration(s)
+	if err == nil && value < 0 {
+		err = errors.New("must not be negative")
+	}
+	return value, err
+}
+
+// handleDrop adds to the number of messages to drop on POST
+func handleDrop(mux *http.ServeMux, path string, add func(int)) {
+	mux.HandleFunc("POST "+path, func(w http.ResponseWriter, r *http.Request) {
+		var body adminDrop
+		if err := readJSON(r, &body); err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+		if body.Count < 0 {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: fmt.Sprintf("invalid count %d, must not be negative", body.Count)})
+			return
+		}
+		add(body.Count)
+		writeJSON(w, http.StatusOK, body)
+	})
+}
+
+// maxAdminRequestSize is the largest request body accepted, requests are a single small object
+const maxAdminRequestSize = 1 << 16
+
+func readJSON(r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxAdminRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
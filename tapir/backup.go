@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/client"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"github.com/phughk/go-dist-algos/tapir/server"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"os"
+)
+
+// backup streams a consistent snapshot of a running replica into a new bbolt database file
+func backup(c *cli.Context) error {
+	output := c.String("output")
+	if err := requireNewFile(output); err != nil {
+		return err
+	}
+	reader, err := client.OpenSnapshot(context.Background(), c.String("address"), 0)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	db, err := server.NewStorageEngine(output)
+	if err != nil {
+		return err
+	}
+	chunks := 0
+	err = db.RestoreSnapshot(func() (*protocol.SnapshotChunk, error) {
+		chunk, err := reader.Next()
+		if err == nil {
+			chunks++
+		}
+		return chunk, err
+	})
+	if err = errors.Join(err, db.Close()); err != nil {
+		return errors.Join(fmt.Errorf("error backing up %s: %w", c.String("address"), err), os.Remove(output))
+	}
+	logrus.Infof("Backed up %s to %s in %d chunks", c.String("address"), output, chunks)
+	return nil
+}
+
+// restore seeds a new bbolt database from a backup. The IR record of the new database is empty and its master
+// record is in view 0, so that the replica can start a new cluster.
+func restore(c *cli.Context) error {
+	input := c.String("input")
+	filepath := c.String("filepath")
+	if _, err := os.Stat(input); err != nil {
+		return fmt.Errorf("error opening backup: %w", err)
+	}
+	if err := requireNewFile(filepath); err != nil {
+		return err
+	}
+	src, err := server.NewReadOnlyStorageEngine(input)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := server.NewStorageEngine(filepath)
+	if err != nil {
+		return err
+	}
+	err = server.CopySnapshot(src, dst)
+	if err == nil {
+		err = server.ResetViews(dst)
+	}
+	if err = errors.Join(err, dst.Close()); err != nil {
+		return errors.Join(fmt.Errorf("error restoring %s: %w", input, err), os.Remove(filepath))
+	}
+	logrus.Infof("Restored %s to %s", input, filepath)
+	return nil
+}
+
+// requireNewFile returns an error if the file exists, so that backups and restores never overwrite a database
+func requireNewFile(path string) error {
+	_, err := os.Stat(path)
+	if err == nil {
+		return fmt.Errorf("%s already exists", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/bench"
+	"github.com/urfave/cli/v2"
+	"os"
+	"strings"
+	"time"
+)
+
+// runBench runs a workload against a cluster and reports the throughput, abort rate and latencies
+func runBench(c *cli.Context) error {
+	format := c.String("format")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown format %s, expected text or json", format)
+	}
+	seed := c.Int64("seed")
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	result, err := bench.Run(context.Background(), bench.Options{
+		Cluster:      strings.Split(c.String("cluster"), ","),
+		Duration:     c.Duration("duration"),
+		Warmup:       c.Duration("warmup"),
+		Concurrency:  c.Int("concurrency"),
+		ReadRatio:    c.Float64("read-ratio"),
+		Distribution: c.String("distribution"),
+		Keys:         c.Int("keys"),
+		ValueSize:    c.Int("value-size"),
+		TxnSize:      c.Int("txn-size"),
+		Load:         c.Bool("load"),
+		Seed:         seed,
+	})
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+	printBenchResult(result)
+	return nil
+}
+
+func printBenchResult(result *bench.Result) {
+	opts := result.Options
+	fmt.Printf("Workload: %d clients, %d %s keys, %.0f%% reads, %d operations per transaction, %d byte values, seed %d\n",
+		opts.Concurrency, opts.Keys, opts.Distribution, opts.ReadRatio*100, opts.TxnSize, opts.ValueSize, opts.Seed)
+	fmt.Printf("Transactions: %d committed, %d aborted, %d failed in %s\n", result.Committed, result.Aborted, result.Failed, result.Elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput: %.1f transactions/s, %.1f operations/s\n", result.Throughput, result.OperationThroughput)
+	fmt.Printf("Abort rate: %.2f%%\n", result.AbortRate*100)
+	fmt.Printf("%-12s %8s %10s %10s %10s %10s %10s %10s\n", "Latency", "count", "mean", "p50", "p90", "p99", "p99.9", "max")
+	printLatency("transaction", result.Transaction)
+	printLatency("read", result.Read)
+	printLatency("commit", result.Commit)
+}
+
+func printLatency(name string, l bench.Latency) {
+	round := func(d time.Duration) time.Duration {
+		return d.Round(time.Microsecond)
+	}
+	fmt.Printf("%-12s %8d %10s %10s %10s %10s %10s %10s\n", name, l.Count, round(l.Mean), round(l.P50), round(l.P90), round(l.P99), round(l.P999), round(l.Max))
+}
@@ -0,0 +1,272 @@
+// Package bench runs YCSB-style workloads of reads and writes against a cluster through the client, measuring the
+// throughput, abort rate and latencies of the transactions.
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/client"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// loadBatch is how many keys are written per transaction when loading
+	loadBatch = 50
+	// loadAttempts is how many times a batch is committed before giving up on loading
+	loadAttempts = 10
+)
+
+// Options of a benchmark
+type Options struct {
+	Cluster  []string
+	Duration time.Duration
+	// Warmup runs the workload before the measured duration, without counting its transactions
+	Warmup      time.Duration
+	Concurrency int
+	// ReadRatio is the chance of each operation being a read, the others are writes
+	ReadRatio float64
+	// Distribution of the keys operations are on, uniform or zipfian
+	Distribution string
+	Keys         int
+	ValueSize    int
+	// TxnSize is the number of operations per transaction
+	TxnSize int
+	// Load writes every key before running, so that reads find a value
+	Load bool
+	Seed int64
+}
+
+// Latency percentiles of a kind of request
+type Latency struct {
+	Count int
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	P999  time.Duration
+	Max   time.Duration
+}
+
+// Result of a benchmark, durations are in nanoseconds when encoded as JSON
+type Result struct {
+	Options Options
+	Elapsed time.Duration
+	// Committed, Aborted and Failed transactions, failed transactions may or may not have committed
+	Committed int
+	Aborted   int
+	Failed    int
+	// Throughput is committed transactions per second
+	Throughput float64
+	// OperationThroughput is the operations of committed transactions per second
+	OperationThroughput float64
+	// AbortRate is the fraction of transactions that aborted
+	AbortRate float64
+	// Transaction latency from beginning to committing, of committed transactions
+	Transaction Latency
+	// Read latency of each Get
+	Read Latency
+	// Commit latency of each Commit, whatever the outcome
+	Commit Latency
+}
+
+// samples measured by a worker
+type samples struct {
+	committed   int
+	aborted     int
+	failed      int
+	transaction []time.Duration
+	read        []time.Duration
+	commit      []time.Duration
+}
+
+// Run loads the keys if asked to and runs the workload, with a client per worker
+func Run(ctx context.Context, opts Options) (*Result, error) {
+	if opts.Concurrency <= 0 || opts.Keys <= 0 || opts.TxnSize <= 0 || opts.ValueSize < 0 {
+		return nil, fmt.Errorf("concurrency, keys and transaction size must be positive")
+	}
+	if opts.ReadRatio < 0 || opts.ReadRatio > 1 {
+		return nil, fmt.Errorf("read ratio must be between 0 and 1, not %v", opts.ReadRatio)
+	}
+	// Writes of keys that were read carry the previous value too
+	if 2*opts.TxnSize*(opts.ValueSize+len(key(0))) >= protocol.MaxMessageSize {
+		return nil, fmt.Errorf("transactions of %d values of %d bytes don't fit in a message of %d bytes", opts.TxnSize, opts.ValueSize, protocol.MaxMessageSize)
+	}
+	chooser, err := newKeyChooser(opts.Distribution, opts.Keys)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Load {
+		if err := load(ctx, opts); err != nil {
+			return nil, fmt.Errorf("failed loading keys: %w", err)
+		}
+	}
+	clients := make([]*client.Client, opts.Concurrency)
+	defer func() {
+		for _, c := range clients {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}()
+	for i := range clients {
+		c, err := client.Dial(ctx, opts.Cluster)
+		if err != nil {
+			return nil, fmt.Errorf("failed connecting to the cluster: %w", err)
+		}
+		clients[i] = c
+	}
+
+	start := time.Now().Add(opts.Warmup)
+	ctx, cancel := context.WithDeadline(ctx, start.Add(opts.Duration))
+	defer cancel()
+	results := make([]*samples, opts.Concurrency)
+	wg := sync.WaitGroup{}
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *client.Client) {
+			defer wg.Done()
+			results[i] = run(ctx, c, chooser, opts, rand.New(rand.NewSource(opts.Seed+int64(i))), start)
+		}(i, c)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := &samples{}
+	for _, s := range results {
+		total.committed += s.committed
+		total.aborted += s.aborted
+		total.failed += s.failed
+		total.transaction = append(total.transaction, s.transaction...)
+		total.read = append(total.read, s.read...)
+		total.commit = append(total.commit, s.commit...)
+	}
+	result := &Result{
+		Options:     opts,
+		Elapsed:     elapsed,
+		Committed:   total.committed,
+		Aborted:     total.aborted,
+		Failed:      total.failed,
+		Transaction: latency(total.transaction),
+		Read:        latency(total.read),
+		Commit:      latency(total.commit),
+	}
+	if elapsed > 0 {
+		result.Throughput = float64(total.committed) / elapsed.Seconds()
+		result.OperationThroughput = float64(total.committed*opts.TxnSize) / elapsed.Seconds()
+	}
+	if attempted := total.committed + total.aborted + total.failed; attempted > 0 {
+		result.AbortRate = float64(total.aborted) / float64(attempted)
+	}
+	return result, nil
+}
+
+// run transactions on the client until the context is done, only measuring the ones that begin after start
+func run(ctx context.Context, c *client.Client, chooser keyChooser, opts Options, r *rand.Rand, start time.Time) *samples {
+	s := &samples{}
+	for ctx.Err() == nil {
+		began := time.Now()
+		measured := !began.Before(start)
+		reads := make([]time.Duration, 0, opts.TxnSize)
+		txn := c.Begin()
+		var err error
+		for i := 0; i < opts.TxnSize && err == nil; i++ {
+			k := key(chooser.next(r))
+			if r.Float64() < opts.ReadRatio {
+				before := time.Now()
+				_, err = txn.Get(k)
+				reads = append(reads, time.Since(before))
+			} else {
+				err = txn.Put(k, value(r, opts.ValueSize))
+			}
+		}
+		if err == nil {
+			before := time.Now()
+			err = txn.Commit()
+			if errors.Is(err, client.ErrRetry) {
+				_ = txn.Abort()
+			}
+			if measured {
+				s.commit = append(s.commit, time.Since(before))
+			}
+		} else {
+			_ = txn.Abort()
+		}
+		if !measured || (ctx.Err() != nil && err != nil) {
+			// Transactions cut short by the end of the run aren't counted
+			continue
+		}
+		s.read = append(s.read, reads...)
+		switch {
+		case err == nil:
+			s.committed++
+			s.transaction = append(s.transaction, time.Since(began))
+		case errors.Is(err, client.ErrAborted):
+			s.aborted++
+		default:
+			s.failed++
+		}
+	}
+	return s
+}
+
+// load writes a value to every key
+func load(ctx context.Context, opts Options) error {
+	c, err := client.Dial(ctx, opts.Cluster)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	r := rand.New(rand.NewSource(opts.Seed))
+	batch := max(1, min(loadBatch, protocol.MaxMessageSize/2/(opts.ValueSize+len(key(0)))))
+	for i := 0; i < opts.Keys; i += batch {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		txn := c.Begin()
+		for j := i; j < min(i+batch, opts.Keys); j++ {
+			if err := txn.Put(key(j), value(r, opts.ValueSize)); err != nil {
+				return err
+			}
+		}
+		err := txn.Commit()
+		// The transaction is left open to be committed again while the cluster is changing views
+		for attempt := 1; errors.Is(err, client.ErrRetry) && attempt < loadAttempts; attempt++ {
+			err = txn.Commit()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// latency percentiles of the samples, using the nearest rank
+func latency(samples []time.Duration) Latency {
+	if len(samples) == 0 {
+		return Latency{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	var sum time.Duration
+	for _, d := range samples {
+		sum += d
+	}
+	percentile := func(p float64) time.Duration {
+		rank := int(math.Ceil(p*float64(len(samples)))) - 1
+		return samples[max(0, min(rank, len(samples)-1))]
+	}
+	return Latency{
+		Count: len(samples),
+		Mean:  sum / time.Duration(len(samples)),
+		P50:   percentile(0.5),
+		P90:   percentile(0.9),
+		P99:   percentile(0.99),
+		P999:  percentile(0.999),
+		Max:   samples[len(samples)-1],
+	}
+}
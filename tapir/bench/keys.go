@@ -0,0 +1,95 @@
+package bench
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+const (
+	// DistributionUniform chooses every key with the same probability
+	DistributionUniform = "uniform"
+	// DistributionZipfian chooses the lowest numbered keys most often, as YCSB does
+	DistributionZipfian = "zipfian"
+)
+
+// Distributions of the keys operations are on
+var Distributions = []string{DistributionUniform, DistributionZipfian}
+
+// zipfianConstant is the skew of the zipfian distribution YCSB uses by default
+const zipfianConstant = 0.99
+
+func key(i int) string {
+	return fmt.Sprintf("bench/%08d", i)
+}
+
+// keyChooser picks the index of the key of the next operation
+type keyChooser interface {
+	next(r *rand.Rand) int
+}
+
+func newKeyChooser(distribution string, keys int) (keyChooser, error) {
+	switch distribution {
+	case DistributionUniform:
+		return uniform(keys), nil
+	case DistributionZipfian:
+		return newZipfian(keys, zipfianConstant), nil
+	default:
+		return nil, fmt.Errorf("unknown key distribution %q, expected %s or %s", distribution, DistributionUniform, DistributionZipfian)
+	}
+}
+
+type uniform int
+
+func (u uniform) next(r *rand.Rand) int {
+	return r.Intn(int(u))
+}
+
+// zipfian is the generator of Gray et al., "Quickly Generating Billion-Record Synthetic Databases", which YCSB uses.
+// Unlike rand.Zipf it supports a skew below 1.
+type zipfian struct {
+	items int
+	theta float64
+	zetan float64
+	alpha float64
+	eta   float64
+}
+
+func newZipfian(items int, theta float64) *zipfian {
+	zetan := 0.0
+	for i := 1; i <= items; i++ {
+		zetan += 1 / math.Pow(float64(i), theta)
+	}
+	zeta2 := 1 + 1/math.Pow(2, theta)
+	return &zipfian{
+		items: items,
+		theta: theta,
+		zetan: zetan,
+		alpha: 1 / (1 - theta),
+		eta:   (1 - math.Pow(2/float64(items), 1-theta)) / (1 - zeta2/zetan),
+	}
+}
+
+func (z *zipfian) next(r *rand.Rand) int {
+	u := r.Float64()
+	uz := u * z.zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < 1+math.Pow(0.5, z.theta) && z.items > 1 {
+		return 1
+	}
+	i := int(float64(z.items) * math.Pow(z.eta*u-z.eta+1, z.alpha))
+	return min(i, z.items-1)
+}
+
+// valueAlphabet keeps values valid UTF-8, which keys and values must be
+const valueAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func value(r *rand.Rand, size int) string {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = valueAlphabet[r.Intn(len(valueAlphabet))]
+	}
+	return string(b)
+}
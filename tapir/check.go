@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/history"
+	"github.com/urfave/cli/v2"
+)
+
+// check searches a recorded history for anomalies, failing if there are any
+func check(c *cli.Context) error {
+	events, err := history.Load(c.String("history"))
+	if err != nil {
+		return err
+	}
+	report := history.Check(events, history.Options{Realtime: c.Bool("realtime")})
+	printCheckReport(report)
+	if !report.Valid() {
+		return fmt.Errorf("found %d anomalies", len(report.Anomalies))
+	}
+	return nil
+}
+
+func printCheckReport(report *history.Report) {
+	fmt.Printf("Checked %d transactions: %d committed, %d failed, %d unknown\n",
+		len(report.Transactions), report.Committed, report.Failed, report.Unknown)
+	if len(report.UncheckedKeys) > 0 {
+		fmt.Printf("Keys without a version order, which weren't checked: %v\n", report.UncheckedKeys)
+	}
+	for _, anomaly := range report.Anomalies {
+		fmt.Println(anomaly)
+		for _, id := range anomaly.Transactions {
+			fmt.Printf("     - %s\n", report.Transactions[id])
+		}
+	}
+}
@@ -0,0 +1,450 @@
+// Package client is a Go client library for a TAPIR KV cluster
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/phughk/go-dist-algos/tapir/history"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"github.com/sirupsen/logrus"
+	"reflect"
+	"time"
+)
+
+// DefaultTimeout is how long the client waits for replicas to respond if no Timeout is set
+const DefaultTimeout = 5 * time.Second
+
+var (
+	// ErrNoQuorum not enough replicas responded successfully for the operation to complete
+	ErrNoQuorum = errors.New("no quorum")
+	// ErrTimeout the replicas did not respond in time for a quorum to be reached
+	ErrTimeout = errors.New("timeout")
+	// ErrAborted the replicas rejected the operation and the transaction must be abandoned
+	ErrAborted = errors.New("aborted")
+	// ErrRetry the operation did not complete but may succeed if it is sent again
+	ErrRetry = errors.New("retry")
+	// ErrViewMismatch enough replicas responded but they were not in the same view
+	ErrViewMismatch = errors.New("view mismatch")
+	// ErrUnknownOutcome the result of a consensus operation was decided but not enough replicas confirmed it, so the
+	// operation may or may not take effect
+	ErrUnknownOutcome = errors.New("unknown outcome")
+	// ErrTxnClosed the transaction has already been committed or aborted
+	ErrTxnClosed = errors.New("transaction closed")
+	// ErrInvalidUTF8 keys and values must be valid UTF-8, as they are sent to the replicas as JSON strings
+	ErrInvalidUTF8 = errors.New("invalid UTF-8")
+)
+
+// Client is connected to every replica of a TAPIR cluster
+type Client struct {
+	// ID identifies this client to the replicas
+	ID          string
+	Connections []*protocol.ConnHandler
+	// Timeout is how long to wait for a quorum of replicas to respond to an operation
+	Timeout time.Duration
+	// History records the invocation and outcome of every transaction when set
+	History *history.Recorder
+	clock   protocol.Clock
+	cancel  context.CancelFunc
+}
+
+// Dial connects to every replica in addrs, failing if any of them cannot be reached
+func Dial(ctx context.Context, addrs []string) (*Client, error) {
+	return DialNetwork(ctx, protocol.TCPNetwork{}, protocol.RealClock{}, addrs)
+}
+
+// DialNetwork is Dial over the network, with timeouts measured by the clock
+func DialNetwork(ctx context.Context, network protocol.Network, clock protocol.Clock, addrs []string) (*Client, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &Client{
+		ID:          uuid.New().String(),
+		Connections: make([]*protocol.ConnHandler, 0, len(addrs)),
+		clock:       clock,
+		cancel:      cancel,
+	}
+	for _, addr := range addrs {
+		conn, err := network.Dial(addr)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("error connecting to server %s: %w", addr, err)
+		}
+		server := addr
+		c.Connections = append(c.Connections, protocol.NewConnHandlerWithClock(ctx, conn, clock, clientRequestHandler, func() {
+			logrus.Debugf("Connection to server closed: %s", server)
+		}))
+		logrus.Debugf("Connected to server: %+v", addr)
+	}
+	return c, nil
+}
+
+// Close closes the connections to all replicas
+func (c *Client) Close() {
+	for _, conn := range c.Connections {
+		conn.Close()
+	}
+	c.cancel()
+}
+
+// Begin starts a new transaction, nothing is sent to the replicas until the transaction reads or commits
+func (c *Client) Begin() *Txn {
+	t := &Txn{
+		client:    c,
+		readSet:   make(map[string]string),
+		writeSet:  make(map[string]string),
+		deleteSet: make(map[string]bool),
+	}
+	if c.History != nil {
+		t.historyID = c.History.Invoke(c.ID, c.clock.Now())
+	}
+	return t
+}
+
+// SendOperationRequest IR replicas send their current view number in every response to clients. For an operation to
+// be considered successful, the IR client must receive responses with matching view numbers. For consensus operations,
+// the view numbers in REPLY and CONFIRM must match as well. If a client receives responses with different view numbers,
+// it notifies the replicas in the older view.
+//
+// protocol.Inconsistent operations complete once f+1 replicas in the latest view have replied. protocol.Consensus operations complete
+// on the fast path once a fast quorum of replicas in the latest view returned matching results, otherwise once all
+// replicas replied or the timeout expired, on the slow path with a classic f+1 quorum in the latest view. The result
+// decided on the slow path is returned once f+1 replicas confirmed it, the result decided on the fast path is finalized
+// in the background.
+func (c *Client) SendOperationRequest(readSet []string, writeSet map[string]protocol.PutcOp) (*protocol.OperationResponse, error) {
+	// WriteSet is values that haven't been read
+	// WriteCSet is values that have been read
+	writeCSet := make(map[string]protocol.PutcOp)
+	for _, v := range readSet {
+		_, ok := writeSet[v]
+		if ok {
+			writeCSet[v] = writeSet[v]
+			delete(writeSet, v)
+		}
+	}
+	newWriteSet := make(map[string]string)
+	var deleteSet []string
+	for k, v := range writeSet {
+		if v.Delete {
+			deleteSet = append(deleteSet, k)
+		} else {
+			newWriteSet[k] = v.Proposed
+		}
+	}
+	return c.SendOperation(&protocol.Operation{
+		ReadSet:   readSet,
+		WriteSet:  newWriteSet,
+		WriteCSet: writeCSet,
+		DeleteSet: deleteSet,
+	})
+}
+
+// SendOperation sends the operation to every replica, see SendOperationRequest. Operations that write or compare are
+// protocol.Consensus operations, operations that only read are protocol.Inconsistent. If the replicas are not in the
+// same view, the operation is proposed again once the replicas in older views had time to catch up.
+func (c *Client) SendOperation(op *protocol.Operation) (*protocol.OperationResponse, error) {
+	mode := protocol.Inconsistent
+	if len(op.ReadCSet) > 0 || len(op.WriteCSet) > 0 || len(op.WriteSet) > 0 || len(op.DeleteSet) > 0 || len(op.RangeCSet) > 0 {
+		// Writes are prepared by each replica and only applied once the replicas agreed on the outcome
+		mode = protocol.Consensus
+	}
+	operationRequest := &protocol.OperationRequest{
+		Mode:          mode,
+		Propose:       op,
+		ClientID:      c.ID,
+		TransactionID: uuid.New().String(),
+	}
+	for attempt := 1; ; attempt++ {
+		// Replicas reply to the same propose with the result they recorded, so it can be sent again
+		result, err := c.sendOperationRequest(operationRequest)
+		if !errors.Is(err, ErrViewMismatch) || attempt == viewMismatchAttempts {
+			return result, err
+		}
+		logrus.Debugf("Proposing operation %s again: %v", operationRequest.TransactionID, err)
+		<-c.clock.After(c.retryInterval())
+	}
+}
+
+// viewMismatchAttempts is how many times an operation is proposed while the replicas are not in the same view
+const viewMismatchAttempts = 3
+
+// sendOperationRequest proposes the operation to every replica and finalizes the decided result of a consensus operation,
+// waiting for a majority to confirm it on the slow path and finalizing it in the background on the fast path
+func (c *Client) sendOperationRequest(operationRequest *protocol.OperationRequest) (*protocol.OperationResponse, error) {
+	mode := operationRequest.Mode
+	// Response channel, buffered so that late responses don't block after we have decided
+	responseChan := make(chan *protocol.MaybeError, len(c.Connections))
+	// Send message to all servers
+	for _, conn := range c.Connections {
+		go func(conn *protocol.ConnHandler) {
+			request := protocol.AnyMessage{
+				RequestID:        uuid.New().String(),
+				OperationRequest: operationRequest,
+			}
+			resp, err := conn.SendRequest(&request)
+			if err == nil && resp.OperationResponse == nil {
+				err = fmt.Errorf("unexpected response to operation request: %+v", resp)
+			}
+			responseChan <- &protocol.MaybeError{Conn: conn, Error: err, Response: resp}
+		}(conn)
+	}
+	// Wait for a quorum of responses, or all responses, or the timeout
+	total := len(c.Connections)
+	responses := make([]*protocol.MaybeError, 0, total)
+	received := 0
+	timedOut := false
+	deadline := c.clock.After(c.timeout())
+	var decidedValue *protocol.OperationResponse
+	// Results decided before all responses were received were decided by a fast quorum, or are inconsistent
+	slowPath := false
+collect:
+	for received < total {
+		select {
+		case resp := <-responseChan:
+			received++
+			if resp.Error != nil {
+				logrus.Warnf("Error sending operation request to server: %v", resp.Error)
+				timedOut = timedOut || errors.Is(resp.Error, protocol.ErrRequestTimeout)
+				continue
+			}
+			responses = append(responses, resp)
+			if decidedValue = decideOperationResponse(mode, total, responses, false); decidedValue != nil {
+				break collect
+			}
+		case <-deadline:
+			timedOut = true
+			break collect
+		}
+	}
+	logrus.Tracef("Received %d out of %d responses\n", len(responses), total)
+	if decidedValue == nil {
+		decidedValue = decideOperationResponse(mode, total, responses, true)
+		slowPath = decidedValue != nil && mode == protocol.Consensus
+	}
+	// Replicas that responded after we decided may also be behind, so keep checking them in the background
+	go func(pending int) {
+		late := make([]*protocol.MaybeError, 0, pending)
+		for i := 0; i < pending; i++ {
+			late = append(late, <-responseChan)
+		}
+		c.notifyOlderViews(append(responses, late...))
+	}(total - received)
+
+	if decidedValue == nil {
+		if protocol.MajorityQuorum(len(responses), total) {
+			return nil, fmt.Errorf("%w: %d out of %d responses were not in the same view", ErrViewMismatch, len(responses), total)
+		}
+		if timedOut {
+			return nil, fmt.Errorf("%w: received %d out of %d responses", ErrTimeout, len(responses), total)
+		}
+		return nil, fmt.Errorf("%w: received %d out of %d responses", ErrNoQuorum, len(responses), total)
+	}
+	logrus.Debugf("Decided value: %+v", decidedValue)
+	switch {
+	case mode == protocol.Consensus && slowPath:
+		if err := c.finalize(operationRequest, decidedValue, true); err != nil {
+			return nil, err
+		}
+	case mode == protocol.Consensus:
+		// A view change keeps the result of a fast quorum, so the replicas can finalize it after the client returns
+		go func() {
+			if err := c.finalize(operationRequest, decidedValue, false); err != nil {
+				logrus.Debugf("Error finalizing operation %s decided on the fast path: %v", operationRequest.TransactionID, err)
+			}
+		}()
+	}
+	if decidedValue.Error != nil {
+		return nil, clientError(decidedValue.Error)
+	}
+	return decidedValue, nil
+}
+
+// clientError classifies an error returned by the replicas so that callers can use errors.Is with the client errors,
+// the protocol.ReplicaError is still available with errors.As
+func clientError(err *protocol.ReplicaError) error {
+	switch err.Code {
+	case protocol.ErrorCodeClusterTooSmall:
+		return fmt.Errorf("%w: %w", ErrNoQuorum, err)
+	case protocol.ErrorCodeAborted:
+		return fmt.Errorf("%w: %w", ErrAborted, err)
+	case protocol.ErrorCodeRetry:
+		return fmt.Errorf("%w: %w", ErrRetry, err)
+	default:
+		return fmt.Errorf("unknown replica error code %d: %w", err.Code, err)
+	}
+}
+
+// decideOperationResponse returns the result of an operation once the responses form a quorum in the latest view, or
+// nil if no result can be decided yet. Final is true when no further responses will be received.
+func decideOperationResponse(mode protocol.OperationRequestMode, total int, responses []*protocol.MaybeError, final bool) *protocol.OperationResponse {
+	// Only responses from the latest view count towards the quorum
+	inView := make([]*protocol.OperationResponse, 0, len(responses))
+	for _, resp := range responses {
+		if resp.Error != nil {
+			continue
+		}
+		if len(inView) > 0 && resp.Response.OperationResponse.ViewID > inView[0].ViewID {
+			inView = inView[:0]
+		}
+		if len(inView) == 0 || resp.Response.OperationResponse.ViewID == inView[0].ViewID {
+			inView = append(inView, resp.Response.OperationResponse)
+		}
+	}
+	if mode == protocol.Inconsistent {
+		if protocol.MajorityQuorum(len(inView), total) {
+			return inView[0]
+		}
+		return nil
+	}
+	// protocol.Consensus: find the most common result amongst the replicas
+	var decided, failed *protocol.OperationResponse
+	decidedCount, failedCount := 0, 0
+	for _, candidate := range inView {
+		count := 0
+		for _, other := range inView {
+			if sameOperationResult(candidate, other) {
+				count++
+			}
+		}
+		if count > decidedCount {
+			decided = candidate
+			decidedCount = count
+		}
+		if candidate.Error != nil && count > failedCount {
+			failed = candidate
+			failedCount = count
+		}
+	}
+	if protocol.FastQuorum(decidedCount, total) {
+		return decided
+	}
+	// Slow path, the replicas didn't agree so the client decides from a classic quorum in the same view
+	if final && protocol.MajorityQuorum(len(inView), total) {
+		// A success returned by a minority may have missed a conflicting operation that the other replicas validated
+		// against, so it fails unless a majority agree on it
+		if decided.Error == nil && !protocol.MajorityQuorum(decidedCount, total) && failed != nil {
+			return failed
+		}
+		return decided
+	}
+	return nil
+}
+
+// sameOperationResult is true if two replicas returned the same result, regardless of their views
+func sameOperationResult(a *protocol.OperationResponse, b *protocol.OperationResponse) bool {
+	return reflect.DeepEqual(a.ReadValues, b.ReadValues) && reflect.DeepEqual(a.ScanResults, b.ScanResults) && reflect.DeepEqual(a.Error, b.Error)
+}
+
+// finalize sends the consensus result of an operation to the replicas, so they mark it FINALIZED and apply its writes if
+// it succeeded. It returns once a majority confirmed the result, after which a view change keeps a slow path result.
+func (c *Client) finalize(operationRequest *protocol.OperationRequest, result *protocol.OperationResponse, slowPath bool) error {
+	finalize := &protocol.OperationRequest{
+		Mode:          operationRequest.Mode,
+		ClientID:      operationRequest.ClientID,
+		TransactionID: operationRequest.TransactionID,
+		Finalize:      operationRequest.Propose,
+		SlowPath:      slowPath,
+		Result:        result,
+	}
+	// Buffered so that late confirmations don't block. A confirmation is the view of the replica, or -1 if it failed.
+	confirmations := make(chan int, len(c.Connections))
+	done := make(chan struct{})
+	defer close(done)
+	for _, conn := range c.Connections {
+		go func(conn *protocol.ConnHandler) {
+			for {
+				resp, err := conn.SendRequest(&protocol.AnyMessage{
+					RequestID:        uuid.New().String(),
+					OperationRequest: finalize,
+				})
+				if err == nil && resp.OperationResponse != nil && resp.OperationResponse.Error != nil && resp.OperationResponse.Error.Code == protocol.ErrorCodeRetry {
+					// The replica is changing views, send the result again once it may be NORMAL
+					select {
+					case <-done:
+						return
+					case <-c.clock.After(c.retryInterval()):
+						continue
+					}
+				}
+				if err == nil && (resp.OperationResponse == nil || resp.OperationResponse.Error != nil) {
+					err = fmt.Errorf("unexpected response to finalize: %+v", resp)
+				}
+				if err != nil {
+					logrus.Debugf("Error finalizing operation %s: %v", finalize.TransactionID, err)
+					confirmations <- -1
+				} else {
+					confirmations <- resp.OperationResponse.ViewID
+				}
+				return
+			}
+		}(conn)
+	}
+	total := len(c.Connections)
+	// The result persists across view changes once a majority of the replicas of one view finalized it
+	confirmedInView := make(map[int]int)
+	confirmed := 0
+	deadline := c.clock.After(c.timeout())
+	for received := 0; received < total; received++ {
+		select {
+		case viewID := <-confirmations:
+			if viewID < 0 {
+				continue
+			}
+			confirmedInView[viewID]++
+			confirmed = max(confirmed, confirmedInView[viewID])
+			if protocol.MajorityQuorum(confirmed, total) {
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("%w: %d out of %d replicas confirmed the result of operation %s", ErrUnknownOutcome, confirmed, total, finalize.TransactionID)
+		}
+	}
+	return fmt.Errorf("%w: %d out of %d replicas confirmed the result of operation %s", ErrUnknownOutcome, confirmed, total, finalize.TransactionID)
+}
+
+// notifyOlderViews tells replicas that responded from an older view about the latest view seen
+func (c *Client) notifyOlderViews(responses []*protocol.MaybeError) {
+	latestView := 0
+	for _, resp := range responses {
+		if resp.Error == nil {
+			latestView = max(latestView, resp.Response.OperationResponse.ViewID)
+		}
+	}
+	for _, resp := range responses {
+		if resp.Error != nil || resp.Response.OperationResponse.ViewID >= latestView {
+			continue
+		}
+		logrus.Debugf("Notifying replica %s in view %d of view %d", resp.Conn.RemoteAddr(), resp.Response.OperationResponse.ViewID, latestView)
+		err := resp.Conn.SendUntracked(&protocol.AnyMessage{
+			RequestID:        uuid.New().String(),
+			ViewNotification: &protocol.ViewNotification{ViewID: latestView},
+		})
+		if err != nil {
+			logrus.Warnf("Error notifying replica of newer view: %v", err)
+		}
+	}
+}
+
+// retryInterval is how long to wait before sending an operation or its result again while the replicas change views
+func (c *Client) retryInterval() time.Duration {
+	return c.timeout() / viewMismatchAttempts
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return c.Timeout
+}
+
+func clientRequestHandler(ch *protocol.ConnHandler, m *protocol.AnyMessage) {
+	if m.Ping != 0 {
+		logrus.Tracef("Client received ping: %+v\n", m)
+		err := ch.SendUntracked(&protocol.AnyMessage{RequestID: m.RequestID, Pong: m.Ping})
+		if err != nil {
+			logrus.Warnf("Error sending pong: %v", err)
+		}
+	} else {
+		// Responses are handled by SendRequest, so this is a response that arrived after the request timed out
+		logrus.Debugf("Ignoring late response: %+v", m)
+	}
+}
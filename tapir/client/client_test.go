@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeReplicas answer the proposes of consensus operations with the read values of each replica, and finalizes
+// once release is closed, counting the requests they answered
+type fakeReplicas struct {
+	ctx     context.Context
+	results map[string]map[string]string
+	release chan struct{}
+	// finalized receives the address of each replica that answered a finalize
+	finalized chan string
+	mx        sync.Mutex
+	proposes  int
+	finalizes int
+}
+
+func (f *fakeReplicas) Listen(addr string) (net.Listener, error) {
+	return nil, errors.New("fake replicas can't be listened on")
+}
+
+func (f *fakeReplicas) Dial(addr string) (net.Conn, error) {
+	conn, replica := net.Pipe()
+	protocol.NewConnHandler(f.ctx, replica, func(ch *protocol.ConnHandler, m *protocol.AnyMessage) {
+		// net.Pipe is synchronous, so answer without blocking the reads of the connection
+		go f.handle(addr, ch, m)
+	}, func() {})
+	return conn, nil
+}
+
+func (f *fakeReplicas) handle(addr string, ch *protocol.ConnHandler, m *protocol.AnyMessage) {
+	request := m.OperationRequest
+	if request == nil {
+		return
+	}
+	response := &protocol.OperationResponse{ViewID: 1}
+	if request.Finalize != nil {
+		<-f.release
+		f.mx.Lock()
+		f.finalizes++
+		f.mx.Unlock()
+		defer func() { f.finalized <- addr }()
+	} else {
+		response.ReadValues = f.results[addr]
+		f.mx.Lock()
+		f.proposes++
+		f.mx.Unlock()
+	}
+	// The client may have closed the connection once it returned
+	_ = ch.SendUntracked(&protocol.AnyMessage{RequestID: m.RequestID, OperationResponse: response})
+}
+
+// answered are the proposes and finalizes answered so far
+func (f *fakeReplicas) answered() (int, int) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.proposes, f.finalizes
+}
+
+// TestOperationRoundTrips checks that a result decided on the fast path is returned after the propose, while the
+// result decided on the slow path is only returned once a majority of the replicas finalized it
+func TestOperationRoundTrips(t *testing.T) {
+	replicas := []string{"10.0.0.1:7000", "10.0.0.2:7000", "10.0.0.3:7000"}
+	tests := []struct {
+		name    string
+		results []string
+		// roundTrips before the operation returns, the propose and then the finalize on the slow path
+		roundTrips int
+	}{
+		{name: "fast path", results: []string{"1", "1", "1"}, roundTrips: 1},
+		{name: "slow path", results: []string{"1", "1", "2"}, roundTrips: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			fake := &fakeReplicas{
+				ctx:       ctx,
+				results:   make(map[string]map[string]string),
+				release:   make(chan struct{}),
+				finalized: make(chan string, len(replicas)),
+			}
+			for i, addr := range replicas {
+				fake.results[addr] = map[string]string{"k": test.results[i]}
+			}
+			if test.roundTrips > 1 {
+				close(fake.release)
+			}
+			c, err := DialNetwork(ctx, fake, protocol.RealClock{}, replicas)
+			if err != nil {
+				t.Fatalf("error dialing: %v", err)
+			}
+			defer c.Close()
+			c.Timeout = time.Second
+
+			if _, err := c.SendOperation(&protocol.Operation{ReadSet: []string{"k"}, WriteSet: map[string]string{"k": "3"}}); err != nil {
+				t.Fatalf("error sending operation: %v", err)
+			}
+			proposes, finalizes := fake.answered()
+			roundTrips := 0
+			if proposes == len(replicas) {
+				roundTrips++
+			}
+			if protocol.MajorityQuorum(finalizes, len(replicas)) {
+				roundTrips++
+			}
+			if roundTrips != test.roundTrips || (roundTrips == 1 && finalizes > 0) {
+				t.Errorf("expected %d round trips, returned after %d proposes and %d finalizes", test.roundTrips, proposes, finalizes)
+			}
+
+			// Every replica finalizes the result eventually, on the fast path after the client returned
+			if test.roundTrips == 1 {
+				close(fake.release)
+			}
+			for range replicas {
+				select {
+				case <-fake.finalized:
+				case <-time.After(5 * time.Second):
+					_, finalizes := fake.answered()
+					t.Fatalf("only %d of %d replicas finalized the result", finalizes, len(replicas))
+				}
+			}
+		})
+	}
+}
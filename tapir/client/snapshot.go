@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"github.com/sirupsen/logrus"
+	"net"
+)
+
+// SnapshotReader reads a consistent snapshot of the storage of a single replica, one chunk at a time
+type SnapshotReader struct {
+	conn       *protocol.ConnHandler
+	snapshotID string
+	chunkSize  int
+	cancel     context.CancelFunc
+}
+
+// OpenSnapshot connects to the replica at addr to read a snapshot, a chunkSize of 0 uses the replica's default
+func OpenSnapshot(ctx context.Context, addr string, chunkSize int) (*SnapshotReader, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to server %s: %w", addr, err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &SnapshotReader{
+		conn: protocol.NewConnHandler(ctx, conn, clientRequestHandler, func() {
+			logrus.Debugf("Connection to server closed: %s", addr)
+		}),
+		snapshotID: uuid.New().String(),
+		chunkSize:  chunkSize,
+		cancel:     cancel,
+	}, nil
+}
+
+// Next returns the next chunk of the snapshot, the last chunk has Last set
+func (r *SnapshotReader) Next() (*protocol.SnapshotChunk, error) {
+	resp, err := r.conn.SendRequest(&protocol.AnyMessage{
+		RequestID: uuid.New().String(),
+		SnapshotRequest: &protocol.SnapshotRequest{
+			SnapshotID: r.snapshotID,
+			ChunkSize:  r.chunkSize,
+		},
+	})
+	if errors.Is(err, protocol.ErrRequestTimeout) {
+		return nil, fmt.Errorf("%w: %w", ErrTimeout, err)
+	} else if err != nil {
+		return nil, err
+	}
+	if resp.SnapshotResponse == nil {
+		return nil, fmt.Errorf("unexpected response to snapshot request: %+v", resp)
+	}
+	if resp.SnapshotResponse.Error != nil {
+		return nil, clientError(resp.SnapshotResponse.Error)
+	}
+	if resp.SnapshotResponse.Chunk == nil {
+		return nil, fmt.Errorf("snapshot response has no chunk")
+	}
+	return resp.SnapshotResponse.Chunk, nil
+}
+
+// Close the connection to the replica, the replica abandons the snapshot if it hasn't been read to the end
+func (r *SnapshotReader) Close() {
+	r.conn.Close()
+	r.cancel()
+}
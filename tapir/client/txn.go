@@ -0,0 +1,252 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/history"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"unicode/utf8"
+)
+
+// Txn is a client-side representation of a transaction
+type Txn struct {
+	client *Client
+	// Cache of read values
+	readSet map[string]string
+	// Values being written, used alongside readSet for compare and swap
+	writeSet map[string]string
+	// Keys being deleted, a key is never in both writeSet and deleteSet
+	deleteSet map[string]bool
+	// Ranges scanned with the values the replicas returned, compared on commit to detect phantoms
+	rangeReads []protocol.RangeRead
+	closed     bool
+	// historyID identifies the transaction in the history of the client
+	historyID int
+}
+
+// Get reads a key, returning the value written or read earlier in the transaction if there is one
+func (t *Txn) Get(key string) (string, error) {
+	if t.closed {
+		return "", ErrTxnClosed
+	}
+	if err := validUTF8(key); err != nil {
+		return "", err
+	}
+	if v, ok := t.writeSet[key]; ok {
+		return v, nil
+	}
+	if t.deleteSet[key] {
+		return "", nil
+	}
+	if v, ok := t.readSet[key]; ok {
+		return v, nil
+	}
+	logrus.Debugf("Reading key: %s...\n", key)
+	resp, err := t.client.SendOperationRequest([]string{key}, nil)
+	if err != nil {
+		return "", fmt.Errorf("error reading key: %w", err)
+	}
+	t.readSet[key] = resp.ReadValues[key]
+	return t.readSet[key], nil
+}
+
+// Scan reads up to limit keys from start (inclusive) to end (exclusive) in key order, including the writes made earlier
+// in the transaction. An empty end is unbounded and a limit of 0 is unlimited. The transaction aborts on commit if
+// another transaction changed the range in the meantime.
+func (t *Txn) Scan(start string, end string, limit int) ([]protocol.KeyValue, error) {
+	return t.scan(protocol.KeyRange{Start: start, End: end, Limit: limit})
+}
+
+// ScanPrefix is a Scan of the keys starting with prefix
+func (t *Txn) ScanPrefix(prefix string, limit int) ([]protocol.KeyValue, error) {
+	return t.scan(protocol.PrefixRange(prefix, limit))
+}
+
+func (t *Txn) scan(r protocol.KeyRange) ([]protocol.KeyValue, error) {
+	if t.closed {
+		return nil, ErrTxnClosed
+	}
+	if err := validUTF8(r.Start, r.End); err != nil {
+		return nil, err
+	}
+	logrus.Debugf("Scanning range [%s, %s)...\n", r.Start, r.End)
+	resp, err := t.client.SendOperation(&protocol.Operation{ScanSet: []protocol.KeyRange{r}})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning range: %w", err)
+	}
+	if len(resp.ScanResults) != 1 {
+		return nil, fmt.Errorf("expected 1 scan result but received %d", len(resp.ScanResults))
+	}
+	committed := resp.ScanResults[0].Values
+	t.rangeReads = append(t.rangeReads, protocol.RangeRead{Range: r, Values: committed})
+	values := make(map[string]string, len(committed))
+	for _, kv := range committed {
+		if _, ok := t.readSet[kv.Key]; !ok {
+			t.readSet[kv.Key] = kv.Value
+		}
+		values[kv.Key] = kv.Value
+	}
+	for key, value := range t.writeSet {
+		if !r.Contains(key) {
+			continue
+		}
+		// If the results were truncated by the limit, keys after the last one may not be the next in order
+		if r.Limit > 0 && len(committed) == r.Limit && key > committed[len(committed)-1].Key {
+			continue
+		}
+		values[key] = value
+	}
+	for key := range t.deleteSet {
+		delete(values, key)
+	}
+	result := make([]protocol.KeyValue, 0, len(values))
+	for key, value := range values {
+		result = append(result, protocol.KeyValue{Key: key, Value: value})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	if r.Limit > 0 && len(result) > r.Limit {
+		result = result[:r.Limit]
+	}
+	return result, nil
+}
+
+// Put writes a key, nothing is sent to the replicas until the transaction commits
+func (t *Txn) Put(key string, value string) error {
+	if t.closed {
+		return ErrTxnClosed
+	}
+	if err := validUTF8(key, value); err != nil {
+		return err
+	}
+	t.writeSet[key] = value
+	delete(t.deleteSet, key)
+	return nil
+}
+
+// Delete removes a key, nothing is sent to the replicas until the transaction commits
+func (t *Txn) Delete(key string) error {
+	if t.closed {
+		return ErrTxnClosed
+	}
+	if err := validUTF8(key); err != nil {
+		return err
+	}
+	t.deleteSet[key] = true
+	delete(t.writeSet, key)
+	return nil
+}
+
+// validUTF8 returns ErrInvalidUTF8 if any of the strings would be changed by sending them to the replicas
+func validUTF8(values ...string) error {
+	for _, value := range values {
+		if !utf8.ValidString(value) {
+			return fmt.Errorf("%w: %q", ErrInvalidUTF8, value)
+		}
+	}
+	return nil
+}
+
+// Commit sends the reads and writes of the transaction to the replicas. Writes and deletes of keys that were read are
+// compare and swap on the value that was read, the other keys that were read are compared with the value that was read,
+// and scanned ranges are compared with the values that were scanned, so a transaction that only read is validated too.
+// If the error is ErrRetry the transaction is left open and can be committed again.
+func (t *Txn) Commit() error {
+	if t.closed {
+		return ErrTxnClosed
+	}
+	if len(t.readSet) == 0 && len(t.writeSet) == 0 && len(t.deleteSet) == 0 && len(t.rangeReads) == 0 {
+		t.closed = true
+		t.record(history.Ok, nil)
+		return nil
+	}
+	logrus.Debugf("Committing transaction...\n")
+	// Writes and deletes of keys that were read are compare and swap, others are blind
+	op := &protocol.Operation{
+		ReadCSet:  make(map[string]string),
+		WriteCSet: make(map[string]protocol.PutcOp),
+		WriteSet:  make(map[string]string),
+		RangeCSet: t.rangeReads,
+	}
+	for k, v := range t.readSet {
+		if _, written := t.writeSet[k]; !written && !t.deleteSet[k] {
+			op.ReadCSet[k] = v
+		}
+	}
+	for k, v := range t.writeSet {
+		if previous, ok := t.readSet[k]; ok {
+			op.WriteCSet[k] = protocol.PutcOp{Previous: previous, Proposed: v}
+		} else {
+			op.WriteSet[k] = v
+		}
+	}
+	for k := range t.deleteSet {
+		if previous, ok := t.readSet[k]; ok {
+			op.WriteCSet[k] = protocol.PutcOp{Previous: previous, Delete: true}
+		} else {
+			op.DeleteSet = append(op.DeleteSet, k)
+		}
+	}
+	resp, err := t.client.SendOperation(op)
+	if errors.Is(err, ErrRetry) {
+		return err
+	}
+	t.closed = true
+	if err != nil {
+		if errors.Is(err, ErrAborted) {
+			t.record(history.Fail, err)
+		} else {
+			// The replicas may have committed the transaction without the client finding out
+			t.record(history.Info, err)
+		}
+		return err
+	}
+	t.record(history.Ok, nil)
+	logrus.Debugf("Received response: %+v\n", resp)
+	return nil
+}
+
+// Abort abandons the transaction
+func (t *Txn) Abort() error {
+	if t.closed {
+		return ErrTxnClosed
+	}
+	logrus.Debugf("Rolling back transaction...\n")
+	t.closed = true
+	t.record(history.Fail, nil)
+	return nil
+}
+
+// record the outcome of the transaction in the history of the client
+func (t *Txn) record(eventType history.EventType, err error) {
+	if t.client.History == nil || t.historyID == 0 {
+		// The history was set after the transaction began
+		return
+	}
+	e := history.Event{
+		Type:    eventType,
+		Txn:     t.historyID,
+		Process: t.client.ID,
+		Time:    t.client.clock.Now(),
+		Reads:   make(map[string]string, len(t.readSet)),
+		Writes:  make(map[string]string, len(t.writeSet)),
+		Deletes: make([]string, 0, len(t.deleteSet)),
+	}
+	for k, v := range t.readSet {
+		e.Reads[k] = v
+	}
+	for k, v := range t.writeSet {
+		e.Writes[k] = v
+	}
+	for k := range t.deleteSet {
+		e.Deletes = append(e.Deletes, k)
+	}
+	sort.Strings(e.Deletes)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	t.client.History.Complete(e)
+}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"sort"
+)
+
+// Divergence is a key range where the replicas don't have the same committed values
+type Divergence struct {
+	Range protocol.KeyRange
+	// Digests of the range by replica address
+	Digests map[string]protocol.RangeDigest
+	// Majority are the replicas with the most common digest, the other replicas need repair. It is empty if no digest is
+	// shared by a majority of the replicas, as then it isn't known which data is correct.
+	Majority []string
+}
+
+// VerifyReport is the result of comparing the committed values of every replica
+type VerifyReport struct {
+	Replicas []string
+	// Unreachable replicas by address, these are not compared
+	Unreachable map[string]error
+	Divergences []Divergence
+}
+
+// Verify compares hashes of the committed values of every replica. Diverging ranges are narrowed down by splitting them
+// into prefixes one byte longer, up to maxDepth bytes. Replicas don't share timestamps, so the values can't be compared
+// as of a given time; instead each replica hashes from a consistent read when it receives the request, and writes in
+// progress can show up as divergences.
+func (c *Client) Verify(maxDepth int) (*VerifyReport, error) {
+	report := &VerifyReport{Unreachable: make(map[string]error)}
+	replicas := make(map[string]*protocol.ConnHandler)
+	for _, conn := range c.Connections {
+		addr := conn.RemoteAddr().String()
+		replicas[addr] = conn
+		report.Replicas = append(report.Replicas, addr)
+	}
+	pending := [][]protocol.KeyRange{{protocol.PrefixRange("", 0)}}
+	for depth := 0; len(pending) > 0; depth++ {
+		var next [][]protocol.KeyRange
+		for _, ranges := range pending {
+			digests := make(map[string][]protocol.RangeDigest)
+			for addr, conn := range replicas {
+				replicaDigests, err := requestDigests(conn, ranges)
+				if err != nil {
+					report.Unreachable[addr] = err
+					delete(replicas, addr)
+					continue
+				}
+				digests[addr] = replicaDigests
+			}
+			if len(digests) < 2 {
+				return report, fmt.Errorf("%w: %d out of %d replicas responded", ErrNoQuorum, len(digests), len(report.Replicas))
+			}
+			for i, r := range ranges {
+				divergence := compareDigests(r, i, digests, len(report.Replicas))
+				if divergence == nil {
+					continue
+				}
+				if depth < maxDepth && divergence.isPrefix() {
+					next = append(next, splitPrefix(r.Start))
+				} else {
+					report.Divergences = append(report.Divergences, *divergence)
+				}
+			}
+		}
+		pending = next
+	}
+	return report, nil
+}
+
+// RepairSource returns a replica in the majority of every divergence, to repair the other replicas from. It is an error
+// if a divergence has no majority or the majorities don't share a replica, as repairing could then lose committed data.
+func (r *VerifyReport) RepairSource() (string, error) {
+	var candidates []string
+	for i, divergence := range r.Divergences {
+		if len(divergence.Majority) == 0 {
+			return "", fmt.Errorf("no majority of the %d replicas agree on range [%q, %q)", len(r.Replicas), divergence.Range.Start, divergence.Range.End)
+		}
+		if i == 0 {
+			candidates = divergence.Majority
+			continue
+		}
+		shared := make([]string, 0, len(candidates))
+		for _, addr := range candidates {
+			for _, majority := range divergence.Majority {
+				if addr == majority {
+					shared = append(shared, addr)
+				}
+			}
+		}
+		if len(shared) == 0 {
+			return "", fmt.Errorf("no replica is in the majority of every diverging range, range [%q, %q) has majority %v", divergence.Range.Start, divergence.Range.End, divergence.Majority)
+		}
+		candidates = shared
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("the replicas don't diverge")
+	}
+	return candidates[0], nil
+}
+
+// Repair asks the replica at addr to replace its data and master record with a snapshot of the replica from
+func (c *Client) Repair(addr string, from string) error {
+	for _, conn := range c.Connections {
+		if conn.RemoteAddr().String() != addr {
+			continue
+		}
+		resp, err := conn.SendRequest(&protocol.AnyMessage{
+			RequestID:     uuid.New().String(),
+			RepairRequest: &protocol.RepairRequest{From: from},
+		})
+		if errors.Is(err, protocol.ErrRequestTimeout) {
+			return fmt.Errorf("%w: %w", ErrTimeout, err)
+		} else if err != nil {
+			return err
+		}
+		if resp.RepairResponse == nil {
+			return fmt.Errorf("unexpected response to repair request: %+v", resp)
+		}
+		if resp.RepairResponse.Error != nil {
+			return clientError(resp.RepairResponse.Error)
+		}
+		return nil
+	}
+	return fmt.Errorf("not connected to replica %s", addr)
+}
+
+func requestDigests(conn *protocol.ConnHandler, ranges []protocol.KeyRange) ([]protocol.RangeDigest, error) {
+	resp, err := conn.SendRequest(&protocol.AnyMessage{
+		RequestID:     uuid.New().String(),
+		DigestRequest: &protocol.DigestRequest{Ranges: ranges},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.DigestResponse == nil {
+		return nil, fmt.Errorf("unexpected response to digest request: %+v", resp)
+	}
+	if resp.DigestResponse.Error != nil {
+		return nil, clientError(resp.DigestResponse.Error)
+	}
+	if len(resp.DigestResponse.Digests) != len(ranges) {
+		return nil, fmt.Errorf("requested %d digests but received %d", len(ranges), len(resp.DigestResponse.Digests))
+	}
+	return resp.DigestResponse.Digests, nil
+}
+
+// compareDigests returns the divergence of the i-th range, or nil if every replica has the same digest. The majority
+// must be a majority of all total replicas, including those that didn't respond.
+func compareDigests(r protocol.KeyRange, i int, digests map[string][]protocol.RangeDigest, total int) *Divergence {
+	divergence := &Divergence{Range: r, Digests: make(map[string]protocol.RangeDigest)}
+	byHash := make(map[string][]string)
+	for addr, replicaDigests := range digests {
+		divergence.Digests[addr] = replicaDigests[i]
+		byHash[replicaDigests[i].Hash] = append(byHash[replicaDigests[i].Hash], addr)
+	}
+	if len(byHash) == 1 {
+		return nil
+	}
+	for _, addrs := range byHash {
+		if protocol.MajorityQuorum(len(addrs), total) {
+			sort.Strings(addrs)
+			divergence.Majority = addrs
+		}
+	}
+	return divergence
+}
+
+// isPrefix is true if the range is all the keys with a prefix, rather than a single key
+func (d *Divergence) isPrefix() bool {
+	return d.Range == protocol.PrefixRange(d.Range.Start, 0)
+}
+
+// splitPrefix returns the range of the prefix itself as a key, the ranges of the prefixes one ASCII byte longer, and
+// a range of the rest. Keys are always valid UTF-8 as they are sent as JSON strings, so ranges are split on ASCII bytes
+// which can't be part of a multibyte character.
+func splitPrefix(prefix string) []protocol.KeyRange {
+	ranges := make([]protocol.KeyRange, 0, 129)
+	ranges = append(ranges, protocol.KeyRange{Start: prefix, End: prefix + "\x00"})
+	for b := 0; b < 0x7f; b++ {
+		ranges = append(ranges, protocol.PrefixRange(prefix+string(rune(b)), 0))
+	}
+	ranges = append(ranges, protocol.KeyRange{Start: prefix + "\x7f", End: protocol.PrefixRange(prefix, 0).End})
+	return ranges
+}
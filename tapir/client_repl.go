@@ -2,38 +2,26 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/sirupsen/logrus"
+	"github.com/phughk/go-dist-algos/tapir/client"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"strconv"
 )
 
-// ClientTransaction is a client-side representation of a transaction
-type ClientTransaction struct {
-	// Cache of read values
-	ReadSet map[string]string
-	// Values being written, used alongside ReadSet for compare and swap
-	WriteSet map[string]string
-}
-
-func (ct *ClientTransaction) Empty() bool {
-	return ct == nil || (ct.ReadSet == nil && ct.WriteSet == nil)
-}
-
-func ClientRepl(ctx context.Context, client *Client) {
-	var transaction *ClientTransaction = nil
+func ClientRepl(ctx context.Context, tapirClient *client.Client) {
+	var transaction *client.Txn = nil
 	repl := NewRepl("Interactive client, type 'help' for list of commands.", []*Command{
 		{
 			Catches: []string{"start", "s", "begin", "b"},
 			Help:    "Start a new transaction",
 			MinArgs: 0,
 			Execute: func(args []string) error {
-				if !transaction.Empty() {
+				if transaction != nil {
 					fmt.Println("Abandoning previous transaction")
+					_ = transaction.Abort()
 				}
-				transaction = &ClientTransaction{
-					// TODO version
-					ReadSet:  make(map[string]string),
-					WriteSet: make(map[string]string),
-				}
+				transaction = tapirClient.Begin()
 				return nil
 			},
 		},
@@ -42,20 +30,60 @@ func ClientRepl(ctx context.Context, client *Client) {
 			Help:    "Read a value from the database",
 			MinArgs: 1,
 			Execute: func(args []string) error {
-				logrus.Debugf("Reading keys: %+v...\n", args)
-				resp, err := client.SendOperationRequest(args, nil)
-				if err != nil {
-					logrus.Warnf("Error reading key: %v\n", err)
+				txn := transaction
+				if txn == nil {
+					// Transaction is not active so this operation is standalone
+					txn = tapirClient.Begin()
+					defer txn.Abort()
 				}
-				for k, v := range resp.ReadValues {
-					if transaction != nil {
-						transaction.ReadSet[k] = v
+				for _, k := range args {
+					v, err := txn.Get(k)
+					if err != nil {
+						return err
 					}
 					fmt.Printf("%+v=%+v\n", k, v)
 				}
 				return nil
 			},
 		},
+		{
+			Catches: []string{"scan"},
+			Help:    "Scan keys from start up to end (exclusive, empty for unbounded): scan <start> [end] [limit]",
+			MinArgs: 1,
+			Execute: func(args []string) error {
+				end := ""
+				if len(args) > 1 {
+					end = args[1]
+				}
+				limit := 0
+				if len(args) > 2 {
+					var err error
+					if limit, err = strconv.Atoi(args[2]); err != nil {
+						return fmt.Errorf("invalid limit: %w", err)
+					}
+				}
+				return replScan(tapirClient, transaction, func(txn *client.Txn) ([]protocol.KeyValue, error) {
+					return txn.Scan(args[0], end, limit)
+				})
+			},
+		},
+		{
+			Catches: []string{"prefix"},
+			Help:    "Scan keys starting with a prefix: prefix <prefix> [limit]",
+			MinArgs: 1,
+			Execute: func(args []string) error {
+				limit := 0
+				if len(args) > 1 {
+					var err error
+					if limit, err = strconv.Atoi(args[1]); err != nil {
+						return fmt.Errorf("invalid limit: %w", err)
+					}
+				}
+				return replScan(tapirClient, transaction, func(txn *client.Txn) ([]protocol.KeyValue, error) {
+					return txn.ScanPrefix(args[0], limit)
+				})
+			},
+		},
 		{
 			Catches: []string{"write", "w", "put", "p"},
 			Help:    "Write a value to the database",
@@ -63,21 +91,34 @@ func ClientRepl(ctx context.Context, client *Client) {
 			Execute: func(args []string) error {
 				if transaction != nil {
 					// Active transaction, cache writes
-					transaction.WriteSet[args[0]] = args[1]
-				} else {
+					return transaction.Put(args[0], args[1])
+				}
+				// Transaction is not active so this operation is standalone
+				txn := tapirClient.Begin()
+				if err := txn.Put(args[0], args[1]); err != nil {
+					return err
+				}
+				return txn.Commit()
+			},
+		},
+		{
+			Catches: []string{"delete", "del"},
+			Help:    "Delete keys from the database",
+			MinArgs: 1,
+			Execute: func(args []string) error {
+				txn := transaction
+				if txn == nil {
 					// Transaction is not active so this operation is standalone
-					logrus.Debugf("Writing key: %s, value: %s...\n", args[0], args[1])
-					resp, err := client.SendOperationRequest([]string{}, map[string]PutcOp{args[0]: {
-						Previous: "",
-						Proposed: args[1],
-					}})
-					if err != nil {
-						logrus.Warnf("Error writing key: %v", err)
-					}
-					for k, v := range resp.ReadValues {
-						fmt.Printf("%+v=%+v\n", k, v)
+					txn = tapirClient.Begin()
+				}
+				for _, k := range args {
+					if err := txn.Delete(k); err != nil {
+						return err
 					}
 				}
+				if transaction == nil {
+					return txn.Commit()
+				}
 				return nil
 			},
 		},
@@ -86,27 +127,17 @@ func ClientRepl(ctx context.Context, client *Client) {
 			Help:    "Commit the transaction",
 			MinArgs: 0,
 			Execute: func(args []string) error {
-				if transaction.Empty() {
-					transaction = nil
-				} else {
-					logrus.Debugf("Committing transaction...\n")
-					// make a new write set including reads as no-op
-					newWriteSet := make(map[string]PutcOp)
-					for k, v := range transaction.WriteSet {
-						newWriteSet[k] = PutcOp{
-							Previous: transaction.ReadSet[k],
-							Proposed: v,
-						}
-					}
-					newReadSet := make([]string, 0, len(transaction.ReadSet))
-					for k := range transaction.ReadSet {
-						newReadSet = append(newReadSet, k)
-					}
-					resp, err := client.SendOperationRequest(newReadSet, newWriteSet)
-					if err != nil {
-						logrus.Warnf("Error committing transaction: %v\n", err)
-					}
-					logrus.Debugf("Received response: %+v\n", resp)
+				if transaction == nil {
+					return nil
+				}
+				err := transaction.Commit()
+				if errors.Is(err, client.ErrRetry) {
+					// Keep the transaction so that it can be committed again
+					return fmt.Errorf("error committing transaction, commit again to retry: %w", err)
+				}
+				transaction = nil
+				if err != nil {
+					return fmt.Errorf("error committing transaction: %w", err)
 				}
 				return nil
 			},
@@ -116,7 +147,9 @@ func ClientRepl(ctx context.Context, client *Client) {
 			Help:    "Cancel or rollback the transaction",
 			MinArgs: 0,
 			Execute: func(args []string) error {
-				logrus.Debugf("Rolling back transaction...\n")
+				if transaction != nil {
+					_ = transaction.Abort()
+				}
 				transaction = nil
 				return nil
 			},
@@ -124,3 +157,21 @@ func ClientRepl(ctx context.Context, client *Client) {
 	})
 	repl.Loop(ctx)
 }
+
+// replScan runs the scan in the active transaction, or standalone if there isn't one, and prints the results
+func replScan(tapirClient *client.Client, transaction *client.Txn, scan func(txn *client.Txn) ([]protocol.KeyValue, error)) error {
+	txn := transaction
+	if txn == nil {
+		txn = tapirClient.Begin()
+		defer txn.Abort()
+	}
+	values, err := scan(txn)
+	if err != nil {
+		return err
+	}
+	for _, kv := range values {
+		fmt.Printf("%+v=%+v\n", kv.Key, kv.Value)
+	}
+	fmt.Printf("(%d keys)\n", len(values))
+	return nil
+}
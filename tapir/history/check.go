@@ -0,0 +1,540 @@
+package history
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kind of dependency between two committed transactions
+type Kind string
+
+const (
+	// WW the second transaction overwrote a value the first wrote
+	WW Kind = "ww"
+	// WR the second transaction read a value the first wrote
+	WR Kind = "wr"
+	// RW the second transaction overwrote a value the first read, an anti-dependency
+	RW Kind = "rw"
+	// Realtime the second transaction started after the first completed
+	Realtime Kind = "rt"
+)
+
+// kinds in the order they are preferred when describing a cycle, the weakest dependency first
+var kinds = []Kind{WW, WR, RW, Realtime}
+
+// Transaction is the invocation of a transaction paired with its completion
+type Transaction struct {
+	ID      int
+	Process string
+	// Type is Ok, Fail or Info, transactions that never completed are Info
+	Type    EventType
+	Start   time.Time
+	End     time.Time
+	Reads   map[string]string
+	Writes  map[string]string
+	Deletes []string
+	Error   string
+}
+
+func (t *Transaction) String() string {
+	return fmt.Sprintf("T%d %s %s reads %v writes %v deletes %v", t.ID, t.Process, t.Type, t.Reads, t.Writes, t.Deletes)
+}
+
+// Dependency of one transaction on another, caused by the key
+type Dependency struct {
+	From int
+	To   int
+	Kind Kind
+	Key  string
+}
+
+// Anomaly is a violation of serializability. Cycles are the shortest cycle of dependencies that shows the anomaly.
+type Anomaly struct {
+	// Type is G0, G1a, G1c, G-single, G2, lost-update or garbage-read, with a -realtime suffix when the cycle needs
+	// a realtime dependency
+	Type         string
+	Description  string
+	Transactions []int
+	Cycle        []Dependency
+}
+
+func (a Anomaly) String() string {
+	if len(a.Cycle) == 0 {
+		return fmt.Sprintf("%s: %s", a.Type, a.Description)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: T%d", a.Type, a.Cycle[0].From)
+	for _, d := range a.Cycle {
+		if d.Key == "" {
+			fmt.Fprintf(&b, " -%s-> T%d", d.Kind, d.To)
+		} else {
+			fmt.Fprintf(&b, " -%s(%s)-> T%d", d.Kind, d.Key, d.To)
+		}
+	}
+	return b.String()
+}
+
+// Options of the checker
+type Options struct {
+	// Realtime also requires transactions to be ordered as they happened in real time, which is strict serializability
+	Realtime bool
+}
+
+// Report of a history
+type Report struct {
+	Transactions map[int]*Transaction
+	Committed    int
+	Failed       int
+	Unknown      int
+	// UncheckedKeys were written more than once with the same value, or deleted, so their versions can't be told
+	// apart and no dependencies are inferred from them
+	UncheckedKeys []string
+	Anomalies     []Anomaly
+}
+
+func (r *Report) Valid() bool {
+	return len(r.Anomalies) == 0
+}
+
+// Check searches a history for dependency cycles between committed transactions and other anomalies.
+//
+// Like Elle, the checker relies on every value of a key being written once. The version order of a key is inferred
+// from transactions that read a value and then overwrote it, so a blind write has no place in it, and the dependencies
+// found are only a subset of the real ones: a reported anomaly is real, but a history without anomalies may still
+// not be serializable. Predicates of scans are not checked, only the values they returned.
+func Check(events []Event, opts Options) *Report {
+	c := &checker{
+		report: &Report{Transactions: pairTransactions(events), Anomalies: make([]Anomaly, 0)},
+		graph:  make(map[int]map[int]*edge),
+	}
+	c.index()
+	c.inferDependencies()
+	if opts.Realtime {
+		c.realtimeDependencies()
+	}
+	c.findCycles([]Kind{WW}, WW)
+	c.findCycles([]Kind{WW, WR}, WR)
+	c.findCycles([]Kind{WW, WR, RW}, RW)
+	if opts.Realtime {
+		c.findCycles(kinds, Realtime)
+	}
+	return c.report
+}
+
+func pairTransactions(events []Event) map[int]*Transaction {
+	txns := make(map[int]*Transaction)
+	for _, e := range events {
+		t, ok := txns[e.Txn]
+		if !ok {
+			t = &Transaction{ID: e.Txn, Process: e.Process, Type: Info, Start: e.Time, End: e.Time}
+			txns[e.Txn] = t
+		}
+		if e.Type == Invoke {
+			t.Start = e.Time
+			continue
+		}
+		t.Type = e.Type
+		t.End = e.Time
+		t.Reads = e.Reads
+		t.Writes = e.Writes
+		t.Deletes = e.Deletes
+		t.Error = e.Error
+	}
+	return txns
+}
+
+type checker struct {
+	report *Report
+	// writers of each value of each key, a delete writes an empty value
+	writers map[string]map[string][]*Transaction
+	// successors of each value of each key, the committed transactions that read the value and overwrote it
+	successors map[string]map[string][]*Transaction
+	unchecked  map[string]bool
+	// committed transactions are the Ok ones, and the Info ones whose writes were read
+	committed map[int]bool
+	graph     map[int]map[int]*edge
+}
+
+type edge struct {
+	// keys causing the edge by kind
+	keys map[Kind]string
+}
+
+// writes of the transaction with deletes as empty values
+func (t *Transaction) writes() map[string]string {
+	writes := make(map[string]string, len(t.Writes)+len(t.Deletes))
+	for k, v := range t.Writes {
+		writes[k] = v
+	}
+	for _, k := range t.Deletes {
+		writes[k] = ""
+	}
+	return writes
+}
+
+func (c *checker) index() {
+	c.writers = make(map[string]map[string][]*Transaction)
+	c.unchecked = make(map[string]bool)
+	c.committed = make(map[int]bool)
+	for _, t := range c.sorted() {
+		switch t.Type {
+		case Ok:
+			c.report.Committed++
+			c.committed[t.ID] = true
+		case Fail:
+			c.report.Failed++
+		default:
+			c.report.Unknown++
+		}
+		for k, v := range t.writes() {
+			if c.writers[k] == nil {
+				c.writers[k] = make(map[string][]*Transaction)
+			}
+			c.writers[k][v] = append(c.writers[k][v], t)
+		}
+	}
+	for k, values := range c.writers {
+		for v := range values {
+			if _, ambiguous := c.writer(k, v); ambiguous || (v == "" && len(c.candidates(k, v)) > 0) {
+				c.unchecked[k] = true
+			}
+		}
+	}
+	// Unknown transactions committed if a committed transaction read what they wrote
+	for _, t := range c.sorted() {
+		if t.Type != Ok {
+			continue
+		}
+		for k, v := range t.Reads {
+			if w, _ := c.writer(k, v); w != nil && !c.unchecked[k] {
+				c.committed[w.ID] = true
+			}
+		}
+	}
+	c.successors = make(map[string]map[string][]*Transaction)
+	for _, t := range c.sorted() {
+		if !c.committed[t.ID] {
+			continue
+		}
+		for k := range t.writes() {
+			v, ok := t.Reads[k]
+			if !ok || c.unchecked[k] {
+				continue
+			}
+			if c.successors[k] == nil {
+				c.successors[k] = make(map[string][]*Transaction)
+			}
+			c.successors[k][v] = append(c.successors[k][v], t)
+		}
+	}
+	for k := range c.unchecked {
+		c.report.UncheckedKeys = append(c.report.UncheckedKeys, k)
+	}
+	sort.Strings(c.report.UncheckedKeys)
+}
+
+// candidates to have written the value, which are the transactions that wrote it and didn't fail
+func (c *checker) candidates(k string, v string) []*Transaction {
+	candidates := make([]*Transaction, 0)
+	for _, t := range c.writers[k][v] {
+		if t.Type != Fail {
+			candidates = append(candidates, t)
+		}
+	}
+	return candidates
+}
+
+// writer of the value, preferring a committed transaction over unknown ones. It is nil for the initial empty value,
+// and ambiguous if more than one transaction could have written it.
+func (c *checker) writer(k string, v string) (*Transaction, bool) {
+	var ok, info []*Transaction
+	for _, t := range c.candidates(k, v) {
+		if t.Type == Ok {
+			ok = append(ok, t)
+		} else {
+			info = append(info, t)
+		}
+	}
+	switch {
+	case len(ok) == 1:
+		return ok[0], false
+	case len(ok) > 1:
+		return nil, true
+	case len(info) == 1:
+		return info[0], false
+	default:
+		return nil, len(info) > 1
+	}
+}
+
+func (c *checker) inferDependencies() {
+	for _, t := range c.sorted() {
+		if !c.committed[t.ID] {
+			continue
+		}
+		writes := t.writes()
+		for _, k := range sortedKeys(t.Reads) {
+			if c.unchecked[k] {
+				continue
+			}
+			v := t.Reads[k]
+			w, _ := c.writer(k, v)
+			if w == nil && v != "" {
+				if len(c.writers[k][v]) == 0 {
+					c.anomaly("garbage-read", fmt.Sprintf("T%d read %s=%q which was never written", t.ID, k, v), t.ID)
+				} else {
+					c.anomaly("G1a", fmt.Sprintf("T%d read %s=%q written by failed T%d", t.ID, k, v, c.writers[k][v][0].ID), t.ID, c.writers[k][v][0].ID)
+				}
+				continue
+			}
+			if w != nil && w != t {
+				c.depend(w, t, WR, k)
+				if _, ok := writes[k]; ok {
+					c.depend(w, t, WW, k)
+				}
+			}
+			for _, s := range c.successors[k][v] {
+				if s != t {
+					c.depend(t, s, RW, k)
+				}
+			}
+		}
+	}
+	// Two committed transactions overwriting the same value lost one of the updates
+	for _, k := range sortedKeys(c.successors) {
+		for _, v := range sortedKeys(c.successors[k]) {
+			if s := c.successors[k][v]; len(s) > 1 {
+				c.anomaly("lost-update", fmt.Sprintf("T%d and T%d both read %s=%q and overwrote it", s[0].ID, s[1].ID, k, v), s[0].ID, s[1].ID)
+			}
+		}
+	}
+}
+
+// realtimeDependencies orders each committed transaction after the transactions that completed before it started.
+// Only the latest of those are kept, the others are implied through them.
+func (c *checker) realtimeDependencies() {
+	type point struct {
+		at  time.Time
+		end bool
+		txn *Transaction
+	}
+	points := make([]point, 0)
+	for _, t := range c.sorted() {
+		if !c.committed[t.ID] {
+			continue
+		}
+		points = append(points, point{at: t.Start, txn: t})
+		// Unknown transactions may have committed any time after they started
+		if t.Type == Ok {
+			points = append(points, point{at: t.End, end: true, txn: t})
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		if !points[i].at.Equal(points[j].at) {
+			return points[i].at.Before(points[j].at)
+		}
+		// A transaction that started when another completed isn't after it
+		return !points[i].end && points[j].end
+	})
+	frontier := make([]*Transaction, 0)
+	for _, p := range points {
+		if !p.end {
+			for _, f := range frontier {
+				c.depend(f, p.txn, Realtime, "")
+			}
+			continue
+		}
+		kept := frontier[:0]
+		for _, f := range frontier {
+			if !f.End.Before(p.txn.Start) {
+				kept = append(kept, f)
+			}
+		}
+		frontier = append(kept, p.txn)
+	}
+}
+
+func (c *checker) depend(from *Transaction, to *Transaction, kind Kind, key string) {
+	if c.graph[from.ID] == nil {
+		c.graph[from.ID] = make(map[int]*edge)
+	}
+	e, ok := c.graph[from.ID][to.ID]
+	if !ok {
+		e = &edge{keys: make(map[Kind]string)}
+		c.graph[from.ID][to.ID] = e
+	}
+	if _, ok := e.keys[kind]; !ok {
+		e.keys[kind] = key
+	}
+}
+
+func (c *checker) anomaly(anomalyType string, description string, txns ...int) {
+	c.report.Anomalies = append(c.report.Anomalies, Anomaly{Type: anomalyType, Description: description, Transactions: txns})
+}
+
+// findCycles reports the shortest cycle with a dependency of the required kind in each strongly connected component
+// of the dependencies of the allowed kinds
+func (c *checker) findCycles(allowed []Kind, required Kind) {
+	for _, component := range c.components(allowed) {
+		if len(component) < 2 {
+			continue
+		}
+		in := make(map[int]bool, len(component))
+		for _, id := range component {
+			in[id] = true
+		}
+		var best []Dependency
+		for _, from := range component {
+			for _, to := range sortedKeys(c.graph[from]) {
+				key, ok := c.graph[from][to].keys[required]
+				if !ok || !in[to] {
+					continue
+				}
+				path := c.shortestPath(to, from, allowed, in)
+				if path == nil || (best != nil && len(path)+1 >= len(best)) {
+					continue
+				}
+				best = append([]Dependency{{From: from, To: to, Kind: required, Key: key}}, path...)
+			}
+		}
+		if best != nil {
+			c.report.Anomalies = append(c.report.Anomalies, cycleAnomaly(best))
+		}
+	}
+}
+
+func cycleAnomaly(cycle []Dependency) Anomaly {
+	count := make(map[Kind]int)
+	txns := make([]int, 0, len(cycle))
+	for _, d := range cycle {
+		count[d.Kind]++
+		txns = append(txns, d.From)
+	}
+	anomalyType := "G0"
+	switch {
+	case count[RW] == 1:
+		anomalyType = "G-single"
+	case count[RW] > 1:
+		anomalyType = "G2"
+	case count[WR] > 0:
+		anomalyType = "G1c"
+	}
+	if count[Realtime] > 0 {
+		anomalyType += "-realtime"
+	}
+	return Anomaly{Type: anomalyType, Description: fmt.Sprintf("cycle of %d transactions", len(cycle)), Transactions: txns, Cycle: cycle}
+}
+
+// shortestPath of dependencies of the allowed kinds between transactions in the component, nil if there is none.
+// A path from a transaction to itself is empty.
+func (c *checker) shortestPath(from int, to int, allowed []Kind, in map[int]bool) []Dependency {
+	if from == to {
+		return []Dependency{}
+	}
+	previous := map[int]Dependency{from: {}}
+	queue := []int{from}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, next := range sortedKeys(c.graph[id]) {
+			if _, seen := previous[next]; seen || !in[next] {
+				continue
+			}
+			kind, key, ok := c.graph[id][next].weakest(allowed)
+			if !ok {
+				continue
+			}
+			previous[next] = Dependency{From: id, To: next, Kind: kind, Key: key}
+			if next == to {
+				path := make([]Dependency, 0)
+				for at := to; at != from; at = previous[at].From {
+					path = append([]Dependency{previous[at]}, path...)
+				}
+				return path
+			}
+			queue = append(queue, next)
+		}
+	}
+	return nil
+}
+
+// weakest of the allowed kinds of the edge
+func (e *edge) weakest(allowed []Kind) (Kind, string, bool) {
+	for _, kind := range allowed {
+		if key, ok := e.keys[kind]; ok {
+			return kind, key, true
+		}
+	}
+	return "", "", false
+}
+
+// components are the strongly connected components of the dependencies of the allowed kinds, found with Tarjan's
+// algorithm
+func (c *checker) components(allowed []Kind) [][]int {
+	index := make(map[int]int)
+	low := make(map[int]int)
+	onStack := make(map[int]bool)
+	stack := make([]int, 0)
+	components := make([][]int, 0)
+	var connect func(id int)
+	connect = func(id int) {
+		index[id] = len(index)
+		low[id] = index[id]
+		stack = append(stack, id)
+		onStack[id] = true
+		for _, next := range sortedKeys(c.graph[id]) {
+			if _, _, ok := c.graph[id][next].weakest(allowed); !ok {
+				continue
+			}
+			if _, visited := index[next]; !visited {
+				connect(next)
+				low[id] = min(low[id], low[next])
+			} else if onStack[next] {
+				low[id] = min(low[id], index[next])
+			}
+		}
+		if low[id] == index[id] {
+			component := make([]int, 0)
+			for {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+				component = append(component, top)
+				if top == id {
+					break
+				}
+			}
+			sort.Ints(component)
+			components = append(components, component)
+		}
+	}
+	for _, id := range sortedKeys(c.graph) {
+		if _, visited := index[id]; !visited {
+			connect(id)
+		}
+	}
+	return components
+}
+
+// sorted transactions by ID, so that the checker is deterministic
+func (c *checker) sorted() []*Transaction {
+	ids := sortedKeys(c.report.Transactions)
+	txns := make([]*Transaction, len(ids))
+	for i, id := range ids {
+		txns[i] = c.report.Transactions[id]
+	}
+	return txns
+}
+
+func sortedKeys[K int | string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+	return keys
+}
@@ -0,0 +1,167 @@
+package history
+
+import (
+	"testing"
+	"time"
+)
+
+// txn is a transaction of a hand-built history, which starts and completes at the given seconds
+type txn struct {
+	id     int
+	typ    EventType
+	start  int
+	end    int
+	reads  map[string]string
+	writes map[string]string
+}
+
+func events(txns ...txn) []Event {
+	at := func(second int) time.Time {
+		return time.Unix(int64(second), 0)
+	}
+	events := make([]Event, 0, 2*len(txns))
+	for _, t := range txns {
+		events = append(events, Event{Type: Invoke, Txn: t.id, Process: "p", Time: at(t.start)})
+		events = append(events, Event{Type: t.typ, Txn: t.id, Process: "p", Time: at(t.end), Reads: t.reads, Writes: t.writes})
+	}
+	return events
+}
+
+type kv = map[string]string
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		history  []Event
+		realtime bool
+		// anomalies that must be reported, none for a valid history
+		anomalies []string
+	}{
+		{
+			name: "serializable",
+			history: events(
+				txn{id: 1, typ: Ok, start: 0, end: 1, reads: kv{"x": ""}, writes: kv{"x": "1", "y": "1"}},
+				txn{id: 2, typ: Ok, start: 2, end: 3, reads: kv{"x": "1", "y": "1"}, writes: kv{"x": "2"}},
+				txn{id: 3, typ: Ok, start: 2, end: 4, reads: kv{"y": "1"}, writes: kv{"y": "3"}},
+				txn{id: 4, typ: Ok, start: 5, end: 6, reads: kv{"x": "2", "y": "3"}},
+				txn{id: 5, typ: Fail, start: 5, end: 6, writes: kv{"x": "5"}},
+			),
+			realtime: true,
+		},
+		{
+			name: "G0",
+			history: events(
+				txn{id: 1, typ: Ok, start: 0, end: 1, reads: kv{"y": "2"}, writes: kv{"x": "1", "y": "3"}},
+				txn{id: 2, typ: Ok, start: 0, end: 1, reads: kv{"x": "1"}, writes: kv{"x": "2", "y": "2"}},
+			),
+			anomalies: []string{"G0"},
+		},
+		{
+			name: "G1a",
+			history: events(
+				txn{id: 1, typ: Fail, start: 0, end: 1, writes: kv{"x": "1"}},
+				txn{id: 2, typ: Ok, start: 0, end: 2, reads: kv{"x": "1"}},
+			),
+			anomalies: []string{"G1a"},
+		},
+		{
+			name: "G1c",
+			history: events(
+				txn{id: 1, typ: Ok, start: 0, end: 1, reads: kv{"y": "1"}, writes: kv{"x": "1"}},
+				txn{id: 2, typ: Ok, start: 0, end: 1, reads: kv{"x": "1"}, writes: kv{"y": "1"}},
+			),
+			anomalies: []string{"G1c"},
+		},
+		{
+			name: "G1c through an unknown transaction",
+			history: events(
+				txn{id: 1, typ: Info, start: 0, end: 1, reads: kv{"y": "1"}, writes: kv{"x": "1"}},
+				txn{id: 2, typ: Ok, start: 0, end: 1, reads: kv{"x": "1"}, writes: kv{"y": "1"}},
+			),
+			anomalies: []string{"G1c"},
+		},
+		{
+			name: "G-single read skew",
+			history: events(
+				txn{id: 1, typ: Ok, start: 0, end: 1, writes: kv{"x": "1", "y": "1"}},
+				txn{id: 2, typ: Ok, start: 2, end: 3, reads: kv{"x": "1", "y": "1"}, writes: kv{"x": "2", "y": "2"}},
+				txn{id: 3, typ: Ok, start: 2, end: 3, reads: kv{"x": "1", "y": "2"}},
+			),
+			anomalies: []string{"G-single"},
+		},
+		{
+			name: "G2 write skew",
+			history: events(
+				txn{id: 1, typ: Ok, start: 0, end: 1, reads: kv{"x": "", "y": ""}, writes: kv{"x": "1"}},
+				txn{id: 2, typ: Ok, start: 0, end: 1, reads: kv{"x": "", "y": ""}, writes: kv{"y": "1"}},
+			),
+			anomalies: []string{"G2"},
+		},
+		{
+			name: "lost update",
+			history: events(
+				txn{id: 1, typ: Ok, start: 0, end: 1, writes: kv{"x": "1"}},
+				txn{id: 2, typ: Ok, start: 2, end: 3, reads: kv{"x": "1"}, writes: kv{"x": "2"}},
+				txn{id: 3, typ: Ok, start: 2, end: 3, reads: kv{"x": "1"}, writes: kv{"x": "3"}},
+			),
+			anomalies: []string{"lost-update"},
+		},
+		{
+			name: "garbage read",
+			history: events(
+				txn{id: 1, typ: Ok, start: 0, end: 1, writes: kv{"x": "1"}},
+				txn{id: 2, typ: Ok, start: 2, end: 3, reads: kv{"x": "7"}},
+			),
+			anomalies: []string{"garbage-read"},
+		},
+		{
+			name: "stale read is serializable",
+			history: events(
+				txn{id: 1, typ: Ok, start: 0, end: 1, reads: kv{"x": ""}, writes: kv{"x": "1"}},
+				txn{id: 2, typ: Ok, start: 2, end: 3, reads: kv{"x": ""}},
+			),
+		},
+		{
+			name: "stale read is not strictly serializable",
+			history: events(
+				txn{id: 1, typ: Ok, start: 0, end: 1, reads: kv{"x": ""}, writes: kv{"x": "1"}},
+				txn{id: 2, typ: Ok, start: 2, end: 3, reads: kv{"x": ""}},
+			),
+			realtime:  true,
+			anomalies: []string{"G-single-realtime"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report := Check(test.history, Options{Realtime: test.realtime})
+			if len(test.anomalies) == 0 && !report.Valid() {
+				t.Errorf("expected a valid history, got %v", report.Anomalies)
+			}
+			for _, expected := range test.anomalies {
+				found := false
+				for _, anomaly := range report.Anomalies {
+					found = found || anomaly.Type == expected
+				}
+				if !found {
+					t.Errorf("expected %s, got %v", expected, report.Anomalies)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckCounts(t *testing.T) {
+	report := Check(events(
+		txn{id: 1, typ: Ok, start: 0, end: 1, writes: kv{"x": "1"}},
+		txn{id: 2, typ: Fail, start: 0, end: 1, writes: kv{"x": "2"}},
+		txn{id: 3, typ: Info, start: 0, end: 1, writes: kv{"x": "3"}},
+		txn{id: 4, typ: Ok, start: 0, end: 1, writes: kv{"y": "1"}},
+		txn{id: 5, typ: Ok, start: 0, end: 1, writes: kv{"y": "1"}},
+	), Options{})
+	if report.Committed != 3 || report.Failed != 1 || report.Unknown != 1 {
+		t.Errorf("expected 3 committed, 1 failed and 1 unknown, got %d, %d and %d", report.Committed, report.Failed, report.Unknown)
+	}
+	if len(report.UncheckedKeys) != 1 || report.UncheckedKeys[0] != "y" {
+		t.Errorf("expected y to be unchecked as it was written twice with the same value, got %v", report.UncheckedKeys)
+	}
+}
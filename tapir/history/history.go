@@ -0,0 +1,137 @@
+// Package history records the transactions of clients and checks that the committed transactions are serializable
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// EventType is the invocation of a transaction, or how it completed
+type EventType string
+
+const (
+	Invoke EventType = "invoke"
+	// Ok transactions committed
+	Ok EventType = "ok"
+	// Fail transactions aborted or never tried to commit
+	Fail EventType = "fail"
+	// Info transactions may or may not have committed, because the client gave up waiting for the outcome
+	Info EventType = "info"
+)
+
+// Event is a line of a history file. The completion of a transaction has what it read and wrote, the invocation
+// only has when it started.
+type Event struct {
+	Type    EventType `json:"type"`
+	Txn     int       `json:"txn"`
+	Process string    `json:"process"`
+	Time    time.Time `json:"time"`
+	// Reads are the values the transaction read from the replicas, an empty value is a missing key
+	Reads   map[string]string `json:"reads,omitempty"`
+	Writes  map[string]string `json:"writes,omitempty"`
+	Deletes []string          `json:"deletes,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// Recorder writes the events of any number of clients to a history, one JSON object per line
+type Recorder struct {
+	mx      sync.Mutex
+	encoder *json.Encoder
+	closer  io.Closer
+	next    int
+	err     error
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{encoder: json.NewEncoder(w)}
+}
+
+// Create records to a new history file
+func Create(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating history file: %w", err)
+	}
+	r := NewRecorder(file)
+	r.closer = file
+	return r, nil
+}
+
+// Invoke records the start of a transaction, returning its ID
+func (r *Recorder) Invoke(process string, at time.Time) int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.next++
+	r.write(Event{Type: Invoke, Txn: r.next, Process: process, Time: at})
+	return r.next
+}
+
+// Complete records the outcome of a transaction
+func (r *Recorder) Complete(e Event) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.write(e)
+}
+
+func (r *Recorder) write(e Event) {
+	if r.err != nil {
+		return
+	}
+	r.err = r.encoder.Encode(e)
+}
+
+// Err is the first error writing the history, events after it are lost
+func (r *Recorder) Err() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.err
+}
+
+// Close closes the history file, returning the first error writing it
+func (r *Recorder) Close() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.closer != nil {
+		if err := r.closer.Close(); err != nil && r.err == nil {
+			r.err = err
+		}
+		r.closer = nil
+	}
+	return r.err
+}
+
+// Read the events of a history
+func Read(reader io.Reader) ([]Event, error) {
+	events := make([]Event, 0)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("error parsing line %d of history: %w", line, err)
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading history: %w", err)
+	}
+	return events, nil
+}
+
+// Load the events of a history file
+func Load(path string) ([]Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening history file: %w", err)
+	}
+	defer file.Close()
+	return Read(file)
+}
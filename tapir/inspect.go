@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/server"
+	"github.com/urfave/cli/v2"
+	"os"
+)
+
+// inspect dumps the contents of a replica database file
+func inspect(c *cli.Context) error {
+	inspection, err := server.Inspect(c.String("filepath"), server.InspectFilter{
+		KeyPrefix: c.String("prefix"),
+		ClientID:  c.String("client-id"),
+	})
+	if err != nil {
+		return err
+	}
+	switch c.String("format") {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(inspection)
+	case "text":
+		printInspection(inspection)
+		return nil
+	default:
+		return fmt.Errorf("unknown format %s, expected text or json", c.String("format"))
+	}
+}
+
+func printInspection(inspection *server.Inspection) {
+	fmt.Printf("Data (%d keys, last committed sequence %d):\n", len(inspection.Data), inspection.Sequence)
+	for _, key := range inspection.Data {
+		if key.Deleted {
+			fmt.Printf("key - %s (version %d, deleted)\n", key.Key, key.Version)
+		} else {
+			fmt.Printf("key - %s=%s (version %d)\n", key.Key, key.Value, key.Version)
+		}
+	}
+	fmt.Printf("Record (%d entries):\n", len(inspection.Record))
+	printRecordEntries(inspection.Record)
+	fmt.Printf("Master record (%d entries, view %d, synced view %d):\n", len(inspection.MasterRecord), inspection.MasterRecordViewID, inspection.SyncedViewID)
+	printRecordEntries(inspection.MasterRecord)
+}
+
+func printRecordEntries(entries []server.RecordEntry) {
+	for _, entry := range entries {
+		fmt.Printf("entry - %s %s\n", entry.ID, entry.State)
+		fmt.Printf("      - Client ID: %s\n", entry.ClientID)
+		fmt.Printf("      - View ID: %d\n", entry.ViewID)
+		fmt.Printf("      - Mode: %s\n", entry.Mode)
+		fmt.Printf("      - Operation: %+v\n", entry.Operation)
+		if entry.Error != nil {
+			fmt.Printf("      - Error: %s\n", entry.Error.Error())
+		} else {
+			fmt.Printf("      - Read values: %+v\n", entry.ReadValues)
+			if len(entry.ScanResults) > 0 {
+				fmt.Printf("      - Scan results: %+v\n", entry.ScanResults)
+			}
+		}
+	}
+}
@@ -3,9 +3,14 @@ package main
 import (
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/phughk/go-dist-algos/tapir/bench"
+	"github.com/phughk/go-dist-algos/tapir/model"
+	"github.com/phughk/go-dist-algos/tapir/server"
+	"github.com/phughk/go-dist-algos/tapir/torture"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 	"os"
+	"time"
 )
 
 func main() {
@@ -44,6 +49,34 @@ func main() {
 						Value:    0,
 						Usage:    "minimum cluster size, below this size operations will be rejected even if there is quorum",
 					},
+					&cli.DurationFlag{
+						Name:     "shutdown-timeout",
+						Required: false,
+						Value:    server.DefaultShutdownTimeout,
+						Usage:    "how long to wait for in-flight operations when shutting down",
+					},
+					&cli.BoolFlag{
+						Name:     "bootstrap",
+						Required: false,
+						Value:    false,
+						Usage:    "copy the data from a peer snapshot before serving, for a replica joining an existing cluster or recovering",
+					},
+					&cli.StringFlag{
+						Name:     "metrics-address",
+						Required: false,
+						Usage:    "address to serve Prometheus metrics on at /metrics, for example :9464, disabled if not given",
+					},
+					&cli.StringFlag{
+						Name:     "admin-address",
+						Required: false,
+						Usage:    "address to serve the HTTP admin API, health checks and metrics on, for example :9465, disabled if not given",
+					},
+					&cli.BoolFlag{
+						Name:     "no-repl",
+						Required: false,
+						Value:    false,
+						Usage:    "don't read commands from stdin, run until signalled, for example under systemd or in a container",
+					},
 				},
 
 				Action: serve,
@@ -56,12 +89,404 @@ func main() {
 					Aliases:  []string{"c"},
 					Required: true,
 					Usage:    "comma-separated list of bootstrap servers",
+				}, &cli.StringFlag{
+					Name:     "history",
+					Required: false,
+					Usage:    "file to record every transaction to, for the check command",
 				}},
-				Action: client,
+				Action: runClient,
+			},
+			{
+				Name:  "backup",
+				Usage: "Stream a consistent snapshot of a running replica to a new bbolt database file",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "address",
+						Aliases:  []string{"a"},
+						Required: true,
+						Usage:    "address of the replica to back up",
+					},
+					&cli.StringFlag{
+						Name:     "output",
+						Aliases:  []string{"o"},
+						Required: true,
+						Usage:    "filepath of the backup, which must not exist",
+					},
+				},
+				Action: backup,
+			},
+			{
+				Name:  "restore",
+				Usage: "Seed a new database from a backup, in view 0 with an empty IR record",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "input",
+						Aliases:  []string{"i"},
+						Required: true,
+						Usage:    "filepath of the backup",
+					},
+					&cli.StringFlag{
+						Name:     "filepath",
+						Aliases:  []string{"f"},
+						Required: true,
+						Usage:    "filepath of the new database, which must not exist",
+					},
+				},
+				Action: restore,
+			},
+			{
+				Name:  "inspect",
+				Usage: "Dump the client data, IR record and master record of a replica database file",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "filepath",
+						Aliases:  []string{"f"},
+						Required: true,
+						Usage:    "filepath of the database, which is opened read-only",
+					},
+					&cli.StringFlag{
+						Name:     "format",
+						Required: false,
+						Value:    "text",
+						Usage:    "output format, text or json",
+					},
+					&cli.StringFlag{
+						Name:     "prefix",
+						Aliases:  []string{"p"},
+						Required: false,
+						Usage:    "only show keys, and record entries with operations on keys, starting with the prefix",
+					},
+					&cli.StringFlag{
+						Name:     "client-id",
+						Required: false,
+						Usage:    "only show record entries of the client",
+					},
+				},
+				Action: inspect,
+			},
+			{
+				Name:  "verify",
+				Usage: "Compare the committed data of every replica and report the key ranges that diverge",
+				Description: "Replicas don't share timestamps, so each one hashes its committed data when it receives the request\n" +
+					"rather than as of a given time, and writes in progress can show up as divergences.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "cluster",
+						Aliases:  []string{"c"},
+						Required: true,
+						Usage:    "comma-separated list of every member",
+					},
+					&cli.IntFlag{
+						Name:     "depth",
+						Required: false,
+						Value:    4,
+						Usage:    "how many bytes of key prefix to narrow down diverging ranges to",
+					},
+					&cli.BoolFlag{
+						Name:     "repair",
+						Required: false,
+						Usage:    "replace the data of diverging replicas with a snapshot of a replica in the majority, refusing if a range has no majority",
+					},
+				},
+				Action: verify,
+			},
+			{
+				Name:  "check",
+				Usage: "Check that the committed transactions of a recorded history are serializable",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "history",
+						Aliases:  []string{"f"},
+						Required: true,
+						Usage:    "history file recorded by clients",
+					},
+					&cli.BoolFlag{
+						Name:     "realtime",
+						Required: false,
+						Usage:    "also check that transactions are ordered as they happened, which is strict serializability",
+					},
+				},
+				Action: check,
+			},
+			{
+				Name:  "simulate",
+				Usage: "Run an in-process cluster on a simulated network and clock, failing replicas and the network at random from a seed",
+				Flags: []cli.Flag{
+					&cli.Int64Flag{
+						Name:     "seed",
+						Aliases:  []string{"s"},
+						Required: false,
+						Value:    1,
+						Usage:    "seed of the random choices, the same seed runs the same interleaving",
+					},
+					&cli.IntFlag{
+						Name:     "replicas",
+						Aliases:  []string{"r"},
+						Required: false,
+						Value:    3,
+						Usage:    "number of replicas",
+					},
+					&cli.DurationFlag{
+						Name:     "duration",
+						Aliases:  []string{"d"},
+						Required: false,
+						Value:    30 * time.Second,
+						Usage:    "virtual time to run the workload for",
+					},
+					&cli.Float64Flag{
+						Name:     "crash",
+						Required: false,
+						Value:    0.05,
+						Usage:    "chance of crashing or restarting a replica between transactions",
+					},
+					&cli.Float64Flag{
+						Name:     "partition",
+						Required: false,
+						Value:    0.05,
+						Usage:    "chance of partitioning or healing the network between transactions",
+					},
+					&cli.Float64Flag{
+						Name:     "drop",
+						Required: false,
+						Value:    0.05,
+						Usage:    "chance of dropping messages to a replica between transactions",
+					},
+					&cli.DurationFlag{
+						Name:     "latency",
+						Required: false,
+						Usage:    "latency of the messages received by every replica",
+					},
+					&cli.DurationFlag{
+						Name:     "jitter",
+						Required: false,
+						Usage:    "jitter added to the latency, uniformly distributed",
+					},
+					&cli.Float64Flag{
+						Name:     "loss",
+						Required: false,
+						Usage:    "chance of losing each message received by a replica",
+					},
+					&cli.Float64Flag{
+						Name:     "duplicate",
+						Required: false,
+						Usage:    "chance of duplicating each message received by a replica",
+					},
+					&cli.Float64Flag{
+						Name:     "reorder",
+						Required: false,
+						Usage:    "chance of delaying each message received by a replica so later messages overtake it",
+					},
+					&cli.StringFlag{
+						Name:     "history",
+						Required: false,
+						Usage:    "file to record the transactions to, for the check command",
+					},
+					&cli.BoolFlag{
+						Name:     "trace",
+						Required: false,
+						Usage:    "print every step of the simulation",
+					},
+					&cli.BoolFlag{
+						Name:     "model",
+						Required: false,
+						Usage:    "check the view changes and records of the replicas against the model of IR between steps",
+					},
+				},
+				Action: simulate,
+			},
+			{
+				Name:  "model",
+				Usage: "Explore every state of a model of IR view changes and consensus operations, checking that finalized results never change and there is one master record per view",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:     "replicas",
+						Aliases:  []string{"r"},
+						Required: false,
+						Value:    3,
+						Usage:    "number of replicas",
+					},
+					&cli.IntFlag{
+						Name:     "operations",
+						Aliases:  []string{"o"},
+						Required: false,
+						Value:    1,
+						Usage:    "number of consensus operations",
+					},
+					&cli.IntFlag{
+						Name:     "views",
+						Required: false,
+						Value:    2,
+						Usage:    "highest view the replicas change to",
+					},
+					&cli.IntFlag{
+						Name:     "max-states",
+						Required: false,
+						Value:    model.DefaultMaxStates,
+						Usage:    "states to explore before giving up on exploring all of them",
+					},
+				},
+				Action: modelCheck,
+			},
+			{
+				Name:  "torture",
+				Usage: "Run randomised transactions on a local cluster of replica processes while a nemesis kills, partitions and slows them down, then check the outcome",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:     "replicas",
+						Aliases:  []string{"r"},
+						Required: false,
+						Value:    3,
+						Usage:    "number of replicas",
+					},
+					&cli.IntFlag{
+						Name:     "base-port",
+						Required: false,
+						Value:    17100,
+						Usage:    "loopback port of the first replica, the others use the ports after it",
+					},
+					&cli.DurationFlag{
+						Name:     "duration",
+						Aliases:  []string{"d"},
+						Required: false,
+						Value:    60 * time.Second,
+						Usage:    "how long to run the workloads for",
+					},
+					&cli.IntFlag{
+						Name:     "concurrency",
+						Required: false,
+						Value:    4,
+						Usage:    "number of clients running transactions at the same time",
+					},
+					&cli.StringSliceFlag{
+						Name:     "workload",
+						Aliases:  []string{"w"},
+						Required: false,
+						Usage:    "workloads to run: bank, append and register, all of them if not given",
+					},
+					&cli.StringSliceFlag{
+						Name:     "nemesis",
+						Aliases:  []string{"n"},
+						Required: false,
+						Value:    cli.NewStringSlice(torture.Nemeses...),
+						Usage:    "faults to inject: kill, partition and latency, or none",
+					},
+					&cli.DurationFlag{
+						Name:     "nemesis-interval",
+						Required: false,
+						Value:    5 * time.Second,
+						Usage:    "how long each fault lasts",
+					},
+					&cli.Int64Flag{
+						Name:     "seed",
+						Aliases:  []string{"s"},
+						Required: false,
+						Usage:    "seed of the workloads and the nemesis, random if not given",
+					},
+					&cli.StringFlag{
+						Name:     "dir",
+						Required: false,
+						Usage:    "directory for the databases and logs of the replicas, a temporary directory if not given",
+					},
+					&cli.StringFlag{
+						Name:     "history",
+						Required: false,
+						Usage:    "file to record the transactions to, for the check command",
+					},
+					&cli.BoolFlag{
+						Name:     "realtime",
+						Required: false,
+						Usage:    "check for strict serializability instead of serializability",
+					},
+				},
+				Action: runTorture,
+			},
+			{
+				Name:  "bench",
+				Usage: "Run a YCSB-style workload of reads and writes against a cluster and report the throughput, abort rate and latency percentiles",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "cluster",
+						Aliases:  []string{"c"},
+						Required: true,
+						Usage:    "comma-separated list of bootstrap servers",
+					},
+					&cli.DurationFlag{
+						Name:     "duration",
+						Aliases:  []string{"d"},
+						Required: false,
+						Value:    30 * time.Second,
+						Usage:    "how long to measure the workload for",
+					},
+					&cli.DurationFlag{
+						Name:     "warmup",
+						Required: false,
+						Value:    5 * time.Second,
+						Usage:    "how long to run the workload for before measuring",
+					},
+					&cli.IntFlag{
+						Name:     "concurrency",
+						Required: false,
+						Value:    8,
+						Usage:    "number of clients running transactions at the same time",
+					},
+					&cli.Float64Flag{
+						Name:     "read-ratio",
+						Required: false,
+						Value:    0.5,
+						Usage:    "chance of each operation being a read, the others are writes",
+					},
+					&cli.StringFlag{
+						Name:     "distribution",
+						Required: false,
+						Value:    bench.DistributionZipfian,
+						Usage:    "distribution of the keys operations are on, uniform or zipfian",
+					},
+					&cli.IntFlag{
+						Name:     "keys",
+						Aliases:  []string{"k"},
+						Required: false,
+						Value:    1000,
+						Usage:    "number of keys",
+					},
+					&cli.IntFlag{
+						Name:     "value-size",
+						Required: false,
+						Value:    100,
+						Usage:    "bytes per written value",
+					},
+					&cli.IntFlag{
+						Name:     "txn-size",
+						Required: false,
+						Value:    4,
+						Usage:    "number of operations per transaction",
+					},
+					&cli.BoolFlag{
+						Name:     "load",
+						Required: false,
+						Usage:    "write every key before running, so that reads find a value",
+					},
+					&cli.Int64Flag{
+						Name:     "seed",
+						Aliases:  []string{"s"},
+						Required: false,
+						Usage:    "seed of the workload, random if not given",
+					},
+					&cli.StringFlag{
+						Name:     "format",
+						Required: false,
+						Value:    "text",
+						Usage:    "output format, text or json",
+					},
+				},
+				Action: runBench,
 			},
 		},
 	}
-	app.Run(os.Args)
+	err := app.Run(os.Args)
+	if err != nil {
+		logrus.Errorf("%v", err)
+		os.Exit(1)
+	}
 }
 
 func setLogLevel() {
@@ -0,0 +1,293 @@
+// Package metrics keeps counters and histograms and serves them over HTTP in the Prometheus text exposition format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kind of a metric, as declared in the exposition format
+type Kind string
+
+const (
+	KindCounter   Kind = "counter"
+	KindGauge     Kind = "gauge"
+	KindHistogram Kind = "histogram"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the buckets of latency histograms
+var DefaultBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry of metric families, written in the order they were registered
+type Registry struct {
+	mx       sync.Mutex
+	families []family
+}
+
+type family interface {
+	header() (name string, help string, kind Kind)
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f family) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.families = append(r.families, f)
+}
+
+// Counter registers a counter with the label names, the values of the labels are given to With
+func (r *Registry) Counter(name string, help string, labels ...string) *CounterVec {
+	v := &CounterVec{meta: meta{name: name, help: help, labels: labels}, counters: make(map[string]*Counter)}
+	r.register(v)
+	return v
+}
+
+// Histogram registers a histogram with the bucket upper bounds and label names
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{meta: meta{name: name, help: help, labels: labels}, buckets: buckets, histograms: make(map[string]*Histogram)}
+	r.register(v)
+	return v
+}
+
+// Collect registers a counter or gauge whose values are kept elsewhere, collect is called to emit them every time
+// the metrics are written
+func (r *Registry) Collect(name string, help string, kind Kind, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	r.register(&collected{meta: meta{name: name, help: help, labels: labels}, kind: kind, collect: collect})
+}
+
+// WriteText writes every metric in the text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mx.Lock()
+	families := append([]family(nil), r.families...)
+	r.mx.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		name, help, kind := f.header()
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, kind)
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics for Prometheus to scrape
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.WriteText(w)
+}
+
+type meta struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// key of the label values in the map of a family
+func (m *meta) key(values []string) string {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v, got values %v", m.name, m.labels, values))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// series is the name of a sample with its labels, extra labels are appended as name value pairs
+func (m *meta) series(suffix string, values []string, extra ...string) string {
+	b := strings.Builder{}
+	b.WriteString(m.name)
+	b.WriteString(suffix)
+	if len(values)+len(extra) == 0 {
+		return b.String()
+	}
+	b.WriteByte('{')
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, value := range values {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, m.labels[i], escapeLabel(value)))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+	b.WriteString(strings.Join(pairs, ","))
+	b.WriteByte('}')
+	return b.String()
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec is a counter for each combination of label values
+type CounterVec struct {
+	meta
+	mx       sync.Mutex
+	counters map[string]*Counter
+}
+
+// Counter only goes up
+type Counter struct {
+	values []string
+	bits   atomic.Uint64
+}
+
+// With the label values, in the order of the label names
+func (v *CounterVec) With(values ...string) *Counter {
+	key := v.key(values)
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	c, ok := v.counters[key]
+	if !ok {
+		c = &Counter{values: values}
+		v.counters[key] = c
+	}
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add a delta, which must not be negative
+func (c *Counter) Add(delta float64) {
+	for {
+		old := c.bits.Load()
+		if c.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(c.bits.Load())
+}
+
+func (v *CounterVec) header() (string, string, Kind) {
+	return v.name, v.help, KindCounter
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	for _, key := range sortedKeys(v.counters) {
+		c := v.counters[key]
+		fmt.Fprintf(w, "%s %s\n", v.series("", c.values), formatValue(c.Value()))
+	}
+}
+
+// HistogramVec is a histogram for each combination of label values
+type HistogramVec struct {
+	meta
+	buckets    []float64
+	mx         sync.Mutex
+	histograms map[string]*Histogram
+}
+
+// Histogram counts observations in buckets by their upper bound
+type Histogram struct {
+	values  []string
+	buckets []float64
+	mx      sync.Mutex
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// With the label values, in the order of the label names
+func (v *HistogramVec) With(values ...string) *Histogram {
+	key := v.key(values)
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	h, ok := v.histograms[key]
+	if !ok {
+		h = &Histogram{values: values, buckets: v.buckets, counts: make([]uint64, len(v.buckets))}
+		v.histograms[key] = h
+	}
+	return h
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+// ObserveDuration in seconds
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+func (v *HistogramVec) header() (string, string, Kind) {
+	return v.name, v.help, KindHistogram
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	for _, key := range sortedKeys(v.histograms) {
+		h := v.histograms[key]
+		h.mx.Lock()
+		// Buckets are cumulative
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s %d\n", v.series("_bucket", h.values, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s %d\n", v.series("_bucket", h.values, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s %s\n", v.series("_sum", h.values), formatValue(h.sum))
+		fmt.Fprintf(w, "%s %d\n", v.series("_count", h.values), h.count)
+		h.mx.Unlock()
+	}
+}
+
+type collected struct {
+	meta
+	kind    Kind
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+func (c *collected) header() (string, string, Kind) {
+	return c.name, c.help, c.kind
+}
+
+func (c *collected) write(w *bufio.Writer) {
+	c.collect(func(value float64, labelValues ...string) {
+		c.key(labelValues)
+		fmt.Fprintf(w, "%s %s\n", c.series("", labelValues), formatValue(value))
+	})
+}
@@ -0,0 +1,174 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Observation of a replica of the implementation, taken between steps of a simulation
+type Observation struct {
+	Replica  string
+	View     int
+	Changing bool
+	// CompletedView is the last view the replica completed a view change to as its leader
+	CompletedView int
+	// Record entries by operation ID
+	Record map[string]ObservedEntry
+	// MasterView is the view of the master record the replica adopted
+	MasterView int
+	Master     map[string]ObservedEntry
+}
+
+// ObservedEntry of an operation in a record, the result is opaque but must compare equal for equal results
+type ObservedEntry struct {
+	View      int
+	Finalized bool
+	Result    string
+}
+
+const (
+	// InvariantViewMonotonic replicas never move to a lower view
+	InvariantViewMonotonic = "view-monotonic"
+	// InvariantNormalOperations replicas only execute and finalize operations in the NORMAL state
+	InvariantNormalOperations = "normal-operations"
+	// InvariantEntryView operations are added to the record in the current view of the replica
+	InvariantEntryView = "entry-view"
+	// InvariantStableRecord entries only change when they are finalized or a master record is adopted
+	InvariantStableRecord = "stable-record"
+	// InvariantOneMaster there is at most one master record per view
+	InvariantOneMaster = "one-master"
+)
+
+// Violation of the model by the implementation
+type Violation struct {
+	Invariant string
+	Replica   string
+	Message   string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: replica %s %s", v.Invariant, v.Replica, v.Message)
+}
+
+// Conformance checks that the transitions between observations of the replicas of an implementation are transitions
+// the model allows. The implementation has no explicit messages to compare, so the transitions of each replica are
+// compared with the transitions of a replica of the model, and the master records across replicas.
+type Conformance struct {
+	previous map[string]Observation
+	// masters are the replica that completed each view and the master record it decided
+	masters    map[int]Observation
+	violations []Violation
+	// seen violations, so that a violation that persists is only reported once
+	seen map[Violation]bool
+}
+
+func NewConformance() *Conformance {
+	return &Conformance{
+		previous: make(map[string]Observation),
+		masters:  make(map[int]Observation),
+		seen:     make(map[Violation]bool),
+	}
+}
+
+// Restarted forgets the replica, which lost the state that isn't stored when it restarted
+func (c *Conformance) Restarted(replica string) {
+	delete(c.previous, replica)
+}
+
+// Violations found so far, in the order they were found
+func (c *Conformance) Violations() []Violation {
+	return c.violations
+}
+
+// Counts of the violations by invariant
+func (c *Conformance) Counts() map[string]int {
+	counts := make(map[string]int)
+	for _, v := range c.violations {
+		counts[v.Invariant]++
+	}
+	return counts
+}
+
+func (c *Conformance) violation(invariant string, replica string, format string, args ...any) {
+	v := Violation{Invariant: invariant, Replica: replica, Message: fmt.Sprintf(format, args...)}
+	if !c.seen[v] {
+		c.seen[v] = true
+		c.violations = append(c.violations, v)
+	}
+}
+
+// Observe the replica, checking the transition from its previous observation
+func (c *Conformance) Observe(o Observation) {
+	if o.CompletedView > 0 {
+		if master, ok := c.masters[o.CompletedView]; !ok {
+			c.masters[o.CompletedView] = o
+		} else if master.Replica != o.Replica {
+			c.violation(InvariantOneMaster, o.Replica, "completed view %d, which replica %s already completed", o.CompletedView, master.Replica)
+		}
+	}
+	if o.MasterView > 0 {
+		if master, ok := c.masters[o.MasterView]; ok && master.Replica != o.Replica && !sameEntries(master.Master, o.Master) {
+			c.violation(InvariantOneMaster, o.Replica, "adopted a master record of view %d that differs from the one of replica %s", o.MasterView, master.Replica)
+		}
+	}
+	previous, ok := c.previous[o.Replica]
+	c.previous[o.Replica] = o
+	if !ok {
+		return
+	}
+	if o.View < previous.View {
+		c.violation(InvariantViewMonotonic, o.Replica, "moved from view %d to view %d", previous.View, o.View)
+	}
+	adopted := o.MasterView > previous.MasterView
+	for _, id := range sortedIDs(o.Record) {
+		entry := o.Record[id]
+		before, existed := previous.Record[id]
+		if existed && entry == before {
+			continue
+		}
+		if adopted {
+			// The record was replaced by the master record
+			continue
+		}
+		if o.Changing && previous.Changing {
+			if existed {
+				c.violation(InvariantNormalOperations, o.Replica, "changed operation %s while changing to view %d", id, o.View)
+			} else {
+				c.violation(InvariantNormalOperations, o.Replica, "executed operation %s while changing to view %d", id, o.View)
+			}
+		}
+		if !existed {
+			if entry.View != o.View && entry.View != previous.View {
+				c.violation(InvariantEntryView, o.Replica, "added operation %s in view %d while in view %d", id, entry.View, o.View)
+			}
+			continue
+		}
+		switch {
+		case before.Finalized:
+			c.violation(InvariantStableRecord, o.Replica, "changed finalized operation %s from %q in view %d to %q in view %d", id, before.Result, before.View, entry.Result, entry.View)
+		case !entry.Finalized:
+			c.violation(InvariantStableRecord, o.Replica, "executed operation %s again, changing its result from %q in view %d to %q in view %d", id, before.Result, before.View, entry.Result, entry.View)
+		}
+	}
+}
+
+func sameEntries(a map[string]ObservedEntry, b map[string]ObservedEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, entry := range a {
+		if b[id] != entry {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedIDs(record map[string]ObservedEntry) []string {
+	ids := make([]string, 0, len(record))
+	for id := range record {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,92 @@
+package model
+
+import "fmt"
+
+// DefaultMaxStates is how many states Explore visits before giving up on exploring all of them
+const DefaultMaxStates = 2000000
+
+// Report of exploring the state space
+type Report struct {
+	States      int
+	Transitions int
+	// Depth is the length of the longest of the shortest paths to the states visited
+	Depth int
+	// Complete is false if the exploration stopped at the maximum number of states
+	Complete bool
+	// Violations of the first state found to violate the invariants, nil if there are none
+	Violations []string
+	// Trace is the actions from the initial state to the state that violates the invariants
+	Trace []string
+	// State that violates the invariants
+	State *State
+}
+
+func (r *Report) Valid() bool {
+	return len(r.Violations) == 0
+}
+
+func (r *Report) String() string {
+	if r.Valid() {
+		complete := "all"
+		if !r.Complete {
+			complete = "the first"
+		}
+		return fmt.Sprintf("explored %s %d states and %d transitions to a depth of %d without violations", complete, r.States, r.Transitions, r.Depth)
+	}
+	return fmt.Sprintf("found %d violations after exploring %d states: %v", len(r.Violations), r.States, r.Violations)
+}
+
+// visited is a state found while exploring, with the action from the previous state to reconstruct the trace
+type visited struct {
+	parent string
+	action string
+	depth  int
+}
+
+// Explore visits every state reachable from the initial state breadth first, up to maxStates, stopping at the first
+// state that violates the invariants so that the trace to it is as short as possible
+func Explore(config Config, maxStates int) *Report {
+	config = config.withDefaults()
+	if maxStates <= 0 {
+		maxStates = DefaultMaxStates
+	}
+	initial := Initial(config)
+	report := &Report{}
+	seen := map[string]visited{initial.key(config): {}}
+	queue := []*State{initial}
+	trace := func(key string) []string {
+		actions := make([]string, 0)
+		for v := seen[key]; v.action != ""; v = seen[v.parent] {
+			actions = append([]string{v.action}, actions...)
+		}
+		return actions
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		key := s.key(config)
+		report.States++
+		if violations := Check(s); len(violations) > 0 {
+			report.Violations = violations
+			report.Trace = trace(key)
+			report.State = s
+			return report
+		}
+		for _, t := range Next(config, s) {
+			report.Transitions++
+			next := t.State.key(config)
+			if _, ok := seen[next]; ok {
+				continue
+			}
+			if len(seen) >= maxStates {
+				return report
+			}
+			depth := seen[key].depth + 1
+			seen[next] = visited{parent: key, action: t.Action, depth: depth}
+			report.Depth = max(report.Depth, depth)
+			queue = append(queue, t.State)
+		}
+	}
+	report.Complete = true
+	return report
+}
@@ -0,0 +1,46 @@
+package model
+
+import "testing"
+
+func TestExplore(t *testing.T) {
+	if testing.Short() {
+		t.Skip("exploring two views takes seconds")
+	}
+	report := Explore(Config{Replicas: 3, Operations: 1, MaxView: 2}, 0)
+	if !report.Valid() {
+		t.Fatalf("%s\ntrace: %v\nstate: %s", report, report.Trace, report.State)
+	}
+	if !report.Complete {
+		t.Errorf("expected to explore all states, %s", report)
+	}
+}
+
+func TestExploreOneView(t *testing.T) {
+	report := Explore(Config{Replicas: 3, Operations: 1, MaxView: 1}, 0)
+	if !report.Valid() || !report.Complete {
+		t.Errorf("expected to explore all states without violations, %s", report)
+	}
+}
+
+// TestExploreFindsViolations seeds bugs in the quorums to check that exploring finds the violations they cause
+func TestExploreFindsViolations(t *testing.T) {
+	tests := map[string]Config{
+		// A view change can merge the record of only one of the two replicas with the fast path result, and choose
+		// the other result
+		"fast quorum of a majority": {FastQuorum: func(count int, total int) bool { return count > total/2 }},
+		// A view change can merge the records of the replicas that didn't acknowledge the slow path result
+		"majority of one": {MajorityQuorum: func(count int, total int) bool { return count >= 1 }},
+	}
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			config.Replicas, config.Operations, config.MaxView = 3, 1, 1
+			report := Explore(config, 0)
+			if report.Valid() {
+				t.Fatalf("expected a violation, %s", report)
+			}
+			if len(report.Trace) == 0 || report.State == nil {
+				t.Errorf("expected the trace to the state violating the invariants, got %v and %v", report.Trace, report.State)
+			}
+		})
+	}
+}
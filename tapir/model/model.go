@@ -0,0 +1,608 @@
+// Package model is a state-space exploration model of IR view changes and consensus operations. The model is small
+// enough to be explored exhaustively for a few replicas, operations and views, checking that a consensus result never
+// changes once finalized and that there is at most one master record per view.
+//
+// Replicas execute consensus operations in the NORMAL state, with either of two results, and clients finalize an
+// operation either on the fast path, when a fast quorum of replicas in the same view executed it with the same result,
+// or on the slow path, when a majority of replicas in the same view acknowledged the result the client decided. Any
+// replica can start a view change to the next view, which sends its record to the leader of the view. The leader
+// merges the records of a majority into the master record, which replicas adopt when they receive it. Messages can be
+// lost, duplicated and reordered, as receiving a message is optional and doesn't consume it.
+package model
+
+import (
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Result of executing an operation, operations executed on different replicas can have different results
+type Result byte
+
+const (
+	// NoResult is the result of an operation that is not in a record
+	NoResult Result = iota
+	ResultA
+	ResultB
+)
+
+// results an operation can have when executed
+var results = []Result{ResultA, ResultB}
+
+func (r Result) String() string {
+	switch r {
+	case NoResult:
+		return "-"
+	case ResultA:
+		return "A"
+	case ResultB:
+		return "B"
+	default:
+		return fmt.Sprintf("Result(%d)", byte(r))
+	}
+}
+
+type Status byte
+
+const (
+	Normal Status = iota
+	ViewChanging
+)
+
+func (s Status) String() string {
+	switch s {
+	case Normal:
+		return "NORMAL"
+	case ViewChanging:
+		return "VIEW-CHANGING"
+	default:
+		return fmt.Sprintf("Status(%d)", byte(s))
+	}
+}
+
+// Config of the model, the quorums default to the ones the replicas and clients use
+type Config struct {
+	Replicas   int
+	Operations int
+	// MaxView is the highest view replicas change to
+	MaxView int
+	// FastQuorum is true if count out of total matching results finalize an operation on the fast path
+	FastQuorum func(count int, total int) bool
+	// MajorityQuorum is true if count out of total replicas are a majority
+	MajorityQuorum func(count int, total int) bool
+	// RecoveryQuorum is true if count matching results out of the majority of records merged by the leader must be
+	// kept in the master record
+	RecoveryQuorum func(count int, total int) bool
+}
+
+func (c Config) withDefaults() Config {
+	if c.FastQuorum == nil {
+		c.FastQuorum = protocol.FastQuorum
+	}
+	if c.MajorityQuorum == nil {
+		c.MajorityQuorum = protocol.MajorityQuorum
+	}
+	if c.RecoveryQuorum == nil {
+		c.RecoveryQuorum = protocol.RecoveryQuorum
+	}
+	return c
+}
+
+// majority is the smallest majority of the replicas
+func (c Config) majority() int {
+	for count := 1; count < c.Replicas; count++ {
+		if c.MajorityQuorum(count, c.Replicas) {
+			return count
+		}
+	}
+	return c.Replicas
+}
+
+// leader of a view, which is chosen deterministically
+func (c Config) leader(view int) int {
+	return view % c.Replicas
+}
+
+// Entry of an operation in a record
+type Entry struct {
+	Result    Result
+	Finalized bool
+	// View the entry was added in
+	View int
+}
+
+// Record has an entry for each operation, with NoResult if the operation is not in the record
+type Record []Entry
+
+func (r Record) String() string {
+	parts := make([]string, 0, len(r))
+	for op, e := range r {
+		if e.Result == NoResult {
+			continue
+		}
+		state := "T"
+		if e.Finalized {
+			state = "F"
+		}
+		parts = append(parts, fmt.Sprintf("op%d=%s%s@%d", op, e.Result, state, e.View))
+	}
+	return "{" + strings.Join(parts, " ") + "}"
+}
+
+func (r Record) clone() Record {
+	return append(Record(nil), r...)
+}
+
+type Replica struct {
+	View   int
+	Status Status
+	// LastNormal is the last view the replica was NORMAL in
+	LastNormal int
+	Record     Record
+}
+
+// DoViewChange is sent by a replica to the leader of the view it is changing to
+type DoViewChange struct {
+	View       int
+	From       int
+	LastNormal int
+	Record     Record
+}
+
+// StartView is sent by the leader with the master record of the view
+type StartView struct {
+	View   int
+	Record Record
+}
+
+// Response of a replica to a client proposing an operation
+type Response struct {
+	Replica int
+	View    int
+	Result  Result
+}
+
+// Operation is the client side of a consensus operation
+type Operation struct {
+	Responses []Response
+	// Decided is the result the client decided on the slow path, in DecidedView
+	Decided     Result
+	DecidedView int
+	// Acknowledged is a bit for each replica that acknowledged the decided result
+	Acknowledged uint64
+	// Finalized is the consensus result once the client finalized it, in FinalizedView
+	Finalized     Result
+	FinalizedView int
+}
+
+// Master record decided by the leader of a view
+type Master struct {
+	View   int
+	Leader int
+	Record Record
+}
+
+// State of the replicas, the messages sent and the clients
+type State struct {
+	Replicas      []Replica
+	DoViewChanges []DoViewChange
+	StartViews    []StartView
+	Operations    []Operation
+	Masters       []Master
+}
+
+// Initial state, every replica is NORMAL in view 0 with an empty record
+func Initial(config Config) *State {
+	s := &State{
+		Replicas:   make([]Replica, config.Replicas),
+		Operations: make([]Operation, config.Operations),
+	}
+	for i := range s.Replicas {
+		s.Replicas[i].Record = make(Record, config.Operations)
+	}
+	return s
+}
+
+func (s *State) clone() *State {
+	c := &State{
+		Replicas:      make([]Replica, len(s.Replicas)),
+		DoViewChanges: append([]DoViewChange(nil), s.DoViewChanges...),
+		StartViews:    append([]StartView(nil), s.StartViews...),
+		Operations:    make([]Operation, len(s.Operations)),
+		Masters:       append([]Master(nil), s.Masters...),
+	}
+	for i, r := range s.Replicas {
+		c.Replicas[i] = Replica{View: r.View, Status: r.Status, LastNormal: r.LastNormal, Record: r.Record.clone()}
+	}
+	for i, op := range s.Operations {
+		c.Operations[i] = op
+		c.Operations[i].Responses = append([]Response(nil), op.Responses...)
+	}
+	return c
+}
+
+// key identifies the state up to symmetry. Replicas that don't lead any view are interchangeable, so their parts of
+// the state are sorted, which makes exploring larger clusters feasible. Messages and responses are sets so they are
+// kept sorted.
+func (s *State) key(config Config) string {
+	replicas := make([]string, len(s.Replicas))
+	for i, r := range s.Replicas {
+		b := make([]byte, 0, 64)
+		b = strconv.AppendInt(b, int64(r.View), 10)
+		b = append(b, ',', byte('0'+r.Status), ',')
+		b = strconv.AppendInt(b, int64(r.LastNormal), 10)
+		b = appendRecord(b, r.Record)
+		for _, m := range s.DoViewChanges {
+			if m.From == i {
+				b = append(b, 'd')
+				b = strconv.AppendInt(b, int64(m.View), 10)
+				b = append(b, ',')
+				b = strconv.AppendInt(b, int64(m.LastNormal), 10)
+				b = appendRecord(b, m.Record)
+			}
+		}
+		for op, o := range s.Operations {
+			b = append(b, 'o')
+			b = strconv.AppendInt(b, int64(op), 10)
+			for _, response := range o.Responses {
+				if response.Replica == i {
+					b = append(b, ',')
+					b = strconv.AppendInt(b, int64(response.View), 10)
+					b = append(b, byte('0'+response.Result))
+				}
+			}
+			if o.Acknowledged&(1<<i) != 0 {
+				b = append(b, '!')
+			}
+		}
+		replicas[i] = string(b)
+	}
+	leaders := make(map[int]bool)
+	for view := 1; view <= config.MaxView; view++ {
+		leaders[config.leader(view)] = true
+	}
+	b := make([]byte, 0, 256)
+	symmetric := make([]string, 0, len(replicas))
+	for i, replica := range replicas {
+		if leaders[i] {
+			b = append(b, replica...)
+			b = append(b, '|')
+		} else {
+			symmetric = append(symmetric, replica)
+		}
+	}
+	sort.Strings(symmetric)
+	for _, replica := range symmetric {
+		b = append(b, replica...)
+		b = append(b, '|')
+	}
+	for _, o := range s.Operations {
+		for _, v := range []int{int(o.Decided), o.DecidedView, int(o.Finalized), o.FinalizedView} {
+			b = strconv.AppendInt(b, int64(v), 10)
+			b = append(b, ',')
+		}
+	}
+	for _, m := range s.Masters {
+		b = append(b, 'm')
+		b = strconv.AppendInt(b, int64(m.View), 10)
+		b = append(b, ',')
+		b = strconv.AppendInt(b, int64(m.Leader), 10)
+		b = appendRecord(b, m.Record)
+	}
+	return string(b)
+}
+
+func appendRecord(b []byte, r Record) []byte {
+	b = append(b, '{')
+	for _, e := range r {
+		b = append(b, byte('0'+e.Result))
+		if e.Finalized {
+			b = append(b, 'F')
+		}
+		b = strconv.AppendInt(b, int64(e.View), 10)
+		b = append(b, ' ')
+	}
+	return append(b, '}')
+}
+
+func (s *State) String() string {
+	var b strings.Builder
+	for i, r := range s.Replicas {
+		fmt.Fprintf(&b, "  replica %d: view %d %s (last normal %d) %s\n", i, r.View, r.Status, r.LastNormal, r.Record)
+	}
+	for i, op := range s.Operations {
+		fmt.Fprintf(&b, "  op%d: responses %v", i, op.Responses)
+		if op.Decided != NoResult {
+			fmt.Fprintf(&b, ", decided %s in view %d", op.Decided, op.DecidedView)
+		}
+		if op.Finalized != NoResult {
+			fmt.Fprintf(&b, ", finalized %s in view %d", op.Finalized, op.FinalizedView)
+		}
+		b.WriteByte('\n')
+	}
+	for _, m := range s.Masters {
+		fmt.Fprintf(&b, "  master record of view %d by replica %d: %s\n", m.View, m.Leader, m.Record)
+	}
+	return b.String()
+}
+
+// Transition is an action and the state it leads to
+type Transition struct {
+	Action string
+	State  *State
+}
+
+// Next returns every state the state can transition to
+func Next(config Config, s *State) []Transition {
+	config = config.withDefaults()
+	next := make([]Transition, 0)
+	add := func(state *State, format string, args ...any) {
+		next = append(next, Transition{Action: fmt.Sprintf(format, args...), State: state})
+	}
+	for i, r := range s.Replicas {
+		for op := range s.Operations {
+			// A replica executes a proposed operation once, until a master record without it replaces its record
+			if r.Status == Normal && r.Record[op].Result == NoResult && s.Operations[op].Decided == NoResult && s.Operations[op].Finalized == NoResult {
+				for _, result := range results {
+					n := s.clone()
+					n.Replicas[i].Record[op] = Entry{Result: result, View: r.View}
+					n.Operations[op].Responses = addResponse(n.Operations[op].Responses, Response{Replica: i, View: r.View, Result: result})
+					add(n, "replica %d executes op%d with result %s in view %d", i, op, result, r.View)
+				}
+			}
+			// A replica finalizes the decided result if it is still in the view the client decided in
+			decided := s.Operations[op]
+			if r.Status == Normal && decided.Decided != NoResult && decided.Finalized == NoResult && r.View == decided.DecidedView && decided.Acknowledged&(1<<i) == 0 {
+				n := s.clone()
+				n.Replicas[i].Record[op] = Entry{Result: decided.Decided, Finalized: true, View: r.View}
+				n.Operations[op].Acknowledged |= 1 << i
+				action := fmt.Sprintf("replica %d finalizes op%d with result %s in view %d", i, op, decided.Decided, r.View)
+				if countBits(n.Operations[op].Acknowledged) >= config.majority() {
+					n.Operations[op].Finalized = decided.Decided
+					n.Operations[op].FinalizedView = decided.DecidedView
+					action += ", which a majority acknowledged"
+				}
+				add(n, "%s", action)
+			}
+		}
+		// Timeouts and messages from higher views start view changes, a view at a time
+		if r.View < config.MaxView {
+			n := s.clone()
+			view := r.View + 1
+			n.Replicas[i].View = view
+			n.Replicas[i].Status = ViewChanging
+			n.DoViewChanges = addDoViewChange(n.DoViewChanges, DoViewChange{View: view, From: i, LastNormal: r.LastNormal, Record: r.Record.clone()})
+			add(n, "replica %d starts a view change to view %d", i, view)
+		}
+		// The leader merges the records of a majority into the master record
+		if r.Status == ViewChanging && config.leader(r.View) == i {
+			senders := make([]DoViewChange, 0)
+			for _, m := range s.DoViewChanges {
+				if m.View == r.View {
+					senders = append(senders, m)
+				}
+			}
+			for _, quorum := range subsets(senders, config.majority()) {
+				for _, master := range merge(config, s.Operations, quorum) {
+					n := s.clone()
+					n.Replicas[i].Status = Normal
+					n.Replicas[i].LastNormal = r.View
+					n.Replicas[i].Record = master.clone()
+					n.StartViews = addStartView(n.StartViews, StartView{View: r.View, Record: master})
+					n.Masters = append(n.Masters, Master{View: r.View, Leader: i, Record: master})
+					from := make([]string, 0, len(quorum))
+					for _, m := range quorum {
+						from = append(from, strconv.Itoa(m.From))
+					}
+					add(n, "leader %d merges the records of replicas %s into the master record %s of view %d", i, strings.Join(from, ","), master, r.View)
+				}
+			}
+		}
+		// A replica adopts the master record of a view that is not behind it
+		for _, m := range s.StartViews {
+			if m.View > r.View || (m.View == r.View && r.Status == ViewChanging) {
+				n := s.clone()
+				n.Replicas[i] = Replica{View: m.View, Status: Normal, LastNormal: m.View, Record: m.Record.clone()}
+				add(n, "replica %d adopts the master record %s of view %d", i, m.Record, m.View)
+			}
+		}
+	}
+	for op, o := range s.Operations {
+		if o.Decided != NoResult || o.Finalized != NoResult {
+			continue
+		}
+		byView := make(map[int][]Response)
+		for _, r := range o.Responses {
+			byView[r.View] = append(byView[r.View], r)
+		}
+		for _, view := range sortedViews(byView) {
+			responses := byView[view]
+			for _, result := range results {
+				matching := 0
+				for _, r := range responses {
+					if r.Result == result {
+						matching++
+					}
+				}
+				// The fast path needs matching results from a fast quorum
+				if matching > 0 && config.FastQuorum(matching, config.Replicas) {
+					n := s.clone()
+					n.Operations[op].Finalized = result
+					n.Operations[op].FinalizedView = view
+					add(n, "client finalizes op%d with result %s on the fast path in view %d", op, result, view)
+				}
+				// The slow path decides any of the results of a majority
+				if matching > 0 && config.MajorityQuorum(len(responses), config.Replicas) {
+					n := s.clone()
+					n.Operations[op].Decided = result
+					n.Operations[op].DecidedView = view
+					add(n, "client decides op%d with result %s on the slow path in view %d", op, result, view)
+				}
+			}
+		}
+	}
+	return next
+}
+
+// merge the records into the possible master records. Only the records from the latest view any of the replicas was
+// NORMAL in are merged, as older records may be missing operations the master record of a later view has. Finalized
+// entries are kept, as are tentative results that match in a recovery quorum of the records, and the leader decides
+// any result for the other operations.
+func merge(config Config, operations []Operation, quorum []DoViewChange) []Record {
+	latest := 0
+	for _, m := range quorum {
+		latest = max(latest, m.LastNormal)
+	}
+	records := make([]DoViewChange, 0, len(quorum))
+	for _, m := range quorum {
+		if m.LastNormal == latest {
+			records = append(records, m)
+		}
+	}
+	masters := []Record{make(Record, len(operations))}
+	for op := range operations {
+		choices := mergeChoices(config, op, records)
+		decided := make([]Record, 0, len(masters)*len(choices))
+		for _, master := range masters {
+			for _, result := range choices {
+				d := master.clone()
+				d[op] = Entry{Result: result, Finalized: true, View: records[0].View}
+				decided = append(decided, d)
+			}
+		}
+		if len(decided) > 0 {
+			masters = decided
+		}
+	}
+	return masters
+}
+
+// mergeChoices are the results the leader can choose for the operation, none if no record has it
+func mergeChoices(config Config, op int, records []DoViewChange) []Result {
+	counts := make(map[Result]int)
+	for _, m := range records {
+		e := m.Record[op]
+		if e.Finalized {
+			return []Result{e.Result}
+		}
+		if e.Result != NoResult {
+			counts[e.Result]++
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	kept := make([]Result, 0, len(results))
+	for _, result := range results {
+		if counts[result] > 0 && config.RecoveryQuorum(counts[result], config.Replicas) {
+			kept = append(kept, result)
+		}
+	}
+	if len(kept) > 0 {
+		return kept
+	}
+	return results
+}
+
+// Check returns the invariants the state violates
+func Check(s *State) []string {
+	violations := make([]string, 0)
+	for op, o := range s.Operations {
+		if o.Finalized == NoResult {
+			continue
+		}
+		// Replicas in later views have adopted a master record, which must have the result
+		for i, r := range s.Replicas {
+			if e := r.Record[op]; r.Status == Normal && r.View > o.FinalizedView && (!e.Finalized || e.Result != o.Finalized) {
+				violations = append(violations, fmt.Sprintf("consensus result of op%d changed from %s to %s on replica %d in view %d after it was finalized in view %d", op, o.Finalized, e.Result, i, r.View, o.FinalizedView))
+			}
+		}
+		for _, m := range s.Masters {
+			if m.View > o.FinalizedView && m.Record[op].Result != o.Finalized {
+				violations = append(violations, fmt.Sprintf("consensus result of op%d changed from %s to %s in the master record of view %d after it was finalized in view %d", op, o.Finalized, m.Record[op].Result, m.View, o.FinalizedView))
+			}
+		}
+	}
+	leaders := make(map[int]int)
+	for _, m := range s.Masters {
+		if leader, ok := leaders[m.View]; ok {
+			violations = append(violations, fmt.Sprintf("view %d has master records from replicas %d and %d", m.View, leader, m.Leader))
+		}
+		leaders[m.View] = m.Leader
+	}
+	return violations
+}
+
+func addResponse(responses []Response, r Response) []Response {
+	for _, existing := range responses {
+		if existing == r {
+			return responses
+		}
+	}
+	responses = append(responses, r)
+	sort.Slice(responses, func(i, j int) bool {
+		a, b := responses[i], responses[j]
+		if a.Replica != b.Replica {
+			return a.Replica < b.Replica
+		}
+		if a.View != b.View {
+			return a.View < b.View
+		}
+		return a.Result < b.Result
+	})
+	return responses
+}
+
+func addDoViewChange(messages []DoViewChange, m DoViewChange) []DoViewChange {
+	messages = append(messages, m)
+	sort.SliceStable(messages, func(i, j int) bool {
+		if messages[i].View != messages[j].View {
+			return messages[i].View < messages[j].View
+		}
+		return messages[i].From < messages[j].From
+	})
+	return messages
+}
+
+func addStartView(messages []StartView, m StartView) []StartView {
+	messages = append(messages, m)
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].View < messages[j].View
+	})
+	return messages
+}
+
+// subsets of the messages with count senders, a replica can send a view change for the same view more than once
+// only if it left the view and came back, which it can't
+func subsets(messages []DoViewChange, count int) [][]DoViewChange {
+	if count == 0 {
+		return [][]DoViewChange{nil}
+	}
+	if len(messages) < count {
+		return nil
+	}
+	with := subsets(messages[1:], count-1)
+	for i := range with {
+		with[i] = append([]DoViewChange{messages[0]}, with[i]...)
+	}
+	return append(with, subsets(messages[1:], count)...)
+}
+
+func sortedViews(byView map[int][]Response) []int {
+	views := make([]int, 0, len(byView))
+	for view := range byView {
+		views = append(views, view)
+	}
+	sort.Ints(views)
+	return views
+}
+
+func countBits(bits uint64) int {
+	count := 0
+	for ; bits != 0; bits &= bits - 1 {
+		count++
+	}
+	return count
+}
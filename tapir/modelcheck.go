@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/model"
+	"github.com/urfave/cli/v2"
+	"sort"
+)
+
+// modelCheck explores the states of the model of IR view changes and consensus operations
+func modelCheck(c *cli.Context) error {
+	config := model.Config{
+		Replicas:   c.Int("replicas"),
+		Operations: c.Int("operations"),
+		MaxView:    c.Int("views"),
+	}
+	if config.Replicas < 1 || config.Replicas > 64 {
+		return fmt.Errorf("the model supports 1 to 64 replicas")
+	}
+	report := model.Explore(config, c.Int("max-states"))
+	if report.Valid() {
+		fmt.Printf("Model of %d replicas, %d operations and %d views: %s\n", config.Replicas, config.Operations, config.MaxView, report)
+		return nil
+	}
+	fmt.Println("Trace:")
+	for i, action := range report.Trace {
+		fmt.Printf("%4d %s\n", i+1, action)
+	}
+	fmt.Printf("State:\n%s", report.State)
+	for _, violation := range report.Violations {
+		fmt.Printf("Violation: %s\n", violation)
+	}
+	return fmt.Errorf("the model violates its invariants after %d steps", len(report.Trace))
+}
+
+// printModelViolations prints how many times the replicas violated each invariant of the model, and the first few
+func printModelViolations(violations []model.Violation) {
+	counts := make(map[string]int)
+	for _, v := range violations {
+		counts[v.Invariant]++
+	}
+	invariants := make([]string, 0, len(counts))
+	for invariant := range counts {
+		invariants = append(invariants, invariant)
+	}
+	sort.Strings(invariants)
+	for _, invariant := range invariants {
+		fmt.Printf("Model violations of %s: %d\n", invariant, counts[invariant])
+	}
+	for i, v := range violations {
+		if i == maxPrintedModelViolations {
+			fmt.Printf("... and %d more\n", len(violations)-i)
+			break
+		}
+		fmt.Printf("Model violation: %s\n", v)
+	}
+}
+
+// maxPrintedModelViolations keeps the output readable, as a broken invariant is usually broken many times
+const maxPrintedModelViolations = 20
@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"net"
+	"time"
+)
+
+// Clock is the source of time, so that a simulation can replace wall-clock time with virtual time
+type Clock interface {
+	Now() time.Time
+	// After sends the time on the channel once d has passed
+	After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is wall-clock time
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Network creates connections, so that a simulation can replace TCP with an in-memory network
+type Network interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+// TCPNetwork is the real network
+type TCPNetwork struct{}
+
+func (TCPNetwork) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (TCPNetwork) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
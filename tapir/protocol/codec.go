@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrEmptyMessage is returned when reading a frame without a message
+var ErrEmptyMessage = errors.New("empty message")
+
+// encodeFrame serializes the message to JSON prefixed with its 16-bit big endian length
+func encodeFrame(message *AnyMessage) ([]byte, error) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxMessageSize {
+		return nil, fmt.Errorf("%w: %d bytes, the maximum is %d", ErrMessageTooLarge, len(data), MaxMessageSize)
+	}
+	frame := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	copy(frame[2:], data)
+	return frame, nil
+}
+
+// readFrame reads the next length prefixed message, returning io.EOF only if the reader ended between frames
+func readFrame(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("error reading size of message: %w", err)
+		}
+		return nil, err
+	}
+	if length == 0 {
+		return nil, ErrEmptyMessage
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("error reading message of expected size %d: %w", length, err)
+	}
+	return message, nil
+}
+
+// parseMessage decodes a message received from the network, which may be anything
+func parseMessage(message []byte) (AnyMessage, error) {
+	var anyMessage AnyMessage
+	if err := json.Unmarshal(message, &anyMessage); err != nil {
+		return AnyMessage{}, fmt.Errorf("invalid message of %d bytes: %w", len(message), err)
+	}
+	return anyMessage, nil
+}
@@ -0,0 +1,266 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrRequestTimeout is returned by SendRequest when the peer did not respond in time
+var ErrRequestTimeout = errors.New("timeout waiting for response")
+
+// ErrMessageTooLarge is returned when sending a message that doesn't fit the length prefix
+var ErrMessageTooLarge = errors.New("message too large")
+
+// MaxMessageSize is the largest serialized message, as messages are prefixed with a 16-bit length
+const MaxMessageSize = math.MaxUint16
+
+type RequestHandler func(*ConnHandler, *AnyMessage)
+
+// Filter decides how the next message sent (outbound) or received is delivered, to inject network failures. The
+// message is delivered once after each of the delays it returns, so no delays drop it and more than one duplicates it.
+type Filter func(outbound bool) []time.Duration
+
+// deliverNow is the delivery of a message without a filter
+var deliverNow = []time.Duration{0}
+
+// MaybeError is the outcome of a request sent to one of many connections
+type MaybeError struct {
+	Conn     *ConnHandler
+	Error    error
+	Response *AnyMessage
+}
+
+type ConnHandler struct {
+	terminated atomic.Bool
+	conn       net.Conn
+	clock      Clock
+	// writeMx keeps the length and the message together when sending from many goroutines
+	writeMx        sync.Mutex
+	respMap        map[string]chan AnyMessage
+	respMapMux     sync.Mutex
+	requestHandler RequestHandler
+	shutdownHook   func()
+	// lastMessageTime is set by delayed deliveries on other goroutines than the read loop
+	lastMessageTime atomic.Pointer[time.Time]
+	filter          atomic.Pointer[Filter]
+}
+
+func NewConnHandler(ctx context.Context, conn net.Conn, requestHandler func(*ConnHandler, *AnyMessage), shutdownHook func()) *ConnHandler {
+	return NewConnHandlerWithClock(ctx, conn, RealClock{}, requestHandler, shutdownHook)
+}
+
+// NewConnHandlerWithClock is NewConnHandler with request timeouts and message times taken from the clock
+func NewConnHandlerWithClock(ctx context.Context, conn net.Conn, clock Clock, requestHandler func(*ConnHandler, *AnyMessage), shutdownHook func()) *ConnHandler {
+	ch := ConnHandler{
+		conn:           conn,
+		clock:          clock,
+		respMap:        make(map[string]chan AnyMessage),
+		requestHandler: requestHandler,
+		shutdownHook:   shutdownHook,
+	}
+	go ch.readMessageLoop(ctx)
+	return &ch
+}
+
+func (ch *ConnHandler) SendRequest(message *AnyMessage) (*AnyMessage, error) {
+	responseChan := make(chan AnyMessage, 1)
+
+	ch.respMapMux.Lock()
+	ch.respMap[message.RequestID] = responseChan
+	ch.respMapMux.Unlock()
+	err := ch.SendUntracked(message)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-responseChan:
+		return &resp, nil
+	case <-ch.clock.After(5 * time.Second):
+		ch.respMapMux.Lock()
+		delete(ch.respMap, message.RequestID)
+		ch.respMapMux.Unlock()
+		return nil, ErrRequestTimeout
+	}
+}
+
+func (ch *ConnHandler) SendUntracked(message *AnyMessage) error {
+	delays := ch.deliveries(true)
+	if len(delays) == 0 {
+		logrus.Tracef("Filter dropped outbound message: %+v\n", message)
+		return nil
+	}
+	logrus.Tracef("Sending message: %+v\n", message)
+	frame, err := encodeFrame(message)
+	if err != nil {
+		return err
+	}
+	for _, delay := range delays {
+		if delay <= 0 {
+			if err := ch.write(frame); err != nil {
+				return err
+			}
+			continue
+		}
+		go func(delay time.Duration) {
+			<-ch.clock.After(delay)
+			if err := ch.write(frame); err != nil {
+				logrus.Debugf("Error sending delayed message: %v", err)
+			}
+		}(delay)
+	}
+	return nil
+}
+
+func (ch *ConnHandler) write(frame []byte) error {
+	ch.writeMx.Lock()
+	_, err := ch.conn.Write(frame)
+	ch.writeMx.Unlock()
+	if err != nil {
+		return fmt.Errorf("error sending request: %v", err)
+	}
+	return nil
+}
+
+func (ch *ConnHandler) readMessageLoop(ctx context.Context) {
+	defer logrus.Debugf("Shutdown connection listener loop\n")
+	for !ch.terminated.Load() {
+		select {
+		case <-ctx.Done():
+			ch.Close()
+			return
+		default:
+			ch.readNextSingleMessage()
+		}
+	}
+}
+
+func (ch *ConnHandler) readNextSingleMessage() {
+	message, err := readFrame(ch.conn)
+	if err != nil {
+		if ch.terminated.Load() || err == io.EOF {
+			logrus.Infof("Connection closed by peer")
+			ch.Close()
+			return
+		}
+		// The connection was reset, for example because the peer crashed, or the peer sent a truncated frame
+		logrus.Warnf("Error reading message, closing connection: %v", err)
+		ch.Close()
+		return
+	}
+	delays := ch.deliveries(false)
+	if len(delays) == 0 {
+		logrus.Tracef("Filter dropped inbound message of %d bytes", len(message))
+		return
+	}
+	for _, delay := range delays {
+		if delay <= 0 {
+			ch.handleMessage(message)
+			continue
+		}
+		go func(delay time.Duration) {
+			<-ch.clock.After(delay)
+			if !ch.terminated.Load() {
+				ch.handleMessage(message)
+			}
+		}(delay)
+	}
+}
+
+// handleMessage passes a received message to the request waiting for it, or to the request handler
+func (ch *ConnHandler) handleMessage(message []byte) {
+	now := ch.clock.Now()
+	ch.lastMessageTime.Store(&now)
+	// Now check message type
+	anyMessage, err := parseMessage(message)
+	if err != nil {
+		// The peer is not speaking the protocol, so nothing else it sends can be trusted either
+		logrus.Warnf("Error parsing message from %s, closing connection: %v", ch.RemoteAddr(), err)
+		ch.Close()
+		return
+	}
+	logrus.Tracef("Received message: %+v\n", anyMessage)
+	// Handle callback
+	ch.respMapMux.Lock()
+	respChan, ok := ch.respMap[anyMessage.RequestID]
+	// Delayed messages are handled concurrently, so a duplicated response must only be passed on once
+	delete(ch.respMap, anyMessage.RequestID)
+	ch.respMapMux.Unlock()
+	if ok {
+		logrus.Tracef("It was a response, and handling it now\n")
+		// This is a response to a request
+		respChan <- anyMessage
+	} else {
+		// This is a request and needs a response
+		logrus.Tracef("It was a request and forwarding it to the handler\n")
+		ch.requestHandler(ch, &anyMessage)
+	}
+}
+
+func (ch *ConnHandler) SetShutdownHook(newHook func()) {
+	ch.shutdownHook = newHook
+}
+
+func (ch *ConnHandler) Close() {
+	if ch.terminated.Swap(true) {
+		// Already closed
+		return
+	}
+	err := ch.conn.Close()
+	if err != nil {
+		if !(errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)) {
+			logrus.Errorf("Error closing connection: %v", err)
+		}
+	}
+	ch.shutdownHook()
+}
+
+// SetFilter delays, drops and duplicates messages as the filter decides, nil removes the filter
+func (ch *ConnHandler) SetFilter(filter Filter) {
+	if filter == nil {
+		ch.filter.Store(nil)
+	} else {
+		ch.filter.Store(&filter)
+	}
+}
+
+func (ch *ConnHandler) deliveries(outbound bool) []time.Duration {
+	filter := ch.filter.Load()
+	if filter == nil {
+		return deliverNow
+	}
+	return (*filter)(outbound)
+}
+
+func (ch *ConnHandler) SetHandler(handler RequestHandler) {
+	ch.requestHandler = handler
+}
+
+// HandleRequest invokes the current request handler, used when a handler is replaced mid-request
+func (ch *ConnHandler) HandleRequest(m *AnyMessage) {
+	ch.requestHandler(ch, m)
+}
+
+func (ch *ConnHandler) Terminated() bool {
+	return ch.terminated.Load()
+}
+
+func (ch *ConnHandler) LastMessageTime() time.Time {
+	if t := ch.lastMessageTime.Load(); t != nil {
+		return *t
+	}
+	return time.Time{}
+}
+
+func (ch *ConnHandler) RemoteAddr() net.Addr {
+	return ch.conn.RemoteAddr()
+}
@@ -0,0 +1,468 @@
+package protocol
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"unicode/utf8"
+)
+
+type OperationRequestMode int
+
+const (
+	// Inconsistent mode operations are similar to operations in weak consistency
+	//replication protocols: they can execute in different orders at each replica,
+	//and the application protocol must resolve conflicts afterwards
+	Inconsistent OperationRequestMode = iota
+
+	// Consensus mode operations allow the application protocol to decide
+	//the outcome of conflicts (by executing a decide function specified by the
+	//application protocol) and recover that decision afterwards by ensuring that
+	//the chosen result persists across failures as the consensus result.
+	//
+	// If replicas return conflicting/non-matching results for a consensus operation,
+	// IR allows the application protocol to decide the operation’s outcome by
+	// invoking the decide function – passed in by the application protocol to
+	// InvokeConsensus – in the client-side library. The decide function takes the list of
+	// returned results (the candidate results) and returns a single result,
+	//which IR ensures will persist as the consensus result. The application
+	//protocol can later recover the consensus result to find out its decision to
+	//conflicting operations.
+	Consensus
+)
+
+func (m OperationRequestMode) String() string {
+	switch m {
+	case Inconsistent:
+		return "INCONSISTENT"
+	case Consensus:
+		return "CONSENSUS"
+	default:
+		return fmt.Sprintf("OperationRequestMode(%d)", int(m))
+	}
+}
+
+type OperationRequest struct {
+	Mode          OperationRequestMode
+	ClientID      string
+	TransactionID string
+	Propose       *Operation
+	// Finalize can be its own message or piggy-backed onto next client proposed message
+	Finalize *Operation
+	// SlowPath is set on Finalize when the client decided the consensus result from a majority, as the replicas
+	// didn't return matching results from a fast quorum
+	SlowPath bool
+	// Result is the consensus result sent with Finalize of a consensus operation, the replicas apply the writes of
+	// the operation only if it has no error
+	Result *OperationResponse
+}
+
+type Operation struct {
+	ReadSet []string
+	// ReadCSet values that were read, which must be unchanged for the operation to succeed
+	ReadCSet  map[string]string
+	WriteCSet map[string]PutcOp
+	WriteSet  map[string]string
+	// DeleteSet keys to delete without checking their previous value
+	DeleteSet []string
+	// ScanSet ranges to read, the results are returned in the same order
+	ScanSet []KeyRange
+	// RangeCSet ranges that were read, which must still have the same values for the operation to succeed
+	RangeCSet []RangeRead
+}
+
+// KeyRange is the keys from Start (inclusive) to End (exclusive) in key order, an empty End is unbounded.
+// At most Limit keys are included, or all of them if Limit is 0.
+type KeyRange struct {
+	Start string
+	End   string
+	Limit int
+}
+
+// PrefixRange is the range of keys that start with the prefix
+func PrefixRange(prefix string, limit int) KeyRange {
+	if utf8.ValidString(prefix) {
+		// Ranges sent to replicas are JSON strings, which replace invalid UTF-8, so the end must be valid UTF-8 too.
+		// UTF-8 sorts in code point order, so incrementing the last character ends the range.
+		end := []rune(prefix)
+		for len(end) > 0 {
+			last := end[len(end)-1]
+			if last < utf8.MaxRune {
+				if last+1 == surrogateMin {
+					end[len(end)-1] = surrogateMax + 1
+				} else {
+					end[len(end)-1] = last + 1
+				}
+				return KeyRange{Start: prefix, End: string(end), Limit: limit}
+			}
+			end = end[:len(end)-1]
+		}
+		return KeyRange{Start: prefix, End: "", Limit: limit}
+	}
+	end := []byte(prefix)
+	for len(end) > 0 {
+		if end[len(end)-1] < 0xff {
+			end[len(end)-1]++
+			return KeyRange{Start: prefix, End: string(end), Limit: limit}
+		}
+		// 0xff can't be incremented, so the range ends after the shorter prefix
+		end = end[:len(end)-1]
+	}
+	return KeyRange{Start: prefix, End: "", Limit: limit}
+}
+
+// surrogateMin and surrogateMax are the code points reserved for UTF-16, which can't be encoded in UTF-8
+const (
+	surrogateMin = 0xd800
+	surrogateMax = 0xdfff
+)
+
+// Contains is true if the key is in the range, ignoring the limit
+func (r KeyRange) Contains(key string) bool {
+	return key >= r.Start && (r.End == "" || key < r.End)
+}
+
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// RangeRead is the result of reading a range
+type RangeRead struct {
+	Range  KeyRange
+	Values []KeyValue
+}
+
+type PutcOp struct {
+	Previous string
+	Proposed string
+	// Delete the key instead of writing Proposed
+	Delete bool
+}
+
+func (o *OperationRequest) String() string {
+	if o == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("%+v", *o)
+	}
+}
+
+// OperationResponse is effectively the reply message
+type OperationResponse struct {
+	success    bool
+	ReadValues map[string]string
+	// ScanResults the values of each range in the ScanSet of the operation
+	ScanResults []RangeRead
+	// ViewID IR replicas send their current view number in every response to clients
+	ViewID int
+	// Error is set when the replica rejected the operation instead of executing it
+	Error *ReplicaError
+}
+
+func (o *OperationResponse) String() string {
+	if o == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("%+v", *o)
+	}
+}
+
+type AnyMessage struct {
+	RequestID          string
+	Hello              *HelloMessage
+	HelloResponse      *HelloResponse
+	OperationRequest   *OperationRequest
+	OperationResponse  *OperationResponse
+	ViewChangeRequest  *ViewChangeRequest
+	ViewChangeResponse *ViewChangeResponse
+	ViewNotification   *ViewNotification
+	Leave              *LeaveNotification
+	SnapshotRequest    *SnapshotRequest
+	SnapshotResponse   *SnapshotResponse
+	DigestRequest      *DigestRequest
+	DigestResponse     *DigestResponse
+	RepairRequest      *RepairRequest
+	RepairResponse     *RepairResponse
+	Ping               int
+	Pong               int
+}
+
+// ViewChangeRequest is sent by the leader of a view change to the replicas, which accept it if they haven't accepted a
+// view change to the same or a later view
+type ViewChangeRequest struct {
+	ViewID int
+	// FromViewID is the view of the leader, replicas in a later view reject the view change so the leader catches up
+	FromViewID int
+	Members    []string
+}
+
+func (v *ViewChangeRequest) String() string {
+	if v == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("%+v", *v)
+	}
+}
+
+type ViewChangeResponse struct {
+	// ViewID is the last view the replica was NORMAL in
+	ViewID  int
+	Members []string
+	// Promised is the latest view the replica accepted a view change to
+	Promised int
+	// Error is set when the replica refused the proposed view
+	Error *ReplicaError
+}
+
+func (v *ViewChangeResponse) String() string {
+	if v == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("%+v", *v)
+	}
+}
+
+// ViewNotification is sent by a client to replicas that responded from an older view than other replicas, and by the
+// leader of a view change to the replicas once it decided the master record of the view
+type ViewNotification struct {
+	ViewID int
+}
+
+func (v *ViewNotification) String() string {
+	if v == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("%+v", *v)
+	}
+}
+
+// LeaveNotification is sent by a replica to its peers when it is shutting down, so they can start a view change
+type LeaveNotification struct {
+	ID string
+}
+
+func (l *LeaveNotification) String() string {
+	if l == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("%+v", *l)
+	}
+}
+
+// SnapshotRequest asks a replica for the next chunk of a snapshot of its storage. The first request of a snapshot
+// starts it, and the replica keeps the snapshot consistent until the last chunk has been requested.
+type SnapshotRequest struct {
+	SnapshotID string
+	// ChunkSize is the approximate serialized size of each chunk in bytes, a single entry larger than
+	// MaxMessageSize can't be sent
+	ChunkSize int
+	// Sections to send, the client data and the master record if empty
+	Sections []string
+}
+
+func (s *SnapshotRequest) String() string {
+	if s == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("%+v", *s)
+	}
+}
+
+type SnapshotResponse struct {
+	Chunk *SnapshotChunk
+	// Error is set when the replica could not produce the chunk, the snapshot must be started again
+	Error *ReplicaError
+}
+
+func (s *SnapshotResponse) String() string {
+	if s == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("%+v", *s)
+	}
+}
+
+// SnapshotChunk is part of a consistent copy of the storage of a replica
+type SnapshotChunk struct {
+	// Index of the chunk in the snapshot, starting from 0
+	Index int
+	// Sequence is the sequence number of the last transaction committed in the snapshot
+	Sequence uint64
+	Entries  []SnapshotEntry
+	// Last is true for the final chunk of the snapshot
+	Last bool
+}
+
+// SnapshotEntry is a stored key, the value is in the storage format of the replica
+type SnapshotEntry struct {
+	// Section of the storage the key is in, such as the client data or the master record
+	Section string
+	Key     []byte
+	Value   []byte
+}
+
+func (s *SnapshotChunk) String() string {
+	if s == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("{Index:%d Sequence:%d Entries:%d Last:%t}", s.Index, s.Sequence, len(s.Entries), s.Last)
+	}
+}
+
+// DigestRequest asks a replica for hashes of the committed values of key ranges, to compare replicas
+type DigestRequest struct {
+	Ranges []KeyRange
+}
+
+func (d *DigestRequest) String() string {
+	if d == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("%+v", *d)
+	}
+}
+
+type DigestResponse struct {
+	// Digests of each of the requested ranges, in the same order
+	Digests []RangeDigest
+	Error   *ReplicaError
+}
+
+func (d *DigestResponse) String() string {
+	if d == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("%+v", *d)
+	}
+}
+
+// RangeDigest is the number of keys in a range and a hash of their keys and values
+type RangeDigest struct {
+	Range KeyRange
+	Keys  int
+	Hash  string
+}
+
+// RepairRequest asks a replica to replace its data and master record with a snapshot of the replica From
+type RepairRequest struct {
+	From string
+}
+
+func (r *RepairRequest) String() string {
+	if r == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("%+v", *r)
+	}
+}
+
+type RepairResponse struct {
+	Error *ReplicaError
+}
+
+func (r *RepairResponse) String() string {
+	if r == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("%+v", *r)
+	}
+}
+
+type ReplicaErrorCode int
+
+const (
+	// ErrorCodeClusterTooSmall the view has fewer members than the minimum cluster size of the replica
+	ErrorCodeClusterTooSmall ReplicaErrorCode = iota + 1
+	// ErrorCodeAborted the replica refused the operation, for example because a compare and swap did not match
+	ErrorCodeAborted
+	// ErrorCodeRetry the replica could not process the operation right now, but may succeed if it is sent again
+	ErrorCodeRetry
+)
+
+// ReplicaError is a typed rejection sent by a replica in place of a result
+type ReplicaError struct {
+	Code    ReplicaErrorCode
+	Message string
+}
+
+func (e *ReplicaError) Error() string {
+	return e.Message
+}
+
+func NewClusterTooSmallError(members int, minClusterSize int) *ReplicaError {
+	return &ReplicaError{
+		Code:    ErrorCodeClusterTooSmall,
+		Message: fmt.Sprintf("cluster has %d members, below the minimum cluster size of %d", members, minClusterSize),
+	}
+}
+
+func NewAbortedError(message string) *ReplicaError {
+	return &ReplicaError{
+		Code:    ErrorCodeAborted,
+		Message: message,
+	}
+}
+
+func NewRetryError(message string) *ReplicaError {
+	return &ReplicaError{
+		Code:    ErrorCodeRetry,
+		Message: message,
+	}
+}
+
+type ClientType int
+
+const (
+	ClientTypeClient ClientType = iota
+	ClientTypeServer
+)
+
+type HelloMessage struct {
+	Type    ClientType
+	ID      string
+	Members []string
+	ViewID  int
+	Leader  string
+}
+
+func (m *HelloMessage) String() string {
+	if m == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("%+v", *m)
+	}
+}
+
+func NewHelloMessageFromClient(members []string, viewID int) *HelloMessage {
+	return &HelloMessage{
+		Type: ClientTypeClient,
+		// The client ID doesn't matter as long as it's unique
+		ID:      uuid.New().String(),
+		Members: members,
+		ViewID:  viewID,
+	}
+}
+
+func NewHelloMessageFromServer(id string, members []string, viewID int, leader string) *HelloMessage {
+	return &HelloMessage{
+		Type:    ClientTypeServer,
+		ID:      id,
+		Members: members,
+		ViewID:  viewID,
+		Leader:  leader,
+	}
+}
+
+type HelloResponse struct {
+	ViewID  int
+	Members []string
+	Leader  string
+}
+
+func (m *HelloResponse) String() string {
+	if m == nil {
+		return "nil"
+	} else {
+		return fmt.Sprintf("%+v", *m)
+	}
+}
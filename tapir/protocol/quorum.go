@@ -0,0 +1,34 @@
+package protocol
+
+import "math"
+
+// FastQuorum is true if count out of total replicas form a fast quorum, for which if all the results are identical
+// then there is no need to proceed to classic quorum
+func FastQuorum(count int, total int) bool {
+	return count >= fastQuorumSize(total)
+}
+
+// MajorityQuorum is true if count out of total replicas form a majority (f+1) quorum
+func MajorityQuorum(count int, total int) bool {
+	// we tolerate f failures in a 2f+1 group
+	// majority quorum is for f > (total-1)/2
+	return float64(count) > math.Ceil((float64(total)-1.0)/2.0)
+}
+
+// RecoveryQuorum is true if count matching results in the records of a majority of total replicas must be kept by
+// the leader of a view change, because the result may have been finalized on the fast path
+func RecoveryQuorum(count int, total int) bool {
+	// Any majority has at least this many replicas of a fast quorum
+	return count >= fastQuorumSize(total)+majoritySize(total)-total
+}
+
+// majoritySize is the smallest majority of total replicas, f+1 in a 2f+1 group
+func majoritySize(total int) int {
+	return total/2 + 1
+}
+
+// fastQuorumSize is the smallest fast quorum, ceil(3f/2)+1 in a 2f+1 group. Any majority has more replicas of a
+// fast quorum than of the replicas outside it, so the leader of a view change can tell which result was fast.
+func fastQuorumSize(total int) int {
+	return (2*total-majoritySize(total))/2 + 1
+}
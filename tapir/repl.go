@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"github.com/chzyer/readline"
 	"github.com/sirupsen/logrus"
-	"os"
+	"io"
 	"strings"
 )
 
@@ -61,7 +61,7 @@ func (r *Repl) Loop(ctx context.Context) {
 		default:
 			err := r.Iteration()
 			if err == ExitRequest(0) {
-				os.Exit(0)
+				return
 			} else if err != nil {
 				fmt.Printf("Error executing command: %v\n", err)
 			}
@@ -78,7 +78,8 @@ func (e ExitRequest) Error() string {
 func (r *Repl) Iteration() error {
 	input, err := r.Cli.Readline()
 	if err != nil {
-		if errors.Is(err, readline.ErrInterrupt) {
+		// The readline is closed with EOF when the process receives an exit signal
+		if errors.Is(err, readline.ErrInterrupt) || errors.Is(err, io.EOF) {
 			return ExitRequest(0)
 		}
 		fmt.Println("Error reading input:", err)
@@ -4,70 +4,90 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/server"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
 	"syscall"
-	"time"
 )
 
 func serve(c *cli.Context) error {
-	logrus.Debugf("Running server...")
-
-	store_filepath := c.String("filepath")
-	db, err := NewStorageEngine(store_filepath)
+	srv := server.New(server.Config{
+		ListenAddress:  fmt.Sprintf(":%d", c.Int("port")),
+		Members:        processMembers(c.String("cluster")),
+		StoragePath:    c.String("filepath"),
+		MinClusterSize: c.Int("min-cluster-size"),
+		Bootstrap:      c.Bool("bootstrap"),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := srv.Start(ctx)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
-
-	members_raw := c.String("cluster")
-	if err != nil {
-		return err
+	if address := c.String("metrics-address"); address != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", srv.Metrics())
+		metricsServer, err := serveHTTP("metrics", address, mux)
+		if err != nil {
+			return errors.Join(err, srv.Shutdown(ctx))
+		}
+		defer metricsServer.Close()
 	}
-	members := processMembers(members_raw)
-
-	bind_port := c.Int("port")
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", bind_port))
-	if err != nil {
-		return err
+	if address := c.String("admin-address"); address != "" {
+		mux := adminHandler(srv)
+		mux.Handle("/metrics", srv.Metrics())
+		adminServer, err := serveHTTP("admin API", address, mux)
+		if err != nil {
+			return errors.Join(err, srv.Shutdown(ctx))
+		}
+		defer adminServer.Close()
 	}
-	port := listener.Addr().(*net.TCPAddr).Port
-	host := normaliseIp(listener.Addr().(*net.TCPAddr).IP)
-	ctx := context.Background()
-	test_properties := &TestProperties{
-		viewChangePeriod: time.Duration(1) * time.Second,
+	signals, stopSignals := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	// Without the REPL the replica runs until it is signalled, so replDone is never closed
+	var replDone chan struct{}
+	if !c.Bool("no-repl") {
+		replDone = make(chan struct{})
+		go func() {
+			ServerRepl(ctx, srv)
+			close(replDone)
+		}()
 	}
-	ir := NewInconsistentReplicationProtocol(ctx, fmt.Sprintf("%s:%d", host, port), members, db, test_properties)
-	defer listener.Close()
-	logrus.Infof("Listening on port: %d", port)
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	go ServerRepl(ctx, test_properties, ir)
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-			conn, err := listener.Accept()
-			if err != nil {
-				return err
-			}
-			go serveConnectionInbound(conn, ir)
-		}
+	acceptErr := make(chan error, 1)
+	go func() {
+		acceptErr <- srv.Wait()
+	}()
+	select {
+	case <-signals.Done():
+		logrus.Infof("Received exit signal")
+	case <-replDone:
+	case err = <-acceptErr:
+		logrus.Errorf("Stopped accepting connections: %v", err)
 	}
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), c.Duration("shutdown-timeout"))
+	defer cancelShutdown()
+	return errors.Join(err, srv.Shutdown(shutdownCtx))
 }
 
-func normaliseIp(ip net.IP) string {
-	if ip.IsLoopback() || ip.IsMulticast() || ip.IsUnspecified() {
-		// We need to do this because binding to `:0` etc causes multi-host bind, but we need a specific address for membership identity
-		return "127.0.0.1"
-	}
-	if v4 := ip.To4(); v4 != nil {
-		return fmt.Sprintf("%d.%d.%d.%d", v4[0], v4[1], v4[2], v4[3])
+// serveHTTP the handler on the address until the returned server is closed
+func serveHTTP(name string, address string, handler http.Handler) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for %s: %w", name, err)
 	}
-	panic(fmt.Sprintf("Invalid IPv6 address: %s", ip))
+	httpServer := &http.Server{Handler: handler}
+	go func() {
+		if err := httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("Error serving %s: %v", name, err)
+		}
+	}()
+	logrus.Infof("Serving %s on http://%s", name, listener.Addr())
+	return httpServer, nil
 }
 
 func processMembers(members_raw string) []string {
@@ -83,20 +103,3 @@ func processMembers(members_raw string) []string {
 	}
 	return members
 }
-
-func serveConnectionInbound(conn net.Conn, ir *InconsistentReplicationProtocol) {
-	defer func() {
-		fmt.Println("Connection closed: ", conn.RemoteAddr())
-		err := conn.Close()
-		if err != nil {
-			if !(errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)) {
-				logrus.Warnf("Error closing connection: %+v", err)
-			}
-		}
-	}()
-
-	fmt.Println("New connection from: ", conn.RemoteAddr())
-	ctx := context.Background()
-	ch := newPeerConnection(ctx, conn, ir)
-	ch.blockingPingLoop()
-}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Compactor periodically removes state that is no longer needed: operations in the IR record from views before the
+// stored master record, which has them, and the tombstones of deleted keys below the low-water mark, the oldest
+// transaction in progress.
+type Compactor struct {
+	db     StorageEngine
+	clock  protocol.Clock
+	period time.Duration
+	// mx serialises compactions and guards the stats
+	mx    sync.Mutex
+	stats CompactorStats
+}
+
+// Compaction is the result of a single compaction
+type Compaction struct {
+	RecordEntries Reclaimed
+	Tombstones    Reclaimed
+	Duration      time.Duration
+}
+
+// CompactorStats are the totals of all compactions since the replica started
+type CompactorStats struct {
+	Runs          int
+	Errors        int
+	LastRun       time.Time
+	Last          Compaction
+	RecordEntries Reclaimed
+	Tombstones    Reclaimed
+}
+
+func NewCompactor(db StorageEngine, clock protocol.Clock, period time.Duration) *Compactor {
+	return &Compactor{
+		db:     db,
+		clock:  clock,
+		period: period,
+	}
+}
+
+// Run compacts every period until the context is done
+func (c *Compactor) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.clock.After(c.period):
+			compaction, err := c.Compact()
+			if err != nil {
+				logrus.Warnf("Error compacting storage: %v", err)
+			} else if compaction.RecordEntries.Entries > 0 || compaction.Tombstones.Entries > 0 {
+				logrus.Debugf("Compacted %d record entries and %d tombstones, reclaiming %d bytes in %s",
+					compaction.RecordEntries.Entries, compaction.Tombstones.Entries,
+					compaction.RecordEntries.Bytes+compaction.Tombstones.Bytes, compaction.Duration)
+			}
+		}
+	}
+}
+
+// Compact removes the state that is no longer needed now
+func (c *Compactor) Compact() (Compaction, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	start := c.clock.Now()
+	compaction := Compaction{}
+	var err error
+	compaction.RecordEntries, err = c.db.TruncateRecord()
+	if err == nil {
+		compaction.Tombstones, err = c.db.CollectTombstones()
+	}
+	compaction.Duration = c.clock.Now().Sub(start)
+	c.stats.Runs++
+	c.stats.LastRun = start
+	c.stats.Last = compaction
+	c.stats.RecordEntries = c.stats.RecordEntries.Add(compaction.RecordEntries)
+	c.stats.Tombstones = c.stats.Tombstones.Add(compaction.Tombstones)
+	if err != nil {
+		c.stats.Errors++
+		return compaction, err
+	}
+	return compaction, nil
+}
+
+func (c *Compactor) Stats() CompactorStats {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.stats
+}
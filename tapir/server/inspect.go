@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InspectFilter limits what Inspect returns, empty fields match everything
+type InspectFilter struct {
+	// KeyPrefix matches client data keys, and record entries with an operation on a matching key
+	KeyPrefix string
+	// ClientID matches record entries of the client
+	ClientID string
+}
+
+// Inspection is the contents of a bbolt database file
+type Inspection struct {
+	// Sequence is the sequence number of the last committed transaction
+	Sequence           uint64
+	Data               []InspectedKey
+	Record             []RecordEntry
+	MasterRecordViewID int
+	// SyncedViewID is the view every member had adopted the master record of, see StorageEngine.SyncedViewID
+	SyncedViewID int
+	MasterRecord []RecordEntry
+}
+
+// InspectedKey is a client data key with its version, or a tombstone if Deleted
+type InspectedKey struct {
+	Key     string
+	Version uint64
+	Deleted bool
+	Value   string
+}
+
+// Inspect opens a bbolt database file read-only and returns its contents, so it can be used while a replica is down
+func Inspect(filepath string, filter InspectFilter) (*Inspection, error) {
+	db, err := bbolt.Open(filepath, 0600, &bbolt.Options{ReadOnly: true, Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	defer db.Close()
+	inspection := &Inspection{}
+	err = db.View(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{DATA_BUCKET, SYSTEM_BUCKET, MASTER_RECORD_BUCKET} {
+			if tx.Bucket(name) == nil {
+				return fmt.Errorf("bucket %s does not exist, the file is not a replica database", name)
+			}
+		}
+		data := tx.Bucket(DATA_BUCKET)
+		inspection.Sequence = data.Sequence()
+		c := data.Cursor()
+		for k, v := c.Seek([]byte(filter.KeyPrefix)); k != nil && bytes.HasPrefix(k, []byte(filter.KeyPrefix)); k, v = c.Next() {
+			value, err := decodeVersionedValue(v)
+			if err != nil {
+				return fmt.Errorf("error reading key %s: %w", k, err)
+			}
+			inspection.Data = append(inspection.Data, InspectedKey{
+				Key:     string(k),
+				Version: value.Version,
+				Deleted: value.Deleted,
+				Value:   string(value.Value),
+			})
+		}
+		err := tx.Bucket(SYSTEM_BUCKET).ForEach(func(k, v []byte) error {
+			var entry RecordEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("error reading record entry %s: %w", k, err)
+			}
+			if filter.matches(entry) {
+				inspection.Record = append(inspection.Record, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(MASTER_RECORD_BUCKET).ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, MASTER_RECORD_VIEW_KEY) {
+				var err error
+				inspection.MasterRecordViewID, err = strconv.Atoi(string(v))
+				return err
+			}
+			if bytes.Equal(k, MASTER_RECORD_SYNCED_VIEW_KEY) {
+				var err error
+				inspection.SyncedViewID, err = strconv.Atoi(string(v))
+				return err
+			}
+			var entry RecordEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("error reading master record entry %s: %w", k, err)
+			}
+			if filter.matches(entry) {
+				inspection.MasterRecord = append(inspection.MasterRecord, entry)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inspection, nil
+}
+
+func (f InspectFilter) matches(entry RecordEntry) bool {
+	if f.ClientID != "" && entry.ClientID != f.ClientID {
+		return false
+	}
+	if f.KeyPrefix == "" {
+		return true
+	}
+	op := entry.Operation
+	if op == nil {
+		return false
+	}
+	keys := append([]string(nil), op.ReadSet...)
+	keys = append(keys, op.DeleteSet...)
+	for key := range op.WriteSet {
+		keys = append(keys, key)
+	}
+	for key := range op.WriteCSet {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, f.KeyPrefix) {
+			return true
+		}
+	}
+	for _, r := range op.ScanSet {
+		if r.Contains(f.KeyPrefix) || strings.HasPrefix(r.Start, f.KeyPrefix) {
+			return true
+		}
+	}
+	for _, read := range op.RangeCSet {
+		if read.Range.Contains(f.KeyPrefix) || strings.HasPrefix(read.Range.Start, f.KeyPrefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,981 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// protocolPeriod is how often a replica checks whether a view change is needed
+const protocolPeriod = 100 * time.Millisecond
+
+type InconsistentReplicationProtocol struct {
+	self string
+	tp   *TestProperties
+	db   StorageEngine
+	// NOTE: this list can contain peers that are not members, and can miss peers that should be members
+	peers map[string]*PeerTracker
+	view  View
+	// promised is the latest view this replica proposed or accepted a view change to, it doesn't accept view changes
+	// to earlier views
+	promised int
+	// catchingUp is set while fetching a master record to catch up to a later view
+	catchingUp atomic.Bool
+	// mx guards peers, view, promised and dialing. The members of a view are replaced rather than modified, so copies of the
+	// view can be read without the lock.
+	mx sync.RWMutex
+	// minClusterSize below this many members operations are rejected even if there is quorum, 0 disables the check
+	minClusterSize int
+	// completedViewID is the last view this replica completed a view change to, the record from earlier views
+	// has been merged into the master record
+	completedViewID atomic.Int64
+	// viewChangeRequested is set when a peer left, so that a view change happens without waiting for the period
+	viewChangeRequested atomic.Bool
+	// operationMx serializes operations, so that an operation proposed twice is only executed once, and guards
+	// prepared and unapplied. View changes hold it while changing state, and it is taken before mx.
+	operationMx sync.Mutex
+	// prepared consensus operations are waiting for their consensus result
+	prepared preparedOperations
+	// unapplied consensus operations committed before an operation this replica hasn't applied yet
+	unapplied preparedOperations
+	// inflight tracks operations being processed, so that shutdown can wait for them
+	inflight sync.WaitGroup
+	draining bool
+	// repairing rejects operations while the data is replaced by a repair
+	repairing bool
+	drainMx   sync.Mutex
+	// snapshots being sent to other replicas, by snapshot ID
+	snapshots   map[string]*snapshotSession
+	snapshotsMx sync.Mutex
+	// bootstrapMembers are dialed again when they aren't connected, dialing is guarded by mx
+	bootstrapMembers []string
+	dialing          map[string]bool
+	lastReconnect    time.Time
+	metrics          *replicaMetrics
+}
+
+type PeerTracker struct {
+	conn   *protocol.ConnHandler
+	ViewID int
+}
+
+type View struct {
+	currentViewID int
+	self          string
+	when          time.Time
+	leader        string
+	members       []string
+	ViewState     ViewState
+}
+
+// ViewID is the current view of the replica
+func (v View) ViewID() int {
+	return v.currentViewID
+}
+
+// Members of the current view
+func (v View) Members() []string {
+	return v.members
+}
+
+type ViewState struct {
+	Normal int
+	// Changing On receiving a message with a view number that is higher than its current view,
+	// a replica moves to the VIEW-CHANGING state and requests the master record from any replica
+	// in the higher view. It replaces its own record with the master record and upcalls into the application
+	// protocol with Sync before returning to NORMAL state.
+	Changing *ViewStateChanging
+	Recovery *ViewStateRecovery
+}
+
+type ViewStateChanging struct {
+	FromViewID      int
+	ToViewID        int
+	proposedMembers []string
+}
+
+type ViewStateRecovery struct {
+	FromViewID int
+	ToViewID   int
+}
+
+func NewInconsistentReplicationProtocol(ctx context.Context, self string, members []string, minClusterSize int, db StorageEngine, tp *TestProperties) *InconsistentReplicationProtocol {
+	// Read local store view, default is 0 with provided config
+	ir := &InconsistentReplicationProtocol{
+		self:           self,
+		tp:             tp,
+		peers:          make(map[string]*PeerTracker),
+		db:             db,
+		minClusterSize: minClusterSize,
+		snapshots:      make(map[string]*snapshotSession),
+		prepared:       make(preparedOperations),
+		unapplied:      make(preparedOperations),
+		view: View{
+			currentViewID: 0,
+			self:          self,
+			leader:        "",
+			members:       members,
+			when:          tp.clock.Now(),
+			ViewState:     ViewState{Normal: 0, Changing: nil, Recovery: nil},
+		},
+		bootstrapMembers: append([]string(nil), members...),
+		dialing:          make(map[string]bool),
+	}
+	ir.metrics = newReplicaMetrics(ir)
+	ir.loadPrepared()
+	logrus.Infof("Initialized InconsistentReplicationProtocol with self '%s' and members(%d) '%+v'", self, len(members), members)
+	for _, member := range members {
+		if member == self {
+			continue
+		}
+		if err := ir.connectPeer(ctx, member); err != nil {
+			logrus.Warnf("Error connecting to peer '%+v': %v", member, err)
+		}
+	}
+	go ir.protocolExecution(ctx)
+	return ir
+}
+
+// connectPeer dials the member and introduces this replica to it
+func (p *InconsistentReplicationProtocol) connectPeer(ctx context.Context, member string) error {
+	conn, err := p.tp.network.Dial(member)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Connected to peer: %s", member)
+	// The shutdown hook is set once the peer is added, as it removes this connection
+	peer := protocol.NewConnHandlerWithClock(ctx, conn, p.tp.clock,
+		func(ch *protocol.ConnHandler, m *protocol.AnyMessage) {
+			p.handleMessage(member, ch, m)
+		},
+		func() {},
+	)
+	p.AddPeer(member, peer, 0)
+	peer.SetShutdownHook(func() {
+		p.removePeerConn(member, peer)
+	})
+	go p.peerInit(ctx, peer)
+	return nil
+}
+
+// reconnectPeers dials the bootstrap members that aren't connected, for example after a partition healed. Only the
+// replica with the lower address dials, so that two replicas don't replace each other's connection.
+func (p *InconsistentReplicationProtocol) reconnectPeers(ctx context.Context) {
+	now := p.tp.clock.Now()
+	if now.Sub(p.lastReconnect) < p.tp.GetTimeout() {
+		return
+	}
+	p.lastReconnect = now
+	for _, member := range p.bootstrapMembers {
+		if member <= p.self || p.tp.Blocked(p.self, member) || p.tp.Blocked(member, p.self) {
+			continue
+		}
+		p.mx.Lock()
+		_, connected := p.peers[member]
+		if connected || p.dialing[member] {
+			p.mx.Unlock()
+			continue
+		}
+		p.dialing[member] = true
+		p.mx.Unlock()
+		// Dialing an unreachable host can take a while, so don't hold up view changes
+		go func(member string) {
+			if err := p.connectPeer(ctx, member); err != nil {
+				logrus.Debugf("Error reconnecting to peer '%s': %v", member, err)
+			}
+			p.mx.Lock()
+			delete(p.dialing, member)
+			p.mx.Unlock()
+		}(member)
+	}
+}
+
+// / handleMessage is called by a node acting as a peer-client to another node
+func (p *InconsistentReplicationProtocol) handleMessage(peer string, ch *protocol.ConnHandler, m *protocol.AnyMessage) {
+	if p.tp.DecDropReplica() {
+		return
+	}
+	if m.Ping != 0 {
+		if p.tp.DecDropPing() {
+			logrus.Tracef("Dropping ping message from peer '%s'", peer)
+			return
+		}
+		err := ch.SendUntracked(&protocol.AnyMessage{RequestID: m.RequestID, Pong: m.Ping})
+		if err != nil {
+			logrus.Warnf("Error sending pong: %v", err)
+		}
+	} else if m.Hello != nil {
+		view := p.currentView()
+		err := ch.SendUntracked(&protocol.AnyMessage{RequestID: m.RequestID,
+			HelloResponse: &protocol.HelloResponse{ViewID: view.currentViewID,
+				Members: view.members,
+				Leader:  view.leader,
+			}})
+		if err != nil {
+			logrus.Warnf("Error sending hello response: %v", err)
+			ch.Close()
+		} else if m.Hello.ViewID > view.currentViewID {
+			// Fetching the master record would block other messages from the peer. The response is sent first, so
+			// that it isn't interleaved with the requests of the catch up.
+			go p.catchupToView(m.Hello.ViewID, ch)
+		}
+	} else if m.ViewChangeRequest != nil {
+		err := ch.SendUntracked(&protocol.AnyMessage{
+			RequestID:          m.RequestID,
+			ViewChangeResponse: p.acceptViewChange(peer, m.ViewChangeRequest),
+		})
+		if err != nil {
+			logrus.Errorf("Failed to send view change response: %s", err.Error())
+		}
+	} else if m.ViewNotification != nil {
+		// The leader of the view change decided the master record, fetching it would block the responses
+		go p.catchupToView(m.ViewNotification.ViewID, ch)
+	} else if m.SnapshotRequest != nil {
+		// Chunks can take a while to produce, so don't block other messages from the peer
+		go p.serveSnapshotRequest(ch, m)
+	} else if m.Leave != nil {
+		logrus.Infof("Peer '%s' is leaving the cluster", peer)
+		p.RemovePeer(peer)
+		p.viewChangeRequested.Store(true)
+	} else {
+		logrus.Warnf("Unhandled message from peer '%+v': %+v", peer, m)
+	}
+}
+
+func (p *InconsistentReplicationProtocol) protocolExecution(ctx context.Context) {
+	// Read local view
+	// Check member views
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.tp.clock.After(protocolPeriod):
+			p.protocolIteration()
+			p.reconnectPeers(ctx)
+		}
+	}
+}
+
+func (p *InconsistentReplicationProtocol) peersThatAreMembers() []string {
+	p.mx.RLock()
+	defer p.mx.RUnlock()
+	memberPeers := make([]string, 0, len(p.peers))
+	for s := range p.peers {
+		for _, candidate := range p.view.members {
+			if candidate == s {
+				memberPeers = append(memberPeers, s)
+			}
+		}
+	}
+	return memberPeers
+}
+
+// a fast quorum, for which if all the results are identical then there is no need to proceed to classic quorum
+// NOTE: remember to add self to the list, because you don't have a response from self
+func (p *InconsistentReplicationProtocol) fastQuorum(count int) bool {
+	return protocol.FastQuorum(count, len(p.view.members))
+}
+
+// majority quorum will be true if the provided number of *VOTERS* is within the quorum.
+// NOTE: remember to add self to list of voters, as yourself is not included in request responses
+func (p *InconsistentReplicationProtocol) majorityQuorum(count int) bool {
+	return protocol.MajorityQuorum(count, len(p.view.members))
+}
+
+// checkClusterSize returns an error if a view with the given number of members is below the minimum cluster size
+func (p *InconsistentReplicationProtocol) checkClusterSize(members int) *protocol.ReplicaError {
+	if members < p.minClusterSize {
+		return protocol.NewClusterTooSmallError(members, p.minClusterSize)
+	}
+	return nil
+}
+
+func (p *InconsistentReplicationProtocol) shouldBeNextLeader() bool {
+	// Add only live nodes that are part of the current view
+	p.mx.RLock()
+	defer p.mx.RUnlock()
+	sorted := make([]string, 0, len(p.view.members))
+	// Add self :)
+	sorted = append(sorted, p.self)
+	for _, member := range p.view.members {
+		if peer, ok := p.peers[member]; ok {
+			if peer.conn.LastMessageTime().After(p.tp.clock.Now().Add(-p.tp.GetTimeout())) {
+				sorted = append(sorted, member)
+			}
+		}
+	}
+	// Check if we are the next leader
+	sort.Strings(sorted)
+	return sorted[0] == p.self
+}
+
+func (p *InconsistentReplicationProtocol) viewChangeNeeded() bool {
+	// View changes are needed if the view has expired AND membership needs updating
+	// This prevents membership being too flaky
+	view := p.currentView()
+	viewChangePeriod := p.tp.GetViewChangePeriod()
+	if view.when.IsZero() {
+		panic("Current view 'when' is not set")
+	}
+	if p.viewChangeRequested.Swap(false) {
+		logrus.Debugf("View change requested before the view change period expired")
+		return true
+	}
+	if viewChangePeriod <= 0 {
+		// Periodic view changes are disabled, only requested ones happen
+		return false
+	}
+	viewChangeTimeoutExpired := view.when.Add(viewChangePeriod).Before(p.tp.clock.Now())
+	// Do we need to add anyone
+	peersAreMembers := func() bool {
+		p.mx.RLock()
+		defer p.mx.RUnlock()
+		// all members in peers, no need to vote anyone out
+		for _, member := range view.members {
+			if peer, ok := p.peers[member]; ok {
+				if !peer.conn.LastMessageTime().After(p.tp.clock.Now().Add(-p.tp.GetTimeout())) {
+					return false
+				}
+			} else {
+				return false
+			}
+		}
+		return false
+	}()
+	// Do we need to remove anyone
+	contains := func(item string, set map[string]*PeerTracker) bool {
+		for k, _ := range set {
+			if item == k {
+				return true
+			}
+		}
+		return false
+	}
+	membersArePeers := func() bool {
+		p.mx.RLock()
+		defer p.mx.RUnlock()
+		for peer := range p.peers {
+			if !contains(peer, p.peers) {
+				return false
+			}
+		}
+		return true
+	}()
+	if viewChangeTimeoutExpired {
+		logrus.Tracef("The view timeout has expired but peersAreMember=%t and membersArePeers=%t", peersAreMembers, membersArePeers)
+	}
+	return viewChangeTimeoutExpired && !(peersAreMembers && membersArePeers)
+}
+
+func (p *InconsistentReplicationProtocol) protocolIteration() {
+	// Check when the last view was, only the next leader proposes so that replicas don't compete for the same view
+	if p.viewChangeNeeded() && p.shouldBeNextLeader() {
+		p.proposeViewChange()
+	}
+	// Validate Leader and check view change need
+}
+
+// proposeViewChange During a view change, the leader has just one task: to make at least f + 1 replicas up-to-date
+// (i.e., they have applied all operations in the operation set) and consistent with each other (i.e., they have applied the same consensus results).
+// IR view changes require a leader because polling inconsistent replicas can lead to conflicting sets of operations and consensus results.
+// Thus, the leader must decide on a master record that replicas can then use to synchronize with each other.
+//
+// Each view change is coordinated by a leader, which is unique per view and deterministically chosen.
+// There are three key differences. First, in IR the leader merges records during a view change rather than simply
+// taking the longest log from the latest view. The reason for this is that, with inconsistent replicas and unordered
+// operations, any single record could be incomplete. Second, in VR, the leader is used to process operations in the
+// normal case, but IR uses the leader only for performing view changes. Finally, on recovery, an IR replica performs
+// a view change, rather than simply interrogating a single replica. This makes sure that the recovering replica either
+// receives all operations it might have sent a reply for, or prevents them from completing.
+//
+// (RE TAPIR Lock service example)
+// Sync for the lock server matches up all corresponding Lock and Unlock by id;
+// if there are unmatched Locks, it sets locked = TRUE; otherwise, locked = FALSE.
+func (p *InconsistentReplicationProtocol) proposeViewChange() {
+	// The proposed members are the live peers and ourselves
+	proposedMembers := append(p.livePeers(), p.self)
+	p.operationMx.Lock()
+	p.mx.Lock()
+	currentViewID := p.view.currentViewID
+	if err := p.checkClusterSize(len(proposedMembers)); err != nil {
+		logrus.Warnf("Not proposing view change from view %d: %s", currentViewID, err.Error())
+		// Wait another view change period before retrying
+		p.view.when = p.tp.clock.Now()
+		p.mx.Unlock()
+		p.operationMx.Unlock()
+		return
+	}
+	// Propose a view no replica accepted yet, as far as we know, so that there is one leader per view
+	viewID := max(currentViewID, p.promised) + 1
+	p.promised = viewID
+	p.view.when = p.tp.clock.Now()
+	p.view.leader = p.self
+	p.view.ViewState = ViewState{Changing: &ViewStateChanging{
+		FromViewID:      currentViewID,
+		ToViewID:        viewID,
+		proposedMembers: proposedMembers,
+	}}
+	view := p.view
+	p.mx.Unlock()
+	p.operationMx.Unlock()
+	started := p.tp.clock.Now()
+	err := p.changeView(view)
+	p.metrics.viewChangeDuration.With().ObserveDuration(p.tp.clock.Now().Sub(started))
+	if err != nil {
+		logrus.Warnf("Failed to change view: %s", err.Error())
+		p.metrics.viewChanges.With("failed").Inc()
+		p.abandonViewChange(viewID, errors.Is(err, errViewChangeSuperseded))
+		return
+	}
+	p.metrics.viewChanges.With("completed").Inc()
+}
+
+// currentView is a copy of the view of the replica
+func (p *InconsistentReplicationProtocol) currentView() View {
+	p.mx.RLock()
+	defer p.mx.RUnlock()
+	return p.view
+}
+
+// peerOf is the member connected through the connection, if it is a peer
+func (p *InconsistentReplicationProtocol) peerOf(ch *protocol.ConnHandler) (string, bool) {
+	p.mx.RLock()
+	defer p.mx.RUnlock()
+	for member, peer := range p.peers {
+		if peer.conn == ch {
+			return member, true
+		}
+	}
+	return "", false
+}
+
+// lastCompletedViewID is the last view this replica completed a view change to
+func (p *InconsistentReplicationProtocol) lastCompletedViewID() int {
+	return int(p.completedViewID.Load())
+}
+
+// livePeers are the connected peers that sent a message within the timeout, in order
+func (p *InconsistentReplicationProtocol) livePeers() []string {
+	p.mx.RLock()
+	defer p.mx.RUnlock()
+	deadline := p.tp.clock.Now().Add(-p.tp.GetTimeout())
+	peers := make([]string, 0, len(p.peers))
+	for member, peer := range p.peers {
+		if peer.conn.LastMessageTime().After(deadline) {
+			peers = append(peers, member)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// peerConnections are the connections to the peers, in the order of their members so that peers are tried in the same
+// order every time
+func (p *InconsistentReplicationProtocol) peerConnections() []*protocol.ConnHandler {
+	p.mx.RLock()
+	defer p.mx.RUnlock()
+	members := make([]string, 0, len(p.peers))
+	for member := range p.peers {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	peer_connections := make([]*protocol.ConnHandler, 0, len(p.peers))
+	for _, member := range members {
+		peer_connections = append(peer_connections, p.peers[member].conn)
+	}
+	return peer_connections
+}
+
+// sendViewChangeRequest asks the peers to accept the view change, returning the peers that accepted. Superseded is true
+// if a peer refused because it accepted a view change to the same or a later view.
+func (p *InconsistentReplicationProtocol) sendViewChangeRequest(view *View) (accepted map[string]acceptedViewChange, superseded bool) {
+	changing := view.ViewState.Changing
+	p.mx.RLock()
+	peers := make(map[string]*protocol.ConnHandler, len(p.peers))
+	for member, peer := range p.peers {
+		peers[member] = peer.conn
+	}
+	p.mx.RUnlock()
+	type result struct {
+		member   string
+		conn     *protocol.ConnHandler
+		response *protocol.ViewChangeResponse
+		err      error
+	}
+	// Buffered so that late responses don't block
+	results := make(chan result, len(peers))
+	for member, conn := range peers {
+		go func(member string, conn *protocol.ConnHandler) {
+			res, err := conn.SendRequest(&protocol.AnyMessage{
+				RequestID: uuid.New().String(),
+				ViewChangeRequest: &protocol.ViewChangeRequest{
+					ViewID:     changing.ToViewID,
+					FromViewID: changing.FromViewID,
+					Members:    changing.proposedMembers,
+				},
+			})
+			if err == nil && res.ViewChangeResponse == nil {
+				err = fmt.Errorf("unexpected response to view change request: %+v", res)
+			}
+			r := result{member: member, conn: conn, err: err}
+			if err == nil {
+				r.response = res.ViewChangeResponse
+			}
+			results <- r
+		}(member, conn)
+	}
+	accepted = make(map[string]acceptedViewChange, len(peers))
+	deadline := p.tp.clock.After(p.tp.GetTimeout())
+	for i := 0; i < len(peers); i++ {
+		select {
+		case r := <-results:
+			if r.err == nil && r.response.ViewID > view.currentViewID {
+				// The view change can't complete without the master record of the later view
+				go p.catchupToView(r.response.ViewID, r.conn)
+			}
+			if r.err != nil {
+				logrus.Warnf("Failed to make peer request to change view: %s", r.err.Error())
+			} else if r.response.Error != nil {
+				logrus.Warnf("Peer '%s' rejected view change to view %d: %s", r.member, changing.ToViewID, r.response.Error.Error())
+				superseded = superseded || r.response.Promised >= changing.ToViewID
+			} else {
+				accepted[r.member] = acceptedViewChange{conn: r.conn, response: r.response}
+			}
+		case <-deadline:
+			logrus.Warnf("Not all peers responded to change view: received %d out of %d responses", i, len(peers))
+			return accepted, superseded
+		}
+	}
+	return accepted, superseded
+}
+
+func (p *InconsistentReplicationProtocol) AddPeer(s string, ch *protocol.ConnHandler, ViewID int) {
+	ch.SetFilter(func(outbound bool) []time.Duration {
+		return p.tp.deliveries(p.self, s, outbound)
+	})
+	// The lock is important both for iterating over membership but also for detail changes
+	p.mx.Lock()
+	previous, ok := p.peers[s]
+	if ok {
+		delete(p.peers, s)
+	}
+	p.peers[s] = &PeerTracker{
+		conn:   ch,
+		ViewID: ViewID,
+	}
+	p.mx.Unlock()
+	if ok {
+		// Closing runs the shutdown hook, which takes the lock, and only removes the peer if it is still this connection
+		previous.conn.Close()
+	}
+}
+
+func (p *InconsistentReplicationProtocol) RemovePeer(member string) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	delete(p.peers, member)
+	logrus.Infof("Removed peer: %s, peers now are: %+v", member, p.peers)
+}
+
+// removePeerConn removes the peer if it is still connected through the connection, which closed
+func (p *InconsistentReplicationProtocol) removePeerConn(member string, ch *protocol.ConnHandler) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if peer, ok := p.peers[member]; ok && peer.conn == ch {
+		delete(p.peers, member)
+		logrus.Infof("Removed peer: %s, peers now are: %+v", member, p.peers)
+	}
+}
+
+// processOperation adds a proposed operation to the record with the result of executing it, or finalizes it.
+// Inconsistent operations are FINALIZED once executed. Consensus operations are prepared: they stay TENTATIVE until
+// the client finalizes them with the consensus result, and their writes are only applied if that result succeeded.
+// Operations are rejected while the replica is VIEW-CHANGING, as they could be missing from the master record.
+func (p *InconsistentReplicationProtocol) processOperation(request *protocol.OperationRequest) *protocol.OperationResponse {
+	p.operationMx.Lock()
+	defer p.operationMx.Unlock()
+	view := p.currentView()
+	if changing := view.ViewState.Changing; changing != nil {
+		return &protocol.OperationResponse{
+			ViewID: view.currentViewID,
+			Error:  protocol.NewRetryError(fmt.Sprintf("changing from view %d to view %d", changing.FromViewID, changing.ToViewID)),
+		}
+	}
+	result := p.processOperationInView(request, view.currentViewID)
+	result.ViewID = view.currentViewID
+	return result
+}
+
+// processOperationInView processes the operation in the view, holding operationMx
+func (p *InconsistentReplicationProtocol) processOperationInView(request *protocol.OperationRequest, viewID int) *protocol.OperationResponse {
+	if request.Propose == nil {
+		if request.Finalize == nil {
+			return &protocol.OperationResponse{}
+		}
+		if request.Mode == protocol.Consensus {
+			p.metrics.finalized.With(finalizedPath(request.SlowPath)).Inc()
+			return p.finalizeOperation(request)
+		}
+		if err := p.db.FinalizeRecord(request.TransactionID); err != nil {
+			logrus.Debugf("Not finalizing operation %s: %v", request.TransactionID, err)
+		}
+		return &protocol.OperationResponse{}
+	}
+	// The client sends the propose again when it retries, so reply with the result the operation already has
+	if entry, ok, err := p.db.LookupRecord(request.TransactionID); err != nil {
+		return &protocol.OperationResponse{Error: protocol.NewRetryError(err.Error())}
+	} else if ok {
+		return entry.response()
+	}
+	var result *protocol.OperationResponse
+	if request.Mode == protocol.Consensus {
+		result = p.prepareOperation(request.ClientID, request.TransactionID, request.Propose)
+	} else {
+		result = p.executeOperation(request.ClientID, request.TransactionID, request.Propose)
+	}
+	if result.Error != nil && result.Error.Code == protocol.ErrorCodeRetry {
+		// Nothing was executed, so the operation can be executed when it is proposed again
+		return result
+	}
+	entry := RecordEntry{
+		ID:          request.TransactionID,
+		ClientID:    request.ClientID,
+		ViewID:      viewID,
+		Mode:        request.Mode,
+		Operation:   request.Propose,
+		State:       Tentative,
+		ReadValues:  result.ReadValues,
+		ScanResults: result.ScanResults,
+		Error:       result.Error,
+	}
+	if request.Mode == protocol.Inconsistent {
+		entry.State = Finalized
+	}
+	if err := p.db.AddRecord(entry); err != nil {
+		logrus.Errorf("Error adding operation %s to the record: %v", request.TransactionID, err)
+		delete(p.prepared, request.TransactionID)
+		return &protocol.OperationResponse{Error: protocol.NewRetryError(err.Error())}
+	}
+	return result
+}
+
+// prepareOperation validates a consensus operation, and if it succeeds holds it as prepared until it is finalized
+func (p *InconsistentReplicationProtocol) prepareOperation(clientID string, transactionID string, op *protocol.Operation) *protocol.OperationResponse {
+	if id, ok := p.prepared.conflicting(op); ok {
+		return &protocol.OperationResponse{Error: protocol.NewAbortedError(fmt.Sprintf("operation conflicts with prepared operation %s", id))}
+	}
+	if id, ok := p.unapplied.conflicting(op); ok {
+		return &protocol.OperationResponse{Error: protocol.NewAbortedError(fmt.Sprintf("operation conflicts with committed operation %s", id))}
+	}
+	result := p.executeOperation(clientID, transactionID, op)
+	if result.Error == nil {
+		p.prepared[transactionID] = op
+	}
+	return result
+}
+
+// finalizeOperation marks a consensus operation FINALIZED with the result the client decided, which may differ from the
+// result of this replica, and applies its writes if the result succeeded. A replica that never received the propose
+// adds the operation to its record now.
+func (p *InconsistentReplicationProtocol) finalizeOperation(request *protocol.OperationRequest) *protocol.OperationResponse {
+	entry, ok, err := p.db.LookupRecord(request.TransactionID)
+	if err != nil {
+		return &protocol.OperationResponse{Error: protocol.NewRetryError(err.Error())}
+	}
+	if ok && entry.State == Finalized {
+		if request.Result != nil && !sameResult(entry, RecordEntry{ReadValues: request.Result.ReadValues, ScanResults: request.Result.ScanResults, Error: request.Result.Error}) {
+			// A view change decided the operation differently, so the client's result didn't persist
+			return &protocol.OperationResponse{Error: protocol.NewAbortedError(fmt.Sprintf("operation %s was finalized with a different result", request.TransactionID))}
+		}
+		// Finalized again by a retry, the writes were applied the first time
+		return &protocol.OperationResponse{}
+	}
+	if !ok {
+		entry = RecordEntry{
+			ID:        request.TransactionID,
+			ClientID:  request.ClientID,
+			ViewID:    p.currentView().currentViewID,
+			Mode:      request.Mode,
+			Operation: request.Finalize,
+		}
+	}
+	if request.Result != nil {
+		entry.ReadValues = request.Result.ReadValues
+		entry.ScanResults = request.Result.ScanResults
+		entry.Error = request.Result.Error
+	} else if !ok {
+		// Without a result or a propose the outcome is unknown, so wait for a view change to decide it
+		return &protocol.OperationResponse{Error: protocol.NewRetryError(fmt.Sprintf("operation %s is not in the record", request.TransactionID))}
+	}
+	entry.State = Finalized
+	if err := p.db.AddRecord(entry); err != nil {
+		logrus.Errorf("Error finalizing operation %s: %v", request.TransactionID, err)
+		return &protocol.OperationResponse{Error: protocol.NewRetryError(err.Error())}
+	}
+	delete(p.prepared, request.TransactionID)
+	if entry.Error == nil {
+		p.commitOperation(entry)
+	}
+	return &protocol.OperationResponse{}
+}
+
+// commitOperation applies the writes of a finalized consensus operation that succeeded. The replicas that decided the
+// result validated its compares, so if they don't match here this replica missed an operation committed before it,
+// and the writes are held back until that operation is applied.
+func (p *InconsistentReplicationProtocol) commitOperation(entry RecordEntry) {
+	p.unapplied[entry.ID] = entry.Operation
+	for progress := true; progress; {
+		progress = false
+		for _, id := range p.unapplied.ids() {
+			applied, err := p.applyOperation(id)
+			if err != nil {
+				logrus.Warnf("Error applying operation %s: %v", id, err)
+				continue
+			}
+			if applied {
+				delete(p.unapplied, id)
+				progress = true
+			}
+		}
+	}
+	if len(p.unapplied) > 0 {
+		logrus.Debugf("Operations waiting for an earlier operation to be applied: %v", p.unapplied.ids())
+	}
+}
+
+// applyOperation applies the writes of an operation in the record if its compares match the committed data, and marks
+// it as applied. It returns false if the compares don't match yet.
+func (p *InconsistentReplicationProtocol) applyOperation(id string) (bool, error) {
+	entry, ok, err := p.db.LookupRecord(id)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, fmt.Errorf("operation %s is not in the record", id)
+	}
+	if entry.Applied {
+		return true, nil
+	}
+	op := entry.Operation
+	tx_ref, err := p.db.StartTransaction(entry.ClientID, entry.ID)
+	if err != nil {
+		return false, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			if err := p.db.RollbackTransaction(tx_ref); err != nil {
+				logrus.Warnf("Error rolling back transaction %+v: %v", tx_ref, err)
+			}
+		}
+	}()
+	if matched, err := p.compare(tx_ref, op); err != nil || !matched {
+		return false, err
+	}
+	for key, putc := range op.WriteCSet {
+		if putc.Delete {
+			err = p.db.Delete(tx_ref, []byte(key))
+		} else {
+			err = p.db.Put(tx_ref, []byte(key), []byte(putc.Proposed))
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	for key, value := range op.WriteSet {
+		if err := p.db.Put(tx_ref, []byte(key), []byte(value)); err != nil {
+			return false, err
+		}
+	}
+	for _, key := range op.DeleteSet {
+		if err := p.db.Delete(tx_ref, []byte(key)); err != nil {
+			return false, err
+		}
+	}
+	committed = true
+	err = p.db.CommitTransaction(tx_ref)
+	if errors.Is(err, ErrConflict) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	entry.Applied = true
+	return true, p.db.AddRecord(entry)
+}
+
+// compare is true if the committed values match the values the operation compares. The reads are validated again
+// when the transaction commits.
+func (p *InconsistentReplicationProtocol) compare(tx_ref ClientTxRef, op *protocol.Operation) (bool, error) {
+	for _, read := range op.RangeCSet {
+		values, err := p.db.Scan(tx_ref, []byte(read.Range.Start), []byte(read.Range.End), read.Range.Limit)
+		if err != nil {
+			return false, err
+		}
+		if !SameKeyValues(values, read.Values) {
+			return false, nil
+		}
+	}
+	for key, previous := range op.ReadCSet {
+		value, err := p.db.Get(tx_ref, []byte(key))
+		if err != nil {
+			return false, err
+		}
+		if string(value) != previous {
+			return false, nil
+		}
+	}
+	for key, putc := range op.WriteCSet {
+		value, err := p.db.Get(tx_ref, []byte(key))
+		if err != nil {
+			return false, err
+		}
+		if string(value) != putc.Previous {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// executeOperation reads the values of the operation from the storage engine and validates its compares: conditional
+// writes and scanned ranges must be unchanged for the operation to commit. The writes are not applied.
+func (p *InconsistentReplicationProtocol) executeOperation(clientID string, transactionID string, op *protocol.Operation) *protocol.OperationResponse {
+	failed := func(err *protocol.ReplicaError) *protocol.OperationResponse {
+		return &protocol.OperationResponse{Error: err}
+	}
+	tx_ref, err := p.db.StartTransaction(clientID, transactionID)
+	if err != nil {
+		return failed(protocol.NewRetryError(err.Error()))
+	}
+	defer func() {
+		if err := p.db.RollbackTransaction(tx_ref); err != nil {
+			logrus.Warnf("Error rolling back transaction %+v: %v", tx_ref, err)
+		}
+	}()
+	readValues := make(map[string]string, len(op.ReadSet))
+	for _, key := range op.ReadSet {
+		value, err := p.db.Get(tx_ref, []byte(key))
+		if err != nil {
+			return failed(protocol.NewRetryError(err.Error()))
+		}
+		readValues[key] = string(value)
+	}
+	var scanResults []protocol.RangeRead
+	for _, r := range op.ScanSet {
+		values, err := p.db.Scan(tx_ref, []byte(r.Start), []byte(r.End), r.Limit)
+		if err != nil {
+			return failed(protocol.NewRetryError(err.Error()))
+		}
+		scanResults = append(scanResults, protocol.RangeRead{Range: r, Values: values})
+	}
+	for _, read := range op.RangeCSet {
+		values, err := p.db.Scan(tx_ref, []byte(read.Range.Start), []byte(read.Range.End), read.Range.Limit)
+		if err != nil {
+			return failed(protocol.NewRetryError(err.Error()))
+		}
+		if !SameKeyValues(values, read.Values) {
+			return failed(protocol.NewAbortedError(fmt.Sprintf("range [%s, %s) was changed by another transaction", read.Range.Start, read.Range.End)))
+		}
+	}
+	for key, previous := range op.ReadCSet {
+		value, err := p.db.Get(tx_ref, []byte(key))
+		if err != nil {
+			return failed(protocol.NewRetryError(err.Error()))
+		}
+		if string(value) != previous {
+			return failed(protocol.NewAbortedError(fmt.Sprintf("key %s was changed by another transaction", key)))
+		}
+	}
+	for key, putc := range op.WriteCSet {
+		value, err := p.db.Get(tx_ref, []byte(key))
+		if err != nil {
+			return failed(protocol.NewRetryError(err.Error()))
+		}
+		if string(value) != putc.Previous {
+			return failed(protocol.NewAbortedError(fmt.Sprintf("key %s was changed by another transaction", key)))
+		}
+	}
+	return &protocol.OperationResponse{ReadValues: readValues, ScanResults: scanResults}
+}
+
+// beginOperation returns false if the replica is shutting down or repairing, otherwise endOperation must be called once processed
+func (p *InconsistentReplicationProtocol) beginOperation() bool {
+	p.drainMx.Lock()
+	defer p.drainMx.Unlock()
+	if p.draining || p.repairing {
+		return false
+	}
+	p.inflight.Add(1)
+	return true
+}
+
+func (p *InconsistentReplicationProtocol) endOperation() {
+	p.inflight.Done()
+}
+
+// drain rejects new operations and waits for in-flight operations to finish, or the context to be done
+func (p *InconsistentReplicationProtocol) drain(ctx context.Context) error {
+	p.drainMx.Lock()
+	p.draining = true
+	p.drainMx.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("in-flight operations did not finish: %w", ctx.Err())
+	}
+}
+
+// leave notifies the peers that this replica is leaving, then closes the connections to them
+func (p *InconsistentReplicationProtocol) leave() {
+	for _, peer := range p.peerConnections() {
+		err := peer.SendUntracked(&protocol.AnyMessage{
+			RequestID: uuid.New().String(),
+			Leave:     &protocol.LeaveNotification{ID: p.self},
+		})
+		if err != nil {
+			logrus.Warnf("Error notifying peer '%s' that we are leaving: %v", peer.RemoteAddr(), err)
+		}
+		peer.Close()
+	}
+}
+
+func (p *InconsistentReplicationProtocol) peerInit(ctx context.Context, peer *protocol.ConnHandler) {
+	view := p.currentView()
+	resp, err := peer.SendRequest(&protocol.AnyMessage{
+		RequestID: uuid.New().String(),
+		Hello:     protocol.NewHelloMessageFromServer(p.self, view.members, view.currentViewID, view.leader),
+	})
+	if err != nil {
+		logrus.Warnf("Error sending hello message to peer '%+v': %v", peer.RemoteAddr().String(), err)
+		peer.Close()
+		return
+	}
+	if resp.HelloResponse == nil {
+		logrus.Warnf("Received unexpected hello response from peer '%+v': %+v", peer.RemoteAddr().String(), resp)
+		peer.Close()
+		return
+	}
+	if resp.HelloResponse.ViewID > p.currentView().currentViewID {
+		p.catchupToView(resp.HelloResponse.ViewID, peer)
+	}
+}
+
+// observeViewID is called when a client notifies us that other replicas are in a newer view
+func (p *InconsistentReplicationProtocol) observeViewID(viewID int) {
+	if viewID > p.currentView().currentViewID {
+		// Any peer in the view has its master record, fetching it would block the client's connection
+		go p.catchupToView(viewID)
+	}
+}
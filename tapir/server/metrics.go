@@ -0,0 +1,133 @@
+package server
+
+import (
+	"github.com/phughk/go-dist-algos/tapir/metrics"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"go.etcd.io/bbolt"
+)
+
+// replicaMetrics are recorded as the replica runs, values kept elsewhere are read when the metrics are written
+type replicaMetrics struct {
+	registry           *metrics.Registry
+	operations         *metrics.CounterVec
+	operationDuration  *metrics.HistogramVec
+	finalized          *metrics.CounterVec
+	viewChanges        *metrics.CounterVec
+	viewChangeDuration *metrics.HistogramVec
+	peerRTT            *metrics.HistogramVec
+}
+
+func newReplicaMetrics(p *InconsistentReplicationProtocol) *replicaMetrics {
+	registry := metrics.NewRegistry()
+	m := &replicaMetrics{
+		registry: registry,
+		operations: registry.Counter("tapir_operations_total",
+			"Operations proposed by clients, by mode and outcome", "mode", "outcome"),
+		operationDuration: registry.Histogram("tapir_operation_duration_seconds",
+			"Time to execute proposed operations and add them to the record", metrics.DefaultBuckets, "mode"),
+		finalized: registry.Counter("tapir_consensus_finalized_total",
+			"Consensus operations finalized by clients, by whether a fast quorum or a majority decided the result", "path"),
+		viewChanges: registry.Counter("tapir_view_changes_total",
+			"View changes this replica proposed, by outcome", "outcome"),
+		viewChangeDuration: registry.Histogram("tapir_view_change_duration_seconds",
+			"Time for the peers to respond to view changes this replica proposed", metrics.DefaultBuckets),
+		peerRTT: registry.Histogram("tapir_peer_rtt_seconds",
+			"Round trip time of pings to peers, measured by the replica that accepted the connection of the peer", metrics.DefaultBuckets, "peer"),
+	}
+	registry.Collect("tapir_view_id", "Current view of the replica", metrics.KindGauge, nil,
+		func(emit func(float64, ...string)) {
+			emit(float64(p.currentView().currentViewID))
+		})
+	registry.Collect("tapir_completed_view_id", "Last view this replica completed a view change to", metrics.KindGauge, nil,
+		func(emit func(float64, ...string)) {
+			emit(float64(p.lastCompletedViewID()))
+		})
+	registry.Collect("tapir_peers", "Peers connected to the replica", metrics.KindGauge, nil,
+		func(emit func(float64, ...string)) {
+			p.mx.RLock()
+			defer p.mx.RUnlock()
+			emit(float64(len(p.peers)))
+		})
+	registry.Collect("tapir_dropped_messages_total", "Messages dropped by the test properties, by reason", metrics.KindCounter, []string{"reason"},
+		func(emit func(float64, ...string)) {
+			for _, reason := range DropReasons() {
+				emit(float64(p.tp.Dropped(reason)), reason.String())
+			}
+		})
+	if bolt, ok := p.db.(*BoltStorageEngine); ok {
+		registerBoltMetrics(registry, bolt)
+	}
+	return m
+}
+
+// registerBoltMetrics of the bbolt database, the totals are since the database was opened
+func registerBoltMetrics(registry *metrics.Registry, bolt *BoltStorageEngine) {
+	boltMetrics := []struct {
+		name  string
+		help  string
+		kind  metrics.Kind
+		value func(stats *bbolt.Stats) float64
+	}{
+		{"tapir_bbolt_read_transactions_total", "Read transactions started", metrics.KindCounter,
+			func(stats *bbolt.Stats) float64 { return float64(stats.TxN) }},
+		{"tapir_bbolt_open_read_transactions", "Read transactions currently open", metrics.KindGauge,
+			func(stats *bbolt.Stats) float64 { return float64(stats.OpenTxN) }},
+		{"tapir_bbolt_free_pages", "Pages on the freelist", metrics.KindGauge,
+			func(stats *bbolt.Stats) float64 { return float64(stats.FreePageN) }},
+		{"tapir_bbolt_pending_pages", "Pages freed by transactions that readers may still use", metrics.KindGauge,
+			func(stats *bbolt.Stats) float64 { return float64(stats.PendingPageN) }},
+		{"tapir_bbolt_free_bytes", "Bytes allocated in free pages", metrics.KindGauge,
+			func(stats *bbolt.Stats) float64 { return float64(stats.FreeAlloc) }},
+		{"tapir_bbolt_freelist_bytes", "Bytes used by the freelist", metrics.KindGauge,
+			func(stats *bbolt.Stats) float64 { return float64(stats.FreelistInuse) }},
+		{"tapir_bbolt_page_allocations_total", "Page allocations", metrics.KindCounter,
+			func(stats *bbolt.Stats) float64 { return float64(stats.TxStats.GetPageCount()) }},
+		{"tapir_bbolt_page_allocated_bytes_total", "Bytes of pages allocated", metrics.KindCounter,
+			func(stats *bbolt.Stats) float64 { return float64(stats.TxStats.GetPageAlloc()) }},
+		{"tapir_bbolt_rebalances_total", "Node rebalances", metrics.KindCounter,
+			func(stats *bbolt.Stats) float64 { return float64(stats.TxStats.GetRebalance()) }},
+		{"tapir_bbolt_rebalance_seconds_total", "Time spent rebalancing nodes", metrics.KindCounter,
+			func(stats *bbolt.Stats) float64 { return stats.TxStats.GetRebalanceTime().Seconds() }},
+		{"tapir_bbolt_splits_total", "Nodes split", metrics.KindCounter,
+			func(stats *bbolt.Stats) float64 { return float64(stats.TxStats.GetSplit()) }},
+		{"tapir_bbolt_spills_total", "Nodes spilled", metrics.KindCounter,
+			func(stats *bbolt.Stats) float64 { return float64(stats.TxStats.GetSpill()) }},
+		{"tapir_bbolt_spill_seconds_total", "Time spent spilling nodes", metrics.KindCounter,
+			func(stats *bbolt.Stats) float64 { return stats.TxStats.GetSpillTime().Seconds() }},
+		{"tapir_bbolt_writes_total", "Writes to disk", metrics.KindCounter,
+			func(stats *bbolt.Stats) float64 { return float64(stats.TxStats.GetWrite()) }},
+		{"tapir_bbolt_write_seconds_total", "Time spent writing to disk", metrics.KindCounter,
+			func(stats *bbolt.Stats) float64 { return stats.TxStats.GetWriteTime().Seconds() }},
+	}
+	for _, m := range boltMetrics {
+		registry.Collect(m.name, m.help, m.kind, nil, func(emit func(float64, ...string)) {
+			stats := bolt.Stats()
+			emit(m.value(&stats))
+		})
+	}
+}
+
+// operationOutcome is the label of the outcome of an operation with the error
+func operationOutcome(err *protocol.ReplicaError) string {
+	if err == nil {
+		return "ok"
+	}
+	switch err.Code {
+	case protocol.ErrorCodeAborted:
+		return "aborted"
+	case protocol.ErrorCodeRetry:
+		return "retry"
+	case protocol.ErrorCodeClusterTooSmall:
+		return "cluster_too_small"
+	default:
+		return "error"
+	}
+}
+
+// finalizedPath is the label of how the consensus result of a finalized operation was decided
+func finalizedPath(slowPath bool) string {
+	if slowPath {
+		return "slow"
+	}
+	return "fast"
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+// PeerConnection Peer connection handles inbound unclassified requests
+// During the lifecycle we need to determine if it is a client or a server
+type PeerConnection struct {
+	ctx      context.Context
+	ch       *protocol.ConnHandler
+	server   bool
+	memberID string
+	ir       *InconsistentReplicationProtocol
+}
+
+func newPeerConnection(ctx context.Context, conn net.Conn, ir *InconsistentReplicationProtocol) *PeerConnection {
+	pc := &PeerConnection{
+		ctx:    ctx,
+		ch:     nil,
+		server: false,
+		ir:     ir,
+	}
+	// We use a no-op shutdown hook because we don't know if its a client or peer node
+	// When we discover its a peer we change the shutdown hook
+	shutdownHook := func() {}
+	pc.ch = protocol.NewConnHandlerWithClock(ctx, conn, ir.tp.clock, pc.handleClient, shutdownHook)
+	// Until the connection turns out to be from a peer, it gets the faults of clients
+	pc.ch.SetFilter(func(outbound bool) []time.Duration {
+		return ir.tp.deliveries(ir.self, "", outbound)
+	})
+	return pc
+}
+
+// Since we cannot differentiate between client and server, this code handles p2p server upgrade and client comms in one
+func (pc *PeerConnection) handleClient(ch *protocol.ConnHandler, m *protocol.AnyMessage) {
+	if pc.ir.tp.DecDropClient() {
+		return
+	}
+	if m.Ping != 0 {
+		if pc.ir.tp.DecDropPing() {
+			return
+		}
+		logrus.Tracef("Client received ping: %+v\n", m)
+		err := ch.SendUntracked(&protocol.AnyMessage{RequestID: m.RequestID, Pong: m.Ping})
+		if err != nil {
+			logrus.Warnf("Error sending pong: %v", err)
+		}
+	} else if m.Pong != 0 {
+		// This shouldn't happen because ping is synchronous...?
+		logrus.Warnf("Received unhandled pong but that is a synchronous request")
+	} else if m.Hello != nil {
+		if m.Hello.Type == protocol.ClientTypeServer {
+			pc.server = true
+			pc.memberID = m.Hello.ID
+			pc.ir.AddPeer(m.Hello.ID, ch, m.Hello.ViewID)
+			ch.SetShutdownHook(func() {
+				// We need the service address
+				pc.ir.removePeerConn(pc.memberID, ch)
+			})
+			// Upgrade protocol to server comms
+			ch.SetHandler(func(ch *protocol.ConnHandler, m *protocol.AnyMessage) {
+				pc.ir.handleMessage(pc.memberID, ch, m)
+			})
+			// Now invoke the hello inbound path of the server handler to respond to hello
+			ch.HandleRequest(m)
+		}
+	} else if m.OperationRequest != nil {
+		started := pc.ir.tp.clock.Now()
+		view := pc.ir.currentView()
+		response := &protocol.OperationResponse{ViewID: view.currentViewID}
+		if !pc.ir.beginOperation() {
+			response.Error = protocol.NewRetryError("replica is shutting down or repairing")
+		} else {
+			defer pc.ir.endOperation()
+			if err := pc.ir.checkClusterSize(len(view.members)); err != nil {
+				logrus.Debugf("Rejecting operation request: %s", err.Error())
+				response.Error = err
+			} else {
+				result := pc.ir.processOperation(m.OperationRequest)
+				response.ViewID = result.ViewID
+				response.ReadValues, response.ScanResults, response.Error = result.ReadValues, result.ScanResults, result.Error
+			}
+		}
+		if m.OperationRequest.Propose != nil {
+			mode := strings.ToLower(m.OperationRequest.Mode.String())
+			pc.ir.metrics.operations.With(mode, operationOutcome(response.Error)).Inc()
+			pc.ir.metrics.operationDuration.With(mode).ObserveDuration(pc.ir.tp.clock.Now().Sub(started))
+		}
+		err := ch.SendUntracked(&protocol.AnyMessage{RequestID: m.RequestID, OperationResponse: response})
+		if err != nil {
+			logrus.Warnf("Error sending response: %v", err)
+		}
+	} else if m.SnapshotRequest != nil {
+		go pc.ir.serveSnapshotRequest(ch, m)
+	} else if m.DigestRequest != nil {
+		pc.ir.serveDigestRequest(ch, m)
+	} else if m.RepairRequest != nil {
+		go pc.ir.serveRepairRequest(ch, m)
+	} else if m.ViewNotification != nil {
+		pc.ir.observeViewID(m.ViewNotification.ViewID)
+	} else {
+		logrus.Errorf("Server unhandled request: %+v", m)
+	}
+}
+
+func (pc *PeerConnection) blockingPingLoop() {
+	for !pc.ch.Terminated() {
+		sent := pc.ir.tp.clock.Now()
+		resp, err := pc.ch.SendRequest(&protocol.AnyMessage{RequestID: uuid.New().String(), Ping: 1})
+		if err != nil {
+			logrus.Warnf("Error sending ping: %+v", err)
+			pc.ch.Close()
+			break
+		} else {
+			logrus.Tracef("Ping response: %+v", resp)
+			if peer, ok := pc.ir.peerOf(pc.ch); ok {
+				pc.ir.metrics.peerRTT.With(peer).ObserveDuration(pc.ir.tp.clock.Now().Sub(sent))
+			}
+		}
+		<-pc.ir.tp.clock.After(1 * time.Second)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"github.com/sirupsen/logrus"
+	"sort"
+)
+
+// preparedOperations are consensus operations by transaction ID. A replica aborts operations that conflict with the
+// operations it prepared, so that the writes of the operations it commits don't depend on each other's outcome.
+type preparedOperations map[string]*protocol.Operation
+
+// conflicting returns the ID of an operation that conflicts with op
+func (p preparedOperations) conflicting(op *protocol.Operation) (string, bool) {
+	for _, id := range p.ids() {
+		if operationsConflict(op, p[id]) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// ids in order, so that conflicts and operations are applied deterministically
+func (p preparedOperations) ids() []string {
+	ids := make([]string, 0, len(p))
+	for id := range p {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// operationsConflict is true if one operation writes a key the other writes or compares, or a key in a range the other
+// compares
+func operationsConflict(a *protocol.Operation, b *protocol.Operation) bool {
+	return writesConflict(a, b) || writesConflict(b, a)
+}
+
+// writesConflict is true if a writes a key that b writes or compares
+func writesConflict(a *protocol.Operation, b *protocol.Operation) bool {
+	compared := comparedKeys(b)
+	written := writtenKeys(b)
+	for key := range writtenKeys(a) {
+		if compared[key] || written[key] {
+			return true
+		}
+		for _, read := range b.RangeCSet {
+			if read.Range.Contains(key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writtenKeys are the keys the operation writes or deletes
+func writtenKeys(op *protocol.Operation) map[string]bool {
+	keys := make(map[string]bool, len(op.WriteCSet)+len(op.WriteSet)+len(op.DeleteSet))
+	for key := range op.WriteCSet {
+		keys[key] = true
+	}
+	for key := range op.WriteSet {
+		keys[key] = true
+	}
+	for _, key := range op.DeleteSet {
+		keys[key] = true
+	}
+	return keys
+}
+
+// comparedKeys are the keys whose values must be unchanged for the operation to commit
+func comparedKeys(op *protocol.Operation) map[string]bool {
+	keys := make(map[string]bool, len(op.ReadCSet)+len(op.WriteCSet))
+	for key := range op.ReadCSet {
+		keys[key] = true
+	}
+	for key := range op.WriteCSet {
+		keys[key] = true
+	}
+	return keys
+}
+
+// loadPrepared restores the prepared operations from the record, and applies the committed operations that were not
+// applied before the replica stopped
+func (p *InconsistentReplicationProtocol) loadPrepared() {
+	p.operationMx.Lock()
+	defer p.operationMx.Unlock()
+	record, err := p.db.Record()
+	if err != nil {
+		logrus.Errorf("Error reading the record for prepared operations: %v", err)
+		return
+	}
+	var committed []RecordEntry
+	for _, entry := range record {
+		if entry.Mode != protocol.Consensus || entry.Error != nil {
+			continue
+		}
+		if entry.State == Tentative {
+			p.prepared[entry.ID] = entry.Operation
+		} else if !entry.Applied {
+			committed = append(committed, entry)
+		}
+	}
+	for _, entry := range committed {
+		p.commitOperation(entry)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// serveDigestRequest responds with the digests of the requested ranges
+func (p *InconsistentReplicationProtocol) serveDigestRequest(ch *protocol.ConnHandler, m *protocol.AnyMessage) {
+	response := &protocol.DigestResponse{}
+	digests, err := p.db.Digest(m.DigestRequest.Ranges)
+	if err != nil {
+		response.Error = protocol.NewRetryError(err.Error())
+	} else {
+		response.Digests = digests
+	}
+	err = ch.SendUntracked(&protocol.AnyMessage{RequestID: m.RequestID, DigestResponse: response})
+	if err != nil {
+		logrus.Warnf("Error sending digest response: %v", err)
+	}
+}
+
+// serveRepairRequest replaces the data and master record with a snapshot of a peer, rejecting operations meanwhile
+func (p *InconsistentReplicationProtocol) serveRepairRequest(ch *protocol.ConnHandler, m *protocol.AnyMessage) {
+	response := &protocol.RepairResponse{}
+	if err := p.repair(m.RepairRequest.From); err != nil {
+		logrus.Warnf("Error repairing from %s: %v", m.RepairRequest.From, err)
+		response.Error = protocol.NewRetryError(err.Error())
+	}
+	err := ch.SendUntracked(&protocol.AnyMessage{RequestID: m.RequestID, RepairResponse: response})
+	if err != nil {
+		logrus.Warnf("Error sending repair response: %v", err)
+	}
+}
+
+func (p *InconsistentReplicationProtocol) repair(from string) error {
+	p.mx.RLock()
+	peer, ok := p.peers[from]
+	p.mx.RUnlock()
+	if !ok {
+		return fmt.Errorf("not connected to peer %s", from)
+	}
+	p.drainMx.Lock()
+	if p.draining || p.repairing {
+		p.drainMx.Unlock()
+		return fmt.Errorf("replica is shutting down or already repairing")
+	}
+	p.repairing = true
+	p.drainMx.Unlock()
+	defer func() {
+		p.drainMx.Lock()
+		p.repairing = false
+		p.drainMx.Unlock()
+	}()
+	// Snapshots can't be restored while operations have transactions in progress
+	done := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-p.tp.clock.After(p.tp.GetTimeout()):
+		return fmt.Errorf("in-flight operations did not finish")
+	}
+	logrus.Infof("Repairing from a snapshot of %s", from)
+	return p.fetchSnapshot(peer.conn)
+}
@@ -0,0 +1,340 @@
+// Package server runs a TAPIR replica that can be embedded in other processes
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/metrics"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"github.com/sirupsen/logrus"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTimeout is used when the Config does not set a Timeout
+	DefaultTimeout = 5 * time.Second
+	// DefaultViewChangePeriod is used when the Config does not set a ViewChangePeriod
+	DefaultViewChangePeriod = 1 * time.Second
+	// DefaultShutdownTimeout is how long Stop waits for in-flight operations to finish
+	DefaultShutdownTimeout = 10 * time.Second
+	// DefaultCompactionPeriod is used when the Config does not set a CompactionPeriod
+	DefaultCompactionPeriod = 1 * time.Minute
+)
+
+// Config of a replica
+type Config struct {
+	// ListenAddress to accept connections on, for example ":7000"; port 0 picks a free port
+	ListenAddress string
+	// Members are the addresses of the bootstrap cluster members, which may include this replica
+	Members []string
+	// StoragePath is the filepath of the bbolt database
+	StoragePath string
+	// Storage if set is used instead of opening a bbolt database at StoragePath
+	Storage StorageEngine
+	// MinClusterSize below this size operations will be rejected even if there is quorum, 0 disables the check
+	MinClusterSize int
+	// Timeout after which a peer that hasn't sent a message is considered dead
+	Timeout time.Duration
+	// ViewChangePeriod is the minimum time between view changes
+	ViewChangePeriod time.Duration
+	// Bootstrap replaces the data and master record with a snapshot from a peer before accepting connections,
+	// for a replica joining an existing cluster or recovering
+	Bootstrap bool
+	// CompactionPeriod is how often the IR record is truncated and tombstones of deleted keys are collected
+	CompactionPeriod time.Duration
+	// Network to listen and connect to peers on, TCP if nil
+	Network protocol.Network
+	// Clock for timeouts and view changes, wall-clock time if nil
+	Clock protocol.Clock
+}
+
+// Server is a replica accepting connections from clients and peers
+type Server struct {
+	config   Config
+	db       StorageEngine
+	listener net.Listener
+	tp       *TestProperties
+	ir       *InconsistentReplicationProtocol
+	// compactor runs in the background until compactorDone is closed
+	compactor     *Compactor
+	compactorDone chan struct{}
+	cancel        context.CancelFunc
+	// done is closed when the accept loop has stopped, after which acceptErr is set
+	done      chan struct{}
+	acceptErr error
+	stopOnce  sync.Once
+	stopErr   error
+	// conns are the inbound connections from clients and peers
+	conns   map[*protocol.ConnHandler]struct{}
+	connsMx sync.Mutex
+}
+
+func New(config Config) *Server {
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.ViewChangePeriod == 0 {
+		config.ViewChangePeriod = DefaultViewChangePeriod
+	}
+	if config.CompactionPeriod == 0 {
+		config.CompactionPeriod = DefaultCompactionPeriod
+	}
+	if config.Network == nil {
+		config.Network = protocol.TCPNetwork{}
+	}
+	if config.Clock == nil {
+		config.Clock = protocol.RealClock{}
+	}
+	// The replica owns its membership, so don't share it with the caller or other replicas
+	config.Members = append([]string(nil), config.Members...)
+	return &Server{
+		config: config,
+		done:   make(chan struct{}),
+		conns:  make(map[*protocol.ConnHandler]struct{}),
+	}
+}
+
+// Start opens the storage, starts listening and joins the cluster. It returns once the replica is accepting connections.
+func (s *Server) Start(ctx context.Context) error {
+	logrus.Debugf("Running server...")
+	db := s.config.Storage
+	if db == nil {
+		bolt, err := NewStorageEngine(s.config.StoragePath)
+		if err != nil {
+			return err
+		}
+		db = bolt
+	}
+	listener, err := s.config.Network.Listen(s.config.ListenAddress)
+	if err != nil {
+		return errors.Join(err, db.Close())
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	host := normaliseIp(listener.Addr().(*net.TCPAddr).IP)
+	ctx, cancel := context.WithCancel(ctx)
+	s.db = db
+	s.listener = listener
+	s.cancel = cancel
+	s.tp = &TestProperties{
+		timeout:          s.config.Timeout,
+		viewChangePeriod: s.config.ViewChangePeriod,
+		clock:            s.config.Clock,
+		network:          s.config.Network,
+		// Seeded from the clock, so that a simulation injects the same faults every run
+		rand: rand.New(rand.NewSource(s.config.Clock.Now().UnixNano())),
+	}
+	s.ir = NewInconsistentReplicationProtocol(ctx, fmt.Sprintf("%s:%d", host, port), s.config.Members, s.config.MinClusterSize, db, s.tp)
+	if s.config.Bootstrap {
+		if err := s.ir.transferState(ctx); err != nil {
+			cancel()
+			s.listener = nil
+			return errors.Join(err, listener.Close(), db.Close())
+		}
+	}
+	logrus.Infof("Listening on port: %d", port)
+	s.compactor = NewCompactor(db, s.config.Clock, s.config.CompactionPeriod)
+	s.compactorDone = make(chan struct{})
+	go func() {
+		defer close(s.compactorDone)
+		s.compactor.Run(ctx)
+	}()
+	go s.acceptLoop(ctx)
+	return nil
+}
+
+func (s *Server) acceptLoop(ctx context.Context) {
+	defer close(s.done)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				s.acceptErr = err
+			}
+			return
+		}
+		go s.serveConnectionInbound(ctx, conn)
+	}
+}
+
+// Wait blocks until the server stops accepting connections, returning the error that stopped it if it wasn't Stop
+func (s *Server) Wait() error {
+	<-s.done
+	return s.acceptErr
+}
+
+// Stop shuts the server down, waiting up to DefaultShutdownTimeout for in-flight operations
+func (s *Server) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err != nil {
+		logrus.Warnf("Error shutting down: %v", err)
+	}
+}
+
+// Shutdown stops accepting connections, waits for in-flight operations to finish until the context is done,
+// notifies the peers that this replica is leaving, then closes all connections and the storage.
+// Calling Shutdown again returns the result of the first call.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopOnce.Do(func() {
+		if s.listener == nil {
+			// Never started
+			return
+		}
+		logrus.Infof("Shutting down replica %s", s.ir.self)
+		var errs []error
+		if err := s.listener.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error closing listener: %w", err))
+		}
+		<-s.done
+		if err := s.ir.drain(ctx); err != nil {
+			errs = append(errs, err)
+		}
+		s.ir.leave()
+		s.cancel()
+		<-s.compactorDone
+		s.connsMx.Lock()
+		for ch := range s.conns {
+			ch.Close()
+		}
+		s.connsMx.Unlock()
+		if err := s.db.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		s.stopErr = errors.Join(errs...)
+	})
+	return s.stopErr
+}
+
+// Addr is the address of this replica used for membership
+func (s *Server) Addr() string {
+	return s.ir.self
+}
+
+// Compact truncates the IR record and collects tombstones now instead of waiting for the next compaction
+func (s *Server) Compact() (Compaction, error) {
+	return s.compactor.Compact()
+}
+
+// CompactorStats are the totals of all compactions since the replica started
+func (s *Server) CompactorStats() CompactorStats {
+	return s.compactor.Stats()
+}
+
+// Metrics of the replica, to be served for Prometheus to scrape
+func (s *Server) Metrics() *metrics.Registry {
+	return s.ir.metrics.registry
+}
+
+// TestProperties control artificial failures of this replica
+func (s *Server) TestProperties() *TestProperties {
+	return s.tp
+}
+
+func normaliseIp(ip net.IP) string {
+	if ip.IsLoopback() || ip.IsMulticast() || ip.IsUnspecified() {
+		// We need to do this because binding to `:0` etc causes multi-host bind, but we need a specific address for membership identity
+		return "127.0.0.1"
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[0], v4[1], v4[2], v4[3])
+	}
+	panic(fmt.Sprintf("Invalid IPv6 address: %s", ip))
+}
+
+func (s *Server) serveConnectionInbound(ctx context.Context, conn net.Conn) {
+	logrus.Debugf("New connection from: %s", conn.RemoteAddr())
+	pc := newPeerConnection(ctx, conn, s.ir)
+	s.connsMx.Lock()
+	s.conns[pc.ch] = struct{}{}
+	s.connsMx.Unlock()
+	defer func() {
+		logrus.Debugf("Connection closed: %s", conn.RemoteAddr())
+		s.connsMx.Lock()
+		delete(s.conns, pc.ch)
+		s.connsMx.Unlock()
+		pc.ch.Close()
+	}()
+	pc.blockingPingLoop()
+}
+
+// Status is a snapshot of the state of the replica
+type Status struct {
+	Self string
+	View View
+	// CompletedViewID is the last view whose view change completed
+	CompletedViewID int
+	MinClusterSize  int
+	// ClusterSizeError is set while operations are rejected because the view is below the minimum cluster size
+	ClusterSizeError error
+}
+
+func (s *Server) Status() Status {
+	status := Status{
+		Self:            s.ir.self,
+		View:            s.ir.currentView(),
+		CompletedViewID: s.ir.lastCompletedViewID(),
+		MinClusterSize:  s.ir.minClusterSize,
+	}
+	if err := s.ir.checkClusterSize(len(status.View.members)); err != nil {
+		status.ClusterSizeError = err
+	}
+	return status
+}
+
+// Ready returns nil if the replica can take part in operations: its view is in the NORMAL state and it is connected to
+// a quorum of the members of the view. Otherwise it returns why it isn't ready.
+func (s *Server) Ready() error {
+	status := s.Status()
+	if changing := status.View.ViewState.Changing; changing != nil {
+		return fmt.Errorf("changing from view %d to view %d", changing.FromViewID, changing.ToViewID)
+	}
+	if recovery := status.View.ViewState.Recovery; recovery != nil {
+		return fmt.Errorf("recovering from view %d to view %d", recovery.FromViewID, recovery.ToViewID)
+	}
+	if status.ClusterSizeError != nil {
+		return status.ClusterSizeError
+	}
+	members := status.View.Members()
+	deadline := s.config.Clock.Now().Add(-s.tp.GetTimeout())
+	live := 0
+	for _, member := range members {
+		if member == status.Self {
+			live++
+		}
+	}
+	for _, peer := range s.Peers() {
+		if containsPeer(members, peer.Member) && peer.LastMessageTime.After(deadline) {
+			live++
+		}
+	}
+	if !protocol.MajorityQuorum(live, len(members)) {
+		return fmt.Errorf("%d of the %d members of view %d are live, which is not a quorum", live, len(members), status.View.ViewID())
+	}
+	return nil
+}
+
+// PeerStatus is a snapshot of a connected peer
+type PeerStatus struct {
+	Member          string
+	LastMessageTime time.Time
+	ViewID          int
+}
+
+func (s *Server) Peers() []PeerStatus {
+	s.ir.mx.RLock()
+	defer s.ir.mx.RUnlock()
+	peers := make([]PeerStatus, 0, len(s.ir.peers))
+	for member, peer := range s.ir.peers {
+		peers = append(peers, PeerStatus{
+			Member:          member,
+			LastMessageTime: peer.conn.LastMessageTime(),
+			ViewID:          peer.ViewID,
+		})
+	}
+	return peers
+}
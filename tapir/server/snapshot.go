@@ -0,0 +1,314 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"github.com/sirupsen/logrus"
+	"strconv"
+)
+
+// errSnapshotAbandoned is returned when the replica receiving a snapshot stops requesting chunks
+var errSnapshotAbandoned = errors.New("snapshot abandoned")
+
+// snapshotSession is a snapshot being sent to another replica. The storage produces chunks into an unbuffered
+// channel, so the snapshot stays consistent until the receiver has requested the last chunk.
+type snapshotSession struct {
+	chunks chan *protocol.SnapshotChunk
+	// err is set before chunks is closed
+	err error
+}
+
+// snapshotSession returns the session of a snapshot being sent, or starts it if this is its first request
+func (p *InconsistentReplicationProtocol) snapshotSession(request *protocol.SnapshotRequest) *snapshotSession {
+	p.snapshotsMx.Lock()
+	defer p.snapshotsMx.Unlock()
+	if session, ok := p.snapshots[request.SnapshotID]; ok {
+		return session
+	}
+	logrus.Infof("Starting snapshot %s", request.SnapshotID)
+	session := &snapshotSession{chunks: make(chan *protocol.SnapshotChunk)}
+	p.snapshots[request.SnapshotID] = session
+	go func() {
+		defer func() {
+			p.snapshotsMx.Lock()
+			delete(p.snapshots, request.SnapshotID)
+			p.snapshotsMx.Unlock()
+			close(session.chunks)
+		}()
+		session.err = p.snapshot(request, func(chunk *protocol.SnapshotChunk) error {
+			select {
+			case session.chunks <- chunk:
+				return nil
+			case <-p.tp.clock.After(p.tp.GetTimeout()):
+				return errSnapshotAbandoned
+			}
+		})
+		if session.err != nil {
+			logrus.Warnf("Error sending snapshot %s: %v", request.SnapshotID, session.err)
+		}
+	}()
+	return session
+}
+
+// snapshot sends the sections of the request, or the client data and the master record if it has none
+func (p *InconsistentReplicationProtocol) snapshot(request *protocol.SnapshotRequest, send func(chunk *protocol.SnapshotChunk) error) error {
+	if len(request.Sections) == 0 {
+		return p.db.Snapshot(request.ChunkSize, send)
+	}
+	chunker := newSnapshotChunker(request.ChunkSize, 0, send)
+	for _, section := range request.Sections {
+		var entries []RecordEntry
+		var err error
+		masterRecordViewID, syncedViewID := 0, 0
+		switch section {
+		case SnapshotSectionRecord:
+			// For a view change, which needs the operations that were truncated as well
+			entries, err = p.mergeableRecord()
+		case SnapshotSectionMasterRecord:
+			masterRecordViewID, entries, err = p.db.MasterRecord()
+			if err == nil {
+				syncedViewID, err = p.db.SyncedViewID()
+			}
+		default:
+			err = fmt.Errorf("unknown snapshot section %s", section)
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			value, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := chunker.add(section, []byte(entry.ID), value); err != nil {
+				return err
+			}
+		}
+		if section == SnapshotSectionMasterRecord {
+			if err := chunker.add(section, MASTER_RECORD_VIEW_KEY, []byte(strconv.Itoa(masterRecordViewID))); err != nil {
+				return err
+			}
+			if err := chunker.add(section, MASTER_RECORD_SYNCED_VIEW_KEY, []byte(strconv.Itoa(syncedViewID))); err != nil {
+				return err
+			}
+		}
+	}
+	return chunker.finish()
+}
+
+// serveSnapshotRequest responds with the next chunk of the snapshot
+func (p *InconsistentReplicationProtocol) serveSnapshotRequest(ch *protocol.ConnHandler, m *protocol.AnyMessage) {
+	session := p.snapshotSession(m.SnapshotRequest)
+	response := &protocol.SnapshotResponse{}
+	select {
+	case chunk, ok := <-session.chunks:
+		if ok {
+			response.Chunk = chunk
+		} else if session.err != nil {
+			response.Error = protocol.NewRetryError(session.err.Error())
+		} else {
+			response.Error = protocol.NewRetryError("snapshot has already been sent")
+		}
+	case <-p.tp.clock.After(p.tp.GetTimeout()):
+		response.Error = protocol.NewRetryError("timeout waiting for snapshot chunk")
+	}
+	err := ch.SendUntracked(&protocol.AnyMessage{RequestID: m.RequestID, SnapshotResponse: response})
+	if err != nil {
+		logrus.Warnf("Error sending snapshot chunk: %v", err)
+	}
+}
+
+// transferState replaces the client data and master record of this replica with a snapshot from a peer, trying
+// each peer until one succeeds, and moves to the view of the master record
+func (p *InconsistentReplicationProtocol) transferState(ctx context.Context) error {
+	peers := p.peerConnections()
+	if len(peers) == 0 {
+		return fmt.Errorf("no peers to transfer state from")
+	}
+	// Catching up would apply a master record to the data being replaced
+	for !p.catchingUp.CompareAndSwap(false, true) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.tp.clock.After(p.tp.GetTimeout() / 10):
+		}
+	}
+	defer p.catchingUp.Store(false)
+	var errs []error
+	for _, peer := range peers {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := p.fetchSnapshot(peer)
+		if err == nil {
+			err = p.adoptTransferredView(peer)
+		}
+		if err == nil {
+			viewID, entries, err := p.db.MasterRecord()
+			if err != nil {
+				return err
+			}
+			logrus.Infof("Transferred state from %s with a master record of %d operations in view %d", peer.RemoteAddr(), len(entries), viewID)
+			return nil
+		}
+		logrus.Warnf("Error transferring state from %s: %v", peer.RemoteAddr(), err)
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("error transferring state from any peer: %w", errors.Join(errs...))
+}
+
+// adoptTransferredView moves to the view of the master record transferred from the peer, with the members the peer has.
+// The transferred data has the writes of the operations in the master record, so they become the record of this
+// replica as applied, and later views are caught up to from the peers.
+func (p *InconsistentReplicationProtocol) adoptTransferredView(peer *protocol.ConnHandler) error {
+	view := p.currentView()
+	resp, err := peer.SendRequest(&protocol.AnyMessage{
+		RequestID: uuid.New().String(),
+		Hello:     protocol.NewHelloMessageFromServer(p.self, view.members, view.currentViewID, view.leader),
+	})
+	if err != nil {
+		return err
+	}
+	hello := resp.HelloResponse
+	if hello == nil {
+		return fmt.Errorf("unexpected response to hello: %+v", resp)
+	}
+	p.operationMx.Lock()
+	defer p.operationMx.Unlock()
+	viewID, master, err := p.db.MasterRecord()
+	if err != nil {
+		return err
+	}
+	for i, entry := range master {
+		master[i].Applied = entry.Mode == protocol.Consensus && entry.Error == nil
+	}
+	if err := p.db.ReplaceRecord(master); err != nil {
+		return err
+	}
+	p.prepared = make(preparedOperations)
+	p.unapplied = make(preparedOperations)
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if viewID < p.view.currentViewID {
+		// Caught up to a later view while the snapshot was transferred
+		return nil
+	}
+	p.promised = max(p.promised, viewID)
+	p.view.currentViewID = viewID
+	p.view.members = hello.Members
+	p.view.leader = hello.Leader
+	p.view.when = p.tp.clock.Now()
+	p.view.ViewState = ViewState{Normal: viewID}
+	return nil
+}
+
+// fetchSnapshot restores a snapshot of the peer, requesting one chunk at a time
+func (p *InconsistentReplicationProtocol) fetchSnapshot(peer *protocol.ConnHandler) error {
+	return p.db.RestoreSnapshot(snapshotReceiver(peer, nil))
+}
+
+// fetchRecord returns the IR record or the master record of the peer, and the view and synced view of the master record
+func fetchRecord(peer *protocol.ConnHandler, section string) (int, int, []RecordEntry, error) {
+	viewID, syncedViewID := 0, 0
+	var entries []RecordEntry
+	err := receiveSnapshot(snapshotReceiver(peer, []string{section}), func(chunk *protocol.SnapshotChunk) error {
+		for _, e := range chunk.Entries {
+			if e.Section != section {
+				return fmt.Errorf("unexpected snapshot section %s", e.Section)
+			}
+			if section == SnapshotSectionMasterRecord && bytes.Equal(e.Key, MASTER_RECORD_VIEW_KEY) {
+				var err error
+				if viewID, err = strconv.Atoi(string(e.Value)); err != nil {
+					return err
+				}
+				continue
+			}
+			if section == SnapshotSectionMasterRecord && bytes.Equal(e.Key, MASTER_RECORD_SYNCED_VIEW_KEY) {
+				var err error
+				if syncedViewID, err = strconv.Atoi(string(e.Value)); err != nil {
+					return err
+				}
+				continue
+			}
+			var entry RecordEntry
+			if err := json.Unmarshal(e.Value, &entry); err != nil {
+				return fmt.Errorf("error reading record entry %s: %w", e.Key, err)
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return viewID, syncedViewID, entries, err
+}
+
+// snapshotReceiver returns the chunks of a new snapshot of the peer, requesting one chunk at a time
+func snapshotReceiver(peer *protocol.ConnHandler, sections []string) func() (*protocol.SnapshotChunk, error) {
+	snapshotID := uuid.New().String()
+	return func() (*protocol.SnapshotChunk, error) {
+		resp, err := peer.SendRequest(&protocol.AnyMessage{
+			RequestID: uuid.New().String(),
+			SnapshotRequest: &protocol.SnapshotRequest{
+				SnapshotID: snapshotID,
+				ChunkSize:  DefaultSnapshotChunkSize,
+				Sections:   sections,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if resp.SnapshotResponse == nil {
+			return nil, fmt.Errorf("unexpected response to snapshot request: %+v", resp)
+		}
+		if resp.SnapshotResponse.Error != nil {
+			return nil, resp.SnapshotResponse.Error
+		}
+		if resp.SnapshotResponse.Chunk == nil {
+			return nil, fmt.Errorf("snapshot response has no chunk")
+		}
+		return resp.SnapshotResponse.Chunk, nil
+	}
+}
+
+// CopySnapshot replaces the client data and master record of dst with a snapshot of src
+func CopySnapshot(src StorageEngine, dst StorageEngine) error {
+	chunks := make(chan *protocol.SnapshotChunk)
+	done := make(chan struct{})
+	srcErr := make(chan error, 1)
+	go func() {
+		defer close(chunks)
+		srcErr <- src.Snapshot(DefaultSnapshotChunkSize, func(chunk *protocol.SnapshotChunk) error {
+			select {
+			case chunks <- chunk:
+				return nil
+			case <-done:
+				return errSnapshotAbandoned
+			}
+		})
+	}()
+	err := dst.RestoreSnapshot(func() (*protocol.SnapshotChunk, error) {
+		chunk, ok := <-chunks
+		if !ok {
+			return nil, fmt.Errorf("snapshot ended before the last chunk")
+		}
+		return chunk, nil
+	})
+	close(done)
+	return errors.Join(err, <-srcErr)
+}
+
+// ResetViews moves the master record to view 0, for a replica restored from a backup that starts a new cluster
+func ResetViews(db StorageEngine) error {
+	_, entries, err := db.MasterRecord()
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		entries[i].ViewID = 0
+	}
+	return db.SetMasterRecord(0, 0, entries)
+}
@@ -0,0 +1,564 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"sort"
+	"sync"
+)
+
+// ErrConflict is returned when committing a transaction that read a value which has since changed
+var ErrConflict = errors.New("transaction conflict")
+
+// StorageEngine is the persistent state of a replica: the client data, the IR record and the master record.
+//
+// Client transactions are buffered in memory and only applied on commit, so that many clients can have
+// transactions in progress at the same time. Every committed value has the sequence number of the transaction that
+// wrote it, and deleted keys keep a tombstone with the sequence number of the delete, so that a transaction which
+// read a key aborts if the key was deleted and written again in the meantime.
+type StorageEngine interface {
+	// StartTransaction begins a transaction for the client, if transactionID is empty a new one is generated
+	StartTransaction(clientID string, transactionID string) (ClientTxRef, error)
+	// CommitTransaction validates that the values read are unchanged and applies the writes atomically
+	CommitTransaction(tx_ref ClientTxRef) error
+	RollbackTransaction(tx_ref ClientTxRef) error
+	// Get returns the value written or read earlier in the transaction, otherwise the committed value
+	Get(tx_ref ClientTxRef, key []byte) ([]byte, error)
+	// Put buffers the write until the transaction commits
+	Put(tx_ref ClientTxRef, key []byte, value []byte) error
+	// Delete buffers the delete until the transaction commits, when a tombstone replaces the value
+	Delete(tx_ref ClientTxRef, key []byte) error
+	// Scan returns up to limit values from start (inclusive) to end (exclusive) in key order, including writes made
+	// earlier in the transaction. An empty end is unbounded and a limit of 0 is unlimited. The committed values of
+	// the range are validated on commit, so keys inserted into the range by other transactions (phantoms) abort it.
+	Scan(tx_ref ClientTxRef, start []byte, end []byte, limit int) ([]protocol.KeyValue, error)
+	// ScanPrefix is a Scan of the keys starting with prefix
+	ScanPrefix(tx_ref ClientTxRef, prefix []byte, limit int) ([]protocol.KeyValue, error)
+	// CollectTombstones removes the tombstones that no transaction in progress can have read
+	CollectTombstones() (Reclaimed, error)
+
+	// AddRecord adds an operation to the IR record, replacing any entry with the same ID
+	AddRecord(entry RecordEntry) error
+	// FinalizeRecord marks an operation in the IR record as FINALIZED
+	FinalizeRecord(id string) error
+	// Record returns every operation in the IR record
+	Record() ([]RecordEntry, error)
+	// LookupRecord returns the operation with the ID from the IR record, or from the master record if it was truncated
+	// from the IR record, and false if it is in neither
+	LookupRecord(id string) (RecordEntry, bool, error)
+	// ReplaceRecord replaces every operation in the IR record with the entries, when adopting a master record
+	ReplaceRecord(entries []RecordEntry) error
+	// TruncateRecord removes the operations of the IR record that the stored master record already has, and the
+	// operations from before the synced view, see RecordEntry.truncatable. Only the operations the master record
+	// doesn't have are reclaimed, the others are still stored.
+	TruncateRecord() (Reclaimed, error)
+
+	// SetMasterRecord replaces the master record with the one decided by the leader of a view. syncedViewID is the
+	// latest view every member had adopted the master record of when it was decided.
+	SetMasterRecord(viewID int, syncedViewID int, entries []RecordEntry) error
+	// MasterRecord returns the master record and the view it was decided in
+	MasterRecord() (int, []RecordEntry, error)
+	// SyncedViewID returns the synced view stored with the master record, the operations from before it are left out of
+	// later master records
+	SyncedViewID() (int, error)
+
+	// Snapshot sends a consistent copy of the client data and the master record in chunks of about chunkSize
+	// serialized bytes, stopping at the first error returned by send
+	Snapshot(chunkSize int, send func(chunk *protocol.SnapshotChunk) error) error
+	// Digest hashes the committed values of each range from a consistent read. Versions and tombstones are local to
+	// the replica, so only the keys and values are hashed.
+	Digest(ranges []protocol.KeyRange) ([]protocol.RangeDigest, error)
+	// RestoreSnapshot replaces the client data and the master record with the chunks returned by receive, until the
+	// last chunk. The IR record is kept. There must be no transactions in progress.
+	RestoreSnapshot(receive func() (*protocol.SnapshotChunk, error)) error
+
+	Close() error
+}
+
+const (
+	// SnapshotSectionData entries are client data keys with versioned values
+	SnapshotSectionData = "data"
+	// SnapshotSectionMasterRecord entries are master record entries, and the view and synced view of the master record
+	SnapshotSectionMasterRecord = "master_record"
+	// SnapshotSectionRecord entries are IR record entries, which are only sent when requested by a view change
+	SnapshotSectionRecord = "record"
+)
+
+// DefaultSnapshotChunkSize keeps chunks well below protocol.MaxMessageSize
+const DefaultSnapshotChunkSize = 32 * 1024
+
+// snapshotEntryOverhead is roughly the size of a serialized protocol.SnapshotEntry without the section, key and value
+const snapshotEntryOverhead = 40
+
+// snapshotChunker groups snapshot entries into chunks of about chunkSize serialized bytes
+type snapshotChunker struct {
+	chunkSize int
+	send      func(chunk *protocol.SnapshotChunk) error
+	chunk     *protocol.SnapshotChunk
+	size      int
+}
+
+func newSnapshotChunker(chunkSize int, sequence uint64, send func(chunk *protocol.SnapshotChunk) error) *snapshotChunker {
+	if chunkSize <= 0 {
+		chunkSize = DefaultSnapshotChunkSize
+	}
+	return &snapshotChunker{
+		chunkSize: chunkSize,
+		send:      send,
+		chunk:     &protocol.SnapshotChunk{Sequence: sequence},
+	}
+}
+
+// add copies the key and value into the current chunk, sending it once it is full
+func (c *snapshotChunker) add(section string, key []byte, value []byte) error {
+	c.chunk.Entries = append(c.chunk.Entries, protocol.SnapshotEntry{
+		Section: section,
+		Key:     bytes.Clone(key),
+		Value:   bytes.Clone(value),
+	})
+	// Keys and values are serialized as base64
+	c.size += snapshotEntryOverhead + len(section) + base64.StdEncoding.EncodedLen(len(key)) + base64.StdEncoding.EncodedLen(len(value))
+	if c.size < c.chunkSize {
+		return nil
+	}
+	if err := c.send(c.chunk); err != nil {
+		return err
+	}
+	c.chunk = &protocol.SnapshotChunk{Index: c.chunk.Index + 1, Sequence: c.chunk.Sequence}
+	c.size = 0
+	return nil
+}
+
+// finish sends the last chunk, which may have no entries
+func (c *snapshotChunker) finish() error {
+	c.chunk.Last = true
+	return c.send(c.chunk)
+}
+
+// receiveSnapshot calls apply with every chunk from receive in order, until the last chunk
+func receiveSnapshot(receive func() (*protocol.SnapshotChunk, error), apply func(chunk *protocol.SnapshotChunk) error) error {
+	for index := 0; ; index++ {
+		chunk, err := receive()
+		if err != nil {
+			return fmt.Errorf("error receiving snapshot chunk %d: %w", index, err)
+		}
+		if chunk.Index != index {
+			return fmt.Errorf("received snapshot chunk %d but expected chunk %d", chunk.Index, index)
+		}
+		if err := apply(chunk); err != nil {
+			return fmt.Errorf("error restoring snapshot chunk %d: %w", index, err)
+		}
+		if chunk.Last {
+			return nil
+		}
+	}
+}
+
+// digestRange hashes the keys and values of a range, each prefixed with its length so that they can't run together
+func digestRange(r protocol.KeyRange, values []VersionedKeyValue) protocol.RangeDigest {
+	hash := sha256.New()
+	length := make([]byte, 8)
+	for _, kv := range values {
+		for _, b := range [][]byte{[]byte(kv.Key), kv.Value} {
+			binary.BigEndian.PutUint64(length, uint64(len(b)))
+			hash.Write(length)
+			hash.Write(b)
+		}
+	}
+	return protocol.RangeDigest{Range: r, Keys: len(values), Hash: hex.EncodeToString(hash.Sum(nil))}
+}
+
+// Reclaimed is how much state was removed by compaction, Bytes is the size of the keys and values removed
+type Reclaimed struct {
+	Entries int
+	Bytes   int
+}
+
+func (r Reclaimed) Add(other Reclaimed) Reclaimed {
+	return Reclaimed{Entries: r.Entries + other.Entries, Bytes: r.Bytes + other.Bytes}
+}
+
+type ClientTxRef struct {
+	ClientID      string
+	TransactionID string
+}
+
+type ClientTx struct {
+	// StartSequence is the sequence number of the last transaction committed when this transaction started
+	StartSequence uint64
+	// ReadSet values as they were first read, validated on commit
+	ReadSet map[string]VersionedValue
+	// RangeReads committed values of scanned ranges as they were read, validated on commit
+	RangeReads []VersionedRangeRead
+	// WriteSet values buffered until commit
+	WriteSet map[string][]byte
+	// DeleteSet keys to replace with a tombstone on commit
+	DeleteSet map[string]struct{}
+}
+
+// VersionedValue is a committed value, or a tombstone if Deleted. Keys that were never written have Version 0.
+type VersionedValue struct {
+	// Version is the sequence number of the transaction that wrote or deleted the key
+	Version uint64
+	Deleted bool
+	Value   []byte
+}
+
+const versionedValueHeader = 9
+
+// encodeVersionedValue is the version, a deleted flag byte and the value
+func encodeVersionedValue(v VersionedValue) []byte {
+	data := make([]byte, versionedValueHeader+len(v.Value))
+	binary.BigEndian.PutUint64(data, v.Version)
+	if v.Deleted {
+		data[8] = 1
+	}
+	copy(data[versionedValueHeader:], v.Value)
+	return data
+}
+
+func decodeVersionedValue(data []byte) (VersionedValue, error) {
+	if len(data) < versionedValueHeader {
+		return VersionedValue{}, fmt.Errorf("versioned value is too short: %d bytes", len(data))
+	}
+	return VersionedValue{
+		Version: binary.BigEndian.Uint64(data),
+		Deleted: data[8] == 1,
+		Value:   append([]byte(nil), data[versionedValueHeader:]...),
+	}, nil
+}
+
+// absent is true if the key has no value, either because it was deleted or because it was never written
+func (v VersionedValue) absent() bool {
+	return v.Deleted || v.Version == 0
+}
+
+// sameVersion is true if the committed value is the one that was read. A key read as absent is still absent if its
+// tombstone was collected, as collection only removes tombstones older than every transaction in progress.
+func sameVersion(read VersionedValue, current VersionedValue) bool {
+	if read.absent() && current.Version == 0 {
+		return true
+	}
+	return read.Version == current.Version && read.Deleted == current.Deleted
+}
+
+// VersionedKeyValue is a committed value of a key in a range
+type VersionedKeyValue struct {
+	Key string
+	VersionedValue
+}
+
+// VersionedRangeRead is the committed values of a range as they were scanned
+type VersionedRangeRead struct {
+	Range  protocol.KeyRange
+	Values []VersionedKeyValue
+}
+
+type RecordState int
+
+const (
+	// Tentative operations have been received but not finalized
+	Tentative RecordState = iota
+	// Finalized inconsistent operations have executed, and finalized consensus operations have the consensus result
+	Finalized
+)
+
+func (s RecordState) String() string {
+	switch s {
+	case Tentative:
+		return "TENTATIVE"
+	case Finalized:
+		return "FINALIZED"
+	default:
+		return fmt.Sprintf("RecordState(%d)", int(s))
+	}
+}
+
+// RecordEntry is an operation in the IR record of a replica
+type RecordEntry struct {
+	// ID is the transaction ID of the operation
+	ID        string
+	ClientID  string
+	ViewID    int
+	Mode      protocol.OperationRequestMode
+	Operation *protocol.Operation
+	State     RecordState
+	// ReadValues, ScanResults and Error are the result of executing the operation locally, replaced by the consensus
+	// result when a consensus operation is finalized
+	ReadValues  map[string]string
+	ScanResults []protocol.RangeRead
+	Error       *protocol.ReplicaError
+	// Applied is set once the writes of a committed consensus operation were applied to the data
+	Applied bool
+}
+
+// response is the result of the operation as it was sent to the client
+func (e RecordEntry) response() *protocol.OperationResponse {
+	return &protocol.OperationResponse{ReadValues: e.ReadValues, ScanResults: e.ScanResults, Error: e.Error}
+}
+
+// truncatable is true if the entry can be removed from the IR record because the master record of a later view has it,
+// or because it is from before the synced view, which every member adopted a master record with it in. The writes of a
+// committed consensus operation must have been applied, as a restart applies them from the record.
+func (e RecordEntry) truncatable(masterRecordViewID int, syncedViewID int, inMasterRecord bool) bool {
+	committed := e.Mode == protocol.Consensus && e.Error == nil
+	return (inMasterRecord || e.ViewID < syncedViewID) && e.State == Finalized && e.ViewID < masterRecordViewID && (!committed || e.Applied)
+}
+
+// transactions tracks the in-progress client transactions of a StorageEngine
+type transactions struct {
+	txMap map[ClientTxRef]*ClientTx
+	txMux sync.Mutex
+}
+
+func newTransactions() transactions {
+	return transactions{txMap: make(map[ClientTxRef]*ClientTx)}
+}
+
+// start a transaction, sequence is the sequence number of the last committed transaction
+func (t *transactions) start(clientID string, transactionID string, sequence uint64) (ClientTxRef, error) {
+	if transactionID == "" {
+		transactionID = uuid.New().String()
+	}
+	tx_ref := ClientTxRef{ClientID: clientID, TransactionID: transactionID}
+	t.txMux.Lock()
+	defer t.txMux.Unlock()
+	_, exists := t.txMap[tx_ref]
+	if exists {
+		return ClientTxRef{}, fmt.Errorf("client %s already has an active transaction %s", clientID, transactionID)
+	}
+	t.txMap[tx_ref] = &ClientTx{
+		StartSequence: sequence,
+		ReadSet:       make(map[string]VersionedValue),
+		WriteSet:      make(map[string][]byte),
+		DeleteSet:     make(map[string]struct{}),
+	}
+	return tx_ref, nil
+}
+
+func (t *transactions) remove(tx_ref ClientTxRef) (*ClientTx, error) {
+	t.txMux.Lock()
+	defer t.txMux.Unlock()
+	tx, err := t.transaction(tx_ref)
+	if err != nil {
+		return nil, err
+	}
+	delete(t.txMap, tx_ref)
+	return tx, nil
+}
+
+func (t *transactions) transaction(tx_ref ClientTxRef) (*ClientTx, error) {
+	tx, exists := t.txMap[tx_ref]
+	if !exists {
+		return nil, fmt.Errorf("client %s does not have an active transaction %s", tx_ref.ClientID, tx_ref.TransactionID)
+	}
+	return tx, nil
+}
+
+// get returns the value from the transaction if it was written or read before, otherwise reads it with
+// readCommitted and remembers it for validation on commit. Absent keys are nil.
+func (t *transactions) get(tx_ref ClientTxRef, key []byte, readCommitted func(key []byte) (VersionedValue, error)) ([]byte, error) {
+	t.txMux.Lock()
+	tx, err := t.transaction(tx_ref)
+	if err != nil {
+		t.txMux.Unlock()
+		return nil, err
+	}
+	if _, ok := tx.DeleteSet[string(key)]; ok {
+		t.txMux.Unlock()
+		return nil, nil
+	}
+	if value, ok := tx.WriteSet[string(key)]; ok {
+		t.txMux.Unlock()
+		return value, nil
+	}
+	if read, ok := tx.ReadSet[string(key)]; ok {
+		t.txMux.Unlock()
+		return liveValue(read), nil
+	}
+	t.txMux.Unlock()
+	value, err := readCommitted(key)
+	if err != nil {
+		return nil, err
+	}
+	t.txMux.Lock()
+	defer t.txMux.Unlock()
+	if _, ok := tx.ReadSet[string(key)]; !ok {
+		tx.ReadSet[string(key)] = value
+	}
+	return liveValue(tx.ReadSet[string(key)]), nil
+}
+
+// liveValue is the value, or nil if the key is absent
+func liveValue(v VersionedValue) []byte {
+	if v.absent() {
+		return nil
+	}
+	return v.Value
+}
+
+// scan reads the committed values of the range with scanCommitted and remembers them for validation on commit,
+// then overlays the writes and deletes of the transaction. scanCommitted only returns keys that are not deleted.
+func (t *transactions) scan(tx_ref ClientTxRef, r protocol.KeyRange, scanCommitted func(r protocol.KeyRange) ([]VersionedKeyValue, error)) ([]protocol.KeyValue, error) {
+	t.txMux.Lock()
+	tx, err := t.transaction(tx_ref)
+	t.txMux.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	committed, err := scanCommitted(r)
+	if err != nil {
+		return nil, err
+	}
+	t.txMux.Lock()
+	defer t.txMux.Unlock()
+	tx.RangeReads = append(tx.RangeReads, VersionedRangeRead{Range: r, Values: committed})
+	values := make(map[string]string, len(committed))
+	for _, kv := range committed {
+		values[kv.Key] = string(kv.Value)
+	}
+	for key, value := range tx.WriteSet {
+		if !r.Contains(key) {
+			continue
+		}
+		// If the committed values were truncated by the limit, keys after the last one may not be the next in order
+		if r.Limit > 0 && len(committed) == r.Limit && key > committed[len(committed)-1].Key {
+			continue
+		}
+		values[key] = string(value)
+	}
+	for key := range tx.DeleteSet {
+		delete(values, key)
+	}
+	result := make([]protocol.KeyValue, 0, len(values))
+	for key, value := range values {
+		result = append(result, protocol.KeyValue{Key: key, Value: value})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	if r.Limit > 0 && len(result) > r.Limit {
+		result = result[:r.Limit]
+	}
+	return result, nil
+}
+
+// validateReads checks that the keys read and the scanned ranges still have the committed values that were read.
+// readCommitted returns the zero VersionedValue for keys that have no value or tombstone.
+func validateReads(tx *ClientTx, readCommitted func(key string) (VersionedValue, error), scanCommitted func(r protocol.KeyRange) ([]VersionedKeyValue, error)) error {
+	for key, read := range tx.ReadSet {
+		current, err := readCommitted(key)
+		if err != nil {
+			return err
+		}
+		if !sameVersion(read, current) {
+			return fmt.Errorf("%w: key %s changed since it was read", ErrConflict, key)
+		}
+	}
+	for _, read := range tx.RangeReads {
+		current, err := scanCommitted(read.Range)
+		if err != nil {
+			return err
+		}
+		if !sameVersions(current, read.Values) {
+			return fmt.Errorf("%w: range [%s, %s) changed since it was read", ErrConflict, read.Range.Start, read.Range.End)
+		}
+	}
+	return nil
+}
+
+// sameVersions is true if both have the same keys with the same versions in the same order
+func sameVersions(a []VersionedKeyValue, b []VersionedKeyValue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || a[i].Version != b[i].Version {
+			return false
+		}
+	}
+	return true
+}
+
+// applyWrites calls write with the new value of every key written or deleted by the transaction, with the sequence
+// number of the commit. Deleting a key that is already absent writes nothing.
+func applyWrites(tx *ClientTx, sequence uint64, readCommitted func(key string) (VersionedValue, error), write func(key string, value VersionedValue) error) error {
+	for key, value := range tx.WriteSet {
+		if err := write(key, VersionedValue{Version: sequence, Value: value}); err != nil {
+			return err
+		}
+	}
+	for key := range tx.DeleteSet {
+		current, err := readCommitted(key)
+		if err != nil {
+			return err
+		}
+		if current.absent() {
+			continue
+		}
+		if err := write(key, VersionedValue{Version: sequence, Deleted: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasWrites is true if committing the transaction changes any keys
+func (tx *ClientTx) hasWrites() bool {
+	return len(tx.WriteSet) > 0 || len(tx.DeleteSet) > 0
+}
+
+// horizon is the sequence number at or before which tombstones can be collected: no transaction in progress
+// started before it, so none of them can have read a key that was deleted and written again before it
+func (t *transactions) horizon(sequence uint64) uint64 {
+	t.txMux.Lock()
+	defer t.txMux.Unlock()
+	for _, tx := range t.txMap {
+		sequence = min(sequence, tx.StartSequence)
+	}
+	return sequence
+}
+
+// SameKeyValues is true if both have the same keys and values in the same order
+func SameKeyValues(a []protocol.KeyValue, b []protocol.KeyValue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *transactions) put(tx_ref ClientTxRef, key []byte, value []byte) error {
+	t.txMux.Lock()
+	defer t.txMux.Unlock()
+	tx, err := t.transaction(tx_ref)
+	if err != nil {
+		return err
+	}
+	tx.WriteSet[string(key)] = value
+	delete(tx.DeleteSet, string(key))
+	return nil
+}
+
+func (t *transactions) delete(tx_ref ClientTxRef, key []byte) error {
+	t.txMux.Lock()
+	defer t.txMux.Unlock()
+	tx, err := t.transaction(tx_ref)
+	if err != nil {
+		return err
+	}
+	tx.DeleteSet[string(key)] = struct{}{}
+	delete(tx.WriteSet, string(key))
+	return nil
+}
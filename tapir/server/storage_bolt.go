@@ -0,0 +1,601 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"go.etcd.io/bbolt"
+	"strconv"
+	"time"
+)
+
+// DATA_BUCKET Stores client data as versioned values, the bucket sequence is the sequence number of the last
+// committed transaction
+var DATA_BUCKET = []byte("client_bucket")
+
+// SYSTEM_BUCKET Replicas add inconsistent operations to their record
+// as TENTATIVE and then mark them as FINALIZED once they execute.
+// consensus operations are first marked TENTATIVE with the result of
+// locally executing the operation, then FINALIZED once the record
+// has the consensus result.
+var SYSTEM_BUCKET = []byte("system_bucket")
+
+// MASTER_RECORD_BUCKET On synchronization, a single IR node first
+// upcalls into the application protocol with Merge, which takes
+// records from inconsistent replicas and merges them into a master
+// record of successful operations and consensus results. Then, IR
+// upcalls into the application protocol with Sync at each replica.
+// Sync takes the master record and reconciles application protocol
+// state to make the replica consistent with the chosen consensus results.
+//
+// Replicas add inconsistent operations to their record as TENTATIVE
+// and then mark them as FINALIZED once they execute. consensus operations
+// are first marked TENTATIVE with the result of locally executing
+// the operation, then FINALIZED once the record has the consensus result.
+//
+// The Leader in a view decides the master record that replicas replicate
+// from each other.
+var MASTER_RECORD_BUCKET = []byte("master_record_bucket")
+
+// MASTER_RECORD_VIEW_KEY is the key in MASTER_RECORD_BUCKET storing the view the master record was decided in,
+// all other keys but MASTER_RECORD_SYNCED_VIEW_KEY are record entries
+var MASTER_RECORD_VIEW_KEY = []byte("view")
+
+// MASTER_RECORD_SYNCED_VIEW_KEY is the key in MASTER_RECORD_BUCKET storing the latest view every member had adopted
+// the master record of when the master record was decided
+var MASTER_RECORD_SYNCED_VIEW_KEY = []byte("synced_view")
+
+// isMasterRecordViewKey is true for the keys of MASTER_RECORD_BUCKET that aren't record entries
+func isMasterRecordViewKey(k []byte) bool {
+	return bytes.Equal(k, MASTER_RECORD_VIEW_KEY) || bytes.Equal(k, MASTER_RECORD_SYNCED_VIEW_KEY)
+}
+
+// masterRecordView reads one of the views stored in MASTER_RECORD_BUCKET, 0 if it isn't set
+func masterRecordView(bucket *bbolt.Bucket, key []byte) (int, error) {
+	v := bucket.Get(key)
+	if v == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(v))
+}
+
+// RESTORE_BUCKETS stage the sections of a snapshot being restored, by section, so that no transaction is held open
+// while the chunks are received
+var RESTORE_BUCKETS = map[string][]byte{
+	SnapshotSectionData:         []byte("restore_data_bucket"),
+	SnapshotSectionMasterRecord: []byte("restore_master_record_bucket"),
+}
+
+// BoltStorageEngine stores the replica state in a bbolt database file. Transactions only open a
+// bbolt write transaction on commit.
+type BoltStorageEngine struct {
+	db *bbolt.DB
+	transactions
+}
+
+func NewStorageEngine(filepath string) (*BoltStorageEngine, error) {
+	db, err := bbolt.Open(filepath, 0600, &bbolt.Options{
+		// Timeout for opening the database in case another process has a lock
+		Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %e", err)
+	}
+	// Create the default buckets
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{DATA_BUCKET, SYSTEM_BUCKET, MASTER_RECORD_BUCKET} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating bucket: %e", err)
+	}
+	return &BoltStorageEngine{db: db, transactions: newTransactions()}, nil
+}
+
+// NewReadOnlyStorageEngine opens an existing database without taking the write lock, for reading backups and
+// snapshots. Writing to it returns an error.
+func NewReadOnlyStorageEngine(filepath string) (*BoltStorageEngine, error) {
+	db, err := bbolt.Open(filepath, 0600, &bbolt.Options{ReadOnly: true, Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{DATA_BUCKET, SYSTEM_BUCKET, MASTER_RECORD_BUCKET} {
+			if tx.Bucket(bucket) == nil {
+				return fmt.Errorf("bucket %s does not exist, the file is not a replica database", bucket)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+	return &BoltStorageEngine{db: db, transactions: newTransactions()}, nil
+}
+
+// Stats of the bbolt database since it was opened
+func (s *BoltStorageEngine) Stats() bbolt.Stats {
+	return s.db.Stats()
+}
+
+func (s *BoltStorageEngine) StartTransaction(clientID string, transactionID string) (ClientTxRef, error) {
+	var sequence uint64
+	err := s.db.View(func(btx *bbolt.Tx) error {
+		sequence = btx.Bucket(DATA_BUCKET).Sequence()
+		return nil
+	})
+	if err != nil {
+		return ClientTxRef{}, err
+	}
+	return s.transactions.start(clientID, transactionID, sequence)
+}
+
+func (s *BoltStorageEngine) CommitTransaction(tx_ref ClientTxRef) error {
+	tx, err := s.transactions.remove(tx_ref)
+	if err != nil {
+		return err
+	}
+	err = s.db.Update(func(btx *bbolt.Tx) error {
+		bucket := btx.Bucket(DATA_BUCKET)
+		if bucket == nil {
+			return fmt.Errorf("bucket does not exist")
+		}
+		readCommitted := func(key string) (VersionedValue, error) {
+			return readBucket(bucket, []byte(key))
+		}
+		err := validateReads(tx, readCommitted, func(r protocol.KeyRange) ([]VersionedKeyValue, error) {
+			return scanBucket(bucket, r)
+		})
+		if err != nil {
+			return err
+		}
+		if !tx.hasWrites() {
+			return nil
+		}
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		return applyWrites(tx, sequence, readCommitted, func(key string, value VersionedValue) error {
+			return bucket.Put([]byte(key), encodeVersionedValue(value))
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *BoltStorageEngine) RollbackTransaction(tx_ref ClientTxRef) error {
+	_, err := s.transactions.remove(tx_ref)
+	return err
+}
+
+func (s *BoltStorageEngine) Get(tx_ref ClientTxRef, key []byte) ([]byte, error) {
+	return s.transactions.get(tx_ref, key, func(key []byte) (VersionedValue, error) {
+		var value VersionedValue
+		err := s.db.View(func(btx *bbolt.Tx) error {
+			bucket := btx.Bucket(DATA_BUCKET)
+			if bucket == nil {
+				return fmt.Errorf("bucket does not exist")
+			}
+			var err error
+			value, err = readBucket(bucket, key)
+			return err
+		})
+		return value, err
+	})
+}
+
+// readBucket returns the committed value of the key, or the zero VersionedValue if there is none
+func readBucket(bucket *bbolt.Bucket, key []byte) (VersionedValue, error) {
+	data := bucket.Get(key)
+	if data == nil {
+		return VersionedValue{}, nil
+	}
+	// decoding copies the value, which is only valid for the life of the bbolt transaction
+	value, err := decodeVersionedValue(data)
+	if err != nil {
+		return VersionedValue{}, fmt.Errorf("error reading key %s: %w", key, err)
+	}
+	return value, nil
+}
+
+func (s *BoltStorageEngine) Put(tx_ref ClientTxRef, key []byte, value []byte) error {
+	return s.transactions.put(tx_ref, key, value)
+}
+
+func (s *BoltStorageEngine) Delete(tx_ref ClientTxRef, key []byte) error {
+	return s.transactions.delete(tx_ref, key)
+}
+
+func (s *BoltStorageEngine) Scan(tx_ref ClientTxRef, start []byte, end []byte, limit int) ([]protocol.KeyValue, error) {
+	return s.scan(tx_ref, protocol.KeyRange{Start: string(start), End: string(end), Limit: limit})
+}
+
+func (s *BoltStorageEngine) ScanPrefix(tx_ref ClientTxRef, prefix []byte, limit int) ([]protocol.KeyValue, error) {
+	return s.scan(tx_ref, protocol.PrefixRange(string(prefix), limit))
+}
+
+func (s *BoltStorageEngine) scan(tx_ref ClientTxRef, r protocol.KeyRange) ([]protocol.KeyValue, error) {
+	return s.transactions.scan(tx_ref, r, func(r protocol.KeyRange) ([]VersionedKeyValue, error) {
+		var values []VersionedKeyValue
+		err := s.db.View(func(btx *bbolt.Tx) error {
+			bucket := btx.Bucket(DATA_BUCKET)
+			if bucket == nil {
+				return fmt.Errorf("bucket does not exist")
+			}
+			var err error
+			values, err = scanBucket(bucket, r)
+			return err
+		})
+		return values, err
+	})
+}
+
+// scanBucket returns the values of the range in key order without tombstones
+func scanBucket(bucket *bbolt.Bucket, r protocol.KeyRange) ([]VersionedKeyValue, error) {
+	values := make([]VersionedKeyValue, 0)
+	c := bucket.Cursor()
+	for k, v := c.Seek([]byte(r.Start)); k != nil && r.Contains(string(k)); k, v = c.Next() {
+		if r.Limit > 0 && len(values) >= r.Limit {
+			break
+		}
+		value, err := decodeVersionedValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("error reading key %s: %w", k, err)
+		}
+		if !value.Deleted {
+			values = append(values, VersionedKeyValue{Key: string(k), VersionedValue: value})
+		}
+	}
+	return values, nil
+}
+
+func (s *BoltStorageEngine) CollectTombstones() (Reclaimed, error) {
+	reclaimed := Reclaimed{}
+	err := s.db.Update(func(btx *bbolt.Tx) error {
+		bucket := btx.Bucket(DATA_BUCKET)
+		horizon := s.transactions.horizon(bucket.Sequence())
+		var tombstones [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			value, err := decodeVersionedValue(v)
+			if err != nil {
+				return fmt.Errorf("error reading key %s: %w", k, err)
+			}
+			if value.Deleted && value.Version <= horizon {
+				tombstones = append(tombstones, bytes.Clone(k))
+				reclaimed.Bytes += len(k) + len(v)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Keys can't be deleted while iterating over the bucket
+		for _, k := range tombstones {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		reclaimed.Entries = len(tombstones)
+		return nil
+	})
+	if err != nil {
+		return Reclaimed{}, err
+	}
+	return reclaimed, nil
+}
+
+func (s *BoltStorageEngine) AddRecord(entry RecordEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(SYSTEM_BUCKET).Put([]byte(entry.ID), data)
+	})
+}
+
+func (s *BoltStorageEngine) FinalizeRecord(id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(SYSTEM_BUCKET)
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("operation %s is not in the record", id)
+		}
+		var entry RecordEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		entry.State = Finalized
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), data)
+	})
+}
+
+func (s *BoltStorageEngine) LookupRecord(id string) (RecordEntry, bool, error) {
+	var entry RecordEntry
+	found := false
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(SYSTEM_BUCKET).Get([]byte(id))
+		if data == nil && !isMasterRecordViewKey([]byte(id)) {
+			data = tx.Bucket(MASTER_RECORD_BUCKET).Get([]byte(id))
+		}
+		if data == nil {
+			return nil
+		}
+		found = true
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("error reading record entry %s: %w", id, err)
+		}
+		return nil
+	})
+	return entry, found, err
+}
+
+func (s *BoltStorageEngine) ReplaceRecord(entries []RecordEntry) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket(SYSTEM_BUCKET); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucket(SYSTEM_BUCKET)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(entry.ID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorageEngine) Record() ([]RecordEntry, error) {
+	var entries []RecordEntry
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(SYSTEM_BUCKET).ForEach(func(k, v []byte) error {
+			var entry RecordEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("error reading record entry %s: %w", k, err)
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (s *BoltStorageEngine) TruncateRecord() (Reclaimed, error) {
+	reclaimed := Reclaimed{}
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		masterRecord := tx.Bucket(MASTER_RECORD_BUCKET)
+		masterRecordViewID, err := masterRecordView(masterRecord, MASTER_RECORD_VIEW_KEY)
+		if err != nil {
+			return err
+		}
+		syncedViewID, err := masterRecordView(masterRecord, MASTER_RECORD_SYNCED_VIEW_KEY)
+		if err != nil {
+			return err
+		}
+		bucket := tx.Bucket(SYSTEM_BUCKET)
+		var truncated [][]byte
+		err = bucket.ForEach(func(k, v []byte) error {
+			var entry RecordEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("error reading record entry %s: %w", k, err)
+			}
+			inMasterRecord := masterRecord.Get(k) != nil
+			if !entry.truncatable(masterRecordViewID, syncedViewID, inMasterRecord) {
+				return nil
+			}
+			truncated = append(truncated, bytes.Clone(k))
+			// The operations the master record has are still stored
+			if !inMasterRecord {
+				reclaimed = reclaimed.Add(Reclaimed{Entries: 1, Bytes: len(k) + len(v)})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Keys can't be deleted while iterating over the bucket
+		for _, k := range truncated {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Reclaimed{}, err
+	}
+	return reclaimed, nil
+}
+
+func (s *BoltStorageEngine) SetMasterRecord(viewID int, syncedViewID int, entries []RecordEntry) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket(MASTER_RECORD_BUCKET); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucket(MASTER_RECORD_BUCKET)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(MASTER_RECORD_VIEW_KEY, []byte(strconv.Itoa(viewID))); err != nil {
+			return err
+		}
+		if err := bucket.Put(MASTER_RECORD_SYNCED_VIEW_KEY, []byte(strconv.Itoa(syncedViewID))); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(entry.ID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorageEngine) MasterRecord() (int, []RecordEntry, error) {
+	viewID := 0
+	var entries []RecordEntry
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(MASTER_RECORD_BUCKET).ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, MASTER_RECORD_VIEW_KEY) {
+				var err error
+				viewID, err = strconv.Atoi(string(v))
+				return err
+			}
+			if isMasterRecordViewKey(k) {
+				return nil
+			}
+			var entry RecordEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("error reading master record entry %s: %w", k, err)
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return viewID, entries, err
+}
+
+func (s *BoltStorageEngine) SyncedViewID() (int, error) {
+	syncedViewID := 0
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		syncedViewID, err = masterRecordView(tx.Bucket(MASTER_RECORD_BUCKET), MASTER_RECORD_SYNCED_VIEW_KEY)
+		return err
+	})
+	return syncedViewID, err
+}
+
+func (s *BoltStorageEngine) Snapshot(chunkSize int, send func(chunk *protocol.SnapshotChunk) error) error {
+	// A read transaction is a consistent view of the database for as long as it is open
+	return s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(DATA_BUCKET)
+		chunker := newSnapshotChunker(chunkSize, data.Sequence(), send)
+		err := data.ForEach(func(k, v []byte) error {
+			return chunker.add(SnapshotSectionData, k, v)
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(MASTER_RECORD_BUCKET).ForEach(func(k, v []byte) error {
+			return chunker.add(SnapshotSectionMasterRecord, k, v)
+		})
+		if err != nil {
+			return err
+		}
+		return chunker.finish()
+	})
+}
+
+func (s *BoltStorageEngine) Digest(ranges []protocol.KeyRange) ([]protocol.RangeDigest, error) {
+	digests := make([]protocol.RangeDigest, 0, len(ranges))
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(DATA_BUCKET)
+		for _, r := range ranges {
+			values, err := scanBucket(bucket, r)
+			if err != nil {
+				return err
+			}
+			digests = append(digests, digestRange(r, values))
+		}
+		return nil
+	})
+	return digests, err
+}
+
+func (s *BoltStorageEngine) RestoreSnapshot(receive func() (*protocol.SnapshotChunk, error)) error {
+	// Stage the chunks in buckets of their own, one transaction per chunk, discarding any from an interrupted restore
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range RESTORE_BUCKETS {
+			if err := tx.DeleteBucket(name); err != nil && !errors.Is(err, bbolt.ErrBucketNotFound) {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = receiveSnapshot(receive, func(chunk *protocol.SnapshotChunk) error {
+		return s.db.Update(func(tx *bbolt.Tx) error {
+			if err := tx.Bucket(RESTORE_BUCKETS[SnapshotSectionData]).SetSequence(chunk.Sequence); err != nil {
+				return err
+			}
+			for _, entry := range chunk.Entries {
+				name, ok := RESTORE_BUCKETS[entry.Section]
+				if !ok {
+					return fmt.Errorf("unknown snapshot section %s", entry.Section)
+				}
+				if err := tx.Bucket(name).Put(entry.Key, entry.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err == nil {
+		// Then replace the client data and master record at once
+		err = s.db.Update(func(tx *bbolt.Tx) error {
+			for section, name := range map[string][]byte{SnapshotSectionData: DATA_BUCKET, SnapshotSectionMasterRecord: MASTER_RECORD_BUCKET} {
+				if err := tx.DeleteBucket(name); err != nil {
+					return err
+				}
+				bucket, err := tx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				staged := tx.Bucket(RESTORE_BUCKETS[section])
+				if err := bucket.SetSequence(staged.Sequence()); err != nil {
+					return err
+				}
+				if err := staged.ForEach(bucket.Put); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	// The staged chunks are no longer needed whether or not the restore succeeded
+	cleanupErr := s.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range RESTORE_BUCKETS {
+			if err := tx.DeleteBucket(name); err != nil && !errors.Is(err, bbolt.ErrBucketNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Join(err, cleanupErr)
+}
+
+func (s *BoltStorageEngine) Close() error {
+	err := s.db.Close()
+	if err != nil {
+		return fmt.Errorf("error closing database: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"path/filepath"
+	"testing"
+)
+
+// storageEngines are the implementations of StorageEngine that must behave the same
+var storageEngines = map[string]func(t *testing.T) StorageEngine{
+	"bolt": func(t *testing.T) StorageEngine {
+		db, err := NewStorageEngine(filepath.Join(t.TempDir(), "replica.db"))
+		if err != nil {
+			t.Fatalf("error opening bolt storage engine: %v", err)
+		}
+		return db
+	},
+	"memory": func(t *testing.T) StorageEngine {
+		return NewMemoryStorageEngine()
+	},
+}
+
+// storageConformance cases run against each of the storageEngines
+var storageConformance = map[string]func(t *testing.T, db StorageEngine){
+	"write conflict":                testWriteConflict,
+	"compare of an absent key":      testCompareAbsentKey,
+	"blind writes don't conflict":   testBlindWrites,
+	"tombstone versions":            testTombstoneVersions,
+	"phantom on scan":               testScanPhantom,
+	"collect tombstones horizon":    testCollectTombstonesHorizon,
+	"collected tombstone is absent": testCollectedTombstoneAbsent,
+	"truncate record":               testTruncateRecord,
+}
+
+func TestStorageConformance(t *testing.T) {
+	for engine, open := range storageEngines {
+		for name, test := range storageConformance {
+			t.Run(engine+"/"+name, func(t *testing.T) {
+				db := open(t)
+				defer func() {
+					if err := db.Close(); err != nil {
+						t.Errorf("error closing: %v", err)
+					}
+				}()
+				test(t, db)
+			})
+		}
+	}
+}
+
+func startTx(t *testing.T, db StorageEngine) ClientTxRef {
+	t.Helper()
+	tx, err := db.StartTransaction("client", "")
+	if err != nil {
+		t.Fatalf("error starting transaction: %v", err)
+	}
+	return tx
+}
+
+func getKey(t *testing.T, db StorageEngine, tx ClientTxRef, key string) []byte {
+	t.Helper()
+	value, err := db.Get(tx, []byte(key))
+	if err != nil {
+		t.Fatalf("error getting %s: %v", key, err)
+	}
+	return value
+}
+
+func putKey(t *testing.T, db StorageEngine, tx ClientTxRef, key string, value string) {
+	t.Helper()
+	if err := db.Put(tx, []byte(key), []byte(value)); err != nil {
+		t.Fatalf("error putting %s: %v", key, err)
+	}
+}
+
+func commitTx(t *testing.T, db StorageEngine, tx ClientTxRef) {
+	t.Helper()
+	if err := db.CommitTransaction(tx); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+}
+
+func expectConflict(t *testing.T, db StorageEngine, tx ClientTxRef) {
+	t.Helper()
+	if err := db.CommitTransaction(tx); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected ErrConflict, got %v", err)
+	}
+}
+
+// writeKeys commits the values in a transaction of its own
+func writeKeys(t *testing.T, db StorageEngine, values map[string]string) {
+	t.Helper()
+	tx := startTx(t, db)
+	for key, value := range values {
+		putKey(t, db, tx, key, value)
+	}
+	commitTx(t, db, tx)
+}
+
+// deleteKeys commits the delete of the keys in a transaction of its own
+func deleteKeys(t *testing.T, db StorageEngine, keys ...string) {
+	t.Helper()
+	tx := startTx(t, db)
+	for _, key := range keys {
+		if err := db.Delete(tx, []byte(key)); err != nil {
+			t.Fatalf("error deleting %s: %v", key, err)
+		}
+	}
+	commitTx(t, db, tx)
+}
+
+func testWriteConflict(t *testing.T, db StorageEngine) {
+	writeKeys(t, db, map[string]string{"k": "1"})
+	a := startTx(t, db)
+	b := startTx(t, db)
+	if value := getKey(t, db, a, "k"); string(value) != "1" {
+		t.Fatalf("expected k=1, got %q", value)
+	}
+	getKey(t, db, b, "k")
+	putKey(t, db, a, "k", "2")
+	putKey(t, db, b, "k", "3")
+	commitTx(t, db, a)
+	expectConflict(t, db, b)
+
+	c := startTx(t, db)
+	if value := getKey(t, db, c, "k"); string(value) != "2" {
+		t.Errorf("expected the first commit to win with k=2, got %q", value)
+	}
+	if err := db.RollbackTransaction(c); err != nil {
+		t.Errorf("error rolling back: %v", err)
+	}
+}
+
+func testCompareAbsentKey(t *testing.T, db StorageEngine) {
+	a := startTx(t, db)
+	if value := getKey(t, db, a, "k"); value != nil {
+		t.Fatalf("expected k to be absent, got %q", value)
+	}
+	putKey(t, db, a, "other", "1")
+	writeKeys(t, db, map[string]string{"k": "1"})
+	expectConflict(t, db, a)
+}
+
+func testBlindWrites(t *testing.T, db StorageEngine) {
+	writeKeys(t, db, map[string]string{"k": "1"})
+	a := startTx(t, db)
+	b := startTx(t, db)
+	getKey(t, db, a, "x")
+	putKey(t, db, a, "k", "2")
+	getKey(t, db, b, "y")
+	putKey(t, db, b, "k", "3")
+	commitTx(t, db, a)
+	commitTx(t, db, b)
+}
+
+// testTombstoneVersions deletes and writes again the value a transaction read, which must abort it even though the
+// value is the same
+func testTombstoneVersions(t *testing.T, db StorageEngine) {
+	writeKeys(t, db, map[string]string{"k": "1"})
+	a := startTx(t, db)
+	getKey(t, db, a, "k")
+	putKey(t, db, a, "other", "1")
+	deleteKeys(t, db, "k")
+	writeKeys(t, db, map[string]string{"k": "1"})
+	expectConflict(t, db, a)
+
+	// A key read as absent must not be written and deleted in the meantime either
+	b := startTx(t, db)
+	if value := getKey(t, db, b, "new"); value != nil {
+		t.Fatalf("expected new to be absent, got %q", value)
+	}
+	putKey(t, db, b, "other", "2")
+	writeKeys(t, db, map[string]string{"new": "1"})
+	deleteKeys(t, db, "new")
+	expectConflict(t, db, b)
+
+	// Reading a deleted key is the same as reading an absent one
+	c := startTx(t, db)
+	if value := getKey(t, db, c, "new"); value != nil {
+		t.Errorf("expected the deleted key to be absent, got %q", value)
+	}
+	putKey(t, db, c, "new", "2")
+	commitTx(t, db, c)
+}
+
+func testScanPhantom(t *testing.T, db StorageEngine) {
+	writeKeys(t, db, map[string]string{"p/1": "1", "q/1": "1"})
+	scan := func(tx ClientTxRef) []protocol.KeyValue {
+		t.Helper()
+		values, err := db.ScanPrefix(tx, []byte("p/"), 0)
+		if err != nil {
+			t.Fatalf("error scanning: %v", err)
+		}
+		return values
+	}
+
+	a := startTx(t, db)
+	if values := scan(a); len(values) != 1 || values[0] != (protocol.KeyValue{Key: "p/1", Value: "1"}) {
+		t.Fatalf("expected p/1=1, got %v", values)
+	}
+	putKey(t, db, a, "other", "1")
+	writeKeys(t, db, map[string]string{"q/2": "1"})
+	commitTx(t, db, a)
+
+	b := startTx(t, db)
+	scan(b)
+	putKey(t, db, b, "other", "2")
+	writeKeys(t, db, map[string]string{"p/2": "1"})
+	expectConflict(t, db, b)
+
+	c := startTx(t, db)
+	scan(c)
+	putKey(t, db, c, "other", "3")
+	deleteKeys(t, db, "p/1")
+	expectConflict(t, db, c)
+
+	// The writes of the transaction are in its own scans, and don't conflict with it
+	d := startTx(t, db)
+	putKey(t, db, d, "p/3", "3")
+	if values := scan(d); len(values) != 2 || values[1].Key != "p/3" {
+		t.Errorf("expected p/2 and p/3, got %v", values)
+	}
+	commitTx(t, db, d)
+}
+
+func testCollectTombstonesHorizon(t *testing.T, db StorageEngine) {
+	writeKeys(t, db, map[string]string{"k": "1", "j": "1"})
+	// a started before the delete, so it could read k and must still see the tombstone on commit
+	a := startTx(t, db)
+	deleteKeys(t, db, "k")
+	reclaimed, err := db.CollectTombstones()
+	if err != nil {
+		t.Fatalf("error collecting tombstones: %v", err)
+	}
+	if reclaimed.Entries != 0 {
+		t.Errorf("collected %d tombstones newer than a transaction in progress", reclaimed.Entries)
+	}
+	b := startTx(t, db)
+	if err := db.RollbackTransaction(a); err != nil {
+		t.Fatalf("error rolling back: %v", err)
+	}
+	// b started after the delete, so the tombstone is older than every transaction in progress
+	reclaimed, err = db.CollectTombstones()
+	if err != nil {
+		t.Fatalf("error collecting tombstones: %v", err)
+	}
+	if reclaimed.Entries != 1 || reclaimed.Bytes != len("k")+versionedValueHeader {
+		t.Errorf("expected to collect the tombstone of k, collected %+v", reclaimed)
+	}
+	if err := db.RollbackTransaction(b); err != nil {
+		t.Fatalf("error rolling back: %v", err)
+	}
+	reclaimed, err = db.CollectTombstones()
+	if err != nil {
+		t.Fatalf("error collecting tombstones: %v", err)
+	}
+	if reclaimed.Entries != 0 {
+		t.Errorf("collected %d tombstones twice", reclaimed.Entries)
+	}
+}
+
+// testCollectedTombstoneAbsent checks that a transaction which read a deleted key still commits after the tombstone
+// was collected, and aborts if the key was written again
+func testCollectedTombstoneAbsent(t *testing.T, db StorageEngine) {
+	writeKeys(t, db, map[string]string{"k": "1"})
+	deleteKeys(t, db, "k")
+	a := startTx(t, db)
+	getKey(t, db, a, "k")
+	putKey(t, db, a, "other", "1")
+	b := startTx(t, db)
+	getKey(t, db, b, "k")
+	putKey(t, db, b, "other", "2")
+	if reclaimed, err := db.CollectTombstones(); err != nil || reclaimed.Entries != 1 {
+		t.Fatalf("expected to collect the tombstone of k, collected %+v with error %v", reclaimed, err)
+	}
+	commitTx(t, db, a)
+	writeKeys(t, db, map[string]string{"k": "2"})
+	expectConflict(t, db, b)
+}
+
+// testTruncateRecord checks that the operations the master record has are truncated without being reclaimed, and the
+// operations from before the synced view are reclaimed once applied
+func testTruncateRecord(t *testing.T, db StorageEngine) {
+	entry := func(id string, viewID int, mode protocol.OperationRequestMode) RecordEntry {
+		return RecordEntry{ID: id, ViewID: viewID, Mode: mode, Operation: &protocol.Operation{}, State: Finalized}
+	}
+	inMaster := entry("in-master", 2, protocol.Inconsistent)
+	synced := entry("synced", 1, protocol.Inconsistent)
+	unapplied := entry("unapplied", 1, protocol.Consensus)
+	later := entry("later", 2, protocol.Inconsistent)
+	if err := db.SetMasterRecord(3, 2, []RecordEntry{inMaster}); err != nil {
+		t.Fatalf("error setting the master record: %v", err)
+	}
+	for _, e := range []RecordEntry{inMaster, synced, unapplied, later} {
+		if err := db.AddRecord(e); err != nil {
+			t.Fatalf("error adding %s to the record: %v", e.ID, err)
+		}
+	}
+	if syncedViewID, err := db.SyncedViewID(); err != nil || syncedViewID != 2 {
+		t.Fatalf("expected synced view 2, got %d with error %v", syncedViewID, err)
+	}
+
+	reclaimed, err := db.TruncateRecord()
+	if err != nil {
+		t.Fatalf("error truncating the record: %v", err)
+	}
+	data, err := json.Marshal(synced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed.Entries != 1 || reclaimed.Bytes != len(synced.ID)+len(data) {
+		t.Errorf("expected to reclaim only the operation from before the synced view, reclaimed %+v", reclaimed)
+	}
+	record, err := db.Record()
+	if err != nil {
+		t.Fatalf("error reading the record: %v", err)
+	}
+	if len(record) != 2 || record[0].ID != later.ID || record[1].ID != unapplied.ID {
+		t.Errorf("expected the record to keep %s and %s, got %+v", later.ID, unapplied.ID, record)
+	}
+	if _, ok, err := db.LookupRecord(inMaster.ID); err != nil || !ok {
+		t.Errorf("expected to find the truncated operation in the master record, found %v with error %v", ok, err)
+	}
+
+	unapplied.Applied = true
+	if err := db.AddRecord(unapplied); err != nil {
+		t.Fatalf("error adding %s to the record: %v", unapplied.ID, err)
+	}
+	if reclaimed, err := db.TruncateRecord(); err != nil || reclaimed.Entries != 1 {
+		t.Errorf("expected to reclaim the applied operation, reclaimed %+v with error %v", reclaimed, err)
+	}
+}
@@ -0,0 +1,353 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// MemoryStorageEngine keeps the replica state in memory, for tests and simulation.
+// The state survives Close so that a replica can be restarted with the same engine.
+type MemoryStorageEngine struct {
+	transactions
+	mx                 sync.RWMutex
+	data               map[string]VersionedValue
+	sequence           uint64
+	record             map[string]RecordEntry
+	masterRecordViewID int
+	syncedViewID       int
+	masterRecord       []RecordEntry
+}
+
+func NewMemoryStorageEngine() *MemoryStorageEngine {
+	return &MemoryStorageEngine{
+		transactions: newTransactions(),
+		data:         make(map[string]VersionedValue),
+		record:       make(map[string]RecordEntry),
+	}
+}
+
+func (s *MemoryStorageEngine) StartTransaction(clientID string, transactionID string) (ClientTxRef, error) {
+	s.mx.RLock()
+	sequence := s.sequence
+	s.mx.RUnlock()
+	return s.transactions.start(clientID, transactionID, sequence)
+}
+
+func (s *MemoryStorageEngine) CommitTransaction(tx_ref ClientTxRef) error {
+	tx, err := s.transactions.remove(tx_ref)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	err = validateReads(tx, s.readData, func(r protocol.KeyRange) ([]VersionedKeyValue, error) {
+		return s.scanData(r), nil
+	})
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	if !tx.hasWrites() {
+		return nil
+	}
+	s.sequence++
+	return applyWrites(tx, s.sequence, s.readData, func(key string, value VersionedValue) error {
+		value.Value = bytes.Clone(value.Value)
+		s.data[key] = value
+		return nil
+	})
+}
+
+func (s *MemoryStorageEngine) RollbackTransaction(tx_ref ClientTxRef) error {
+	_, err := s.transactions.remove(tx_ref)
+	return err
+}
+
+func (s *MemoryStorageEngine) Get(tx_ref ClientTxRef, key []byte) ([]byte, error) {
+	return s.transactions.get(tx_ref, key, func(key []byte) (VersionedValue, error) {
+		s.mx.RLock()
+		defer s.mx.RUnlock()
+		value, err := s.readData(string(key))
+		value.Value = bytes.Clone(value.Value)
+		return value, err
+	})
+}
+
+// readData returns the committed value of the key, the caller must hold the lock
+func (s *MemoryStorageEngine) readData(key string) (VersionedValue, error) {
+	return s.data[key], nil
+}
+
+func (s *MemoryStorageEngine) Put(tx_ref ClientTxRef, key []byte, value []byte) error {
+	return s.transactions.put(tx_ref, key, value)
+}
+
+func (s *MemoryStorageEngine) Delete(tx_ref ClientTxRef, key []byte) error {
+	return s.transactions.delete(tx_ref, key)
+}
+
+func (s *MemoryStorageEngine) Scan(tx_ref ClientTxRef, start []byte, end []byte, limit int) ([]protocol.KeyValue, error) {
+	return s.scan(tx_ref, protocol.KeyRange{Start: string(start), End: string(end), Limit: limit})
+}
+
+func (s *MemoryStorageEngine) ScanPrefix(tx_ref ClientTxRef, prefix []byte, limit int) ([]protocol.KeyValue, error) {
+	return s.scan(tx_ref, protocol.PrefixRange(string(prefix), limit))
+}
+
+func (s *MemoryStorageEngine) scan(tx_ref ClientTxRef, r protocol.KeyRange) ([]protocol.KeyValue, error) {
+	return s.transactions.scan(tx_ref, r, func(r protocol.KeyRange) ([]VersionedKeyValue, error) {
+		s.mx.RLock()
+		defer s.mx.RUnlock()
+		return s.scanData(r), nil
+	})
+}
+
+// scanData returns the values of the range in key order without tombstones, the caller must hold the lock
+func (s *MemoryStorageEngine) scanData(r protocol.KeyRange) []VersionedKeyValue {
+	values := make([]VersionedKeyValue, 0)
+	for key, value := range s.data {
+		if r.Contains(key) && !value.Deleted {
+			values = append(values, VersionedKeyValue{Key: key, VersionedValue: value})
+		}
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Key < values[j].Key
+	})
+	if r.Limit > 0 && len(values) > r.Limit {
+		values = values[:r.Limit]
+	}
+	return values
+}
+
+func (s *MemoryStorageEngine) CollectTombstones() (Reclaimed, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	horizon := s.transactions.horizon(s.sequence)
+	reclaimed := Reclaimed{}
+	for key, value := range s.data {
+		if value.Deleted && value.Version <= horizon {
+			delete(s.data, key)
+			// Count the size the value would have in the bbolt engine
+			reclaimed = reclaimed.Add(Reclaimed{Entries: 1, Bytes: len(key) + versionedValueHeader})
+		}
+	}
+	return reclaimed, nil
+}
+
+func (s *MemoryStorageEngine) AddRecord(entry RecordEntry) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.record[entry.ID] = entry
+	return nil
+}
+
+func (s *MemoryStorageEngine) FinalizeRecord(id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	entry, ok := s.record[id]
+	if !ok {
+		return fmt.Errorf("operation %s is not in the record", id)
+	}
+	entry.State = Finalized
+	s.record[id] = entry
+	return nil
+}
+
+func (s *MemoryStorageEngine) LookupRecord(id string) (RecordEntry, bool, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if entry, ok := s.record[id]; ok {
+		return entry, true, nil
+	}
+	for _, entry := range s.masterRecord {
+		if entry.ID == id {
+			return entry, true, nil
+		}
+	}
+	return RecordEntry{}, false, nil
+}
+
+func (s *MemoryStorageEngine) ReplaceRecord(entries []RecordEntry) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.record = make(map[string]RecordEntry, len(entries))
+	for _, entry := range entries {
+		s.record[entry.ID] = entry
+	}
+	return nil
+}
+
+func (s *MemoryStorageEngine) Record() ([]RecordEntry, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	entries := make([]RecordEntry, 0, len(s.record))
+	for _, entry := range s.record {
+		entries = append(entries, entry)
+	}
+	// Match the key order of the bbolt engine
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+func (s *MemoryStorageEngine) TruncateRecord() (Reclaimed, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	inMasterRecord := make(map[string]bool, len(s.masterRecord))
+	for _, entry := range s.masterRecord {
+		inMasterRecord[entry.ID] = true
+	}
+	reclaimed := Reclaimed{}
+	for id, entry := range s.record {
+		if !entry.truncatable(s.masterRecordViewID, s.syncedViewID, inMasterRecord[id]) {
+			continue
+		}
+		// The operations the master record has are still stored
+		if !inMasterRecord[id] {
+			// Count the size the entry would have in the bbolt engine
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return reclaimed, err
+			}
+			reclaimed = reclaimed.Add(Reclaimed{Entries: 1, Bytes: len(id) + len(data)})
+		}
+		delete(s.record, id)
+	}
+	return reclaimed, nil
+}
+
+func (s *MemoryStorageEngine) SetMasterRecord(viewID int, syncedViewID int, entries []RecordEntry) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.masterRecordViewID = viewID
+	s.syncedViewID = syncedViewID
+	s.masterRecord = append([]RecordEntry(nil), entries...)
+	return nil
+}
+
+func (s *MemoryStorageEngine) MasterRecord() (int, []RecordEntry, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.masterRecordViewID, append([]RecordEntry(nil), s.masterRecord...), nil
+}
+
+func (s *MemoryStorageEngine) SyncedViewID() (int, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.syncedViewID, nil
+}
+
+func (s *MemoryStorageEngine) Snapshot(chunkSize int, send func(chunk *protocol.SnapshotChunk) error) error {
+	// Copy the state so that commits aren't blocked while the snapshot is sent
+	s.mx.RLock()
+	sequence := s.sequence
+	data := make(map[string]VersionedValue, len(s.data))
+	for key, value := range s.data {
+		data[key] = value
+	}
+	masterRecordViewID := s.masterRecordViewID
+	syncedViewID := s.syncedViewID
+	masterRecord := append([]RecordEntry(nil), s.masterRecord...)
+	s.mx.RUnlock()
+
+	// Use the same keys and values as the bbolt engine so that snapshots can be restored into either
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	chunker := newSnapshotChunker(chunkSize, sequence, send)
+	for _, key := range keys {
+		if err := chunker.add(SnapshotSectionData, []byte(key), encodeVersionedValue(data[key])); err != nil {
+			return err
+		}
+	}
+	for _, entry := range masterRecord {
+		value, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := chunker.add(SnapshotSectionMasterRecord, []byte(entry.ID), value); err != nil {
+			return err
+		}
+	}
+	if err := chunker.add(SnapshotSectionMasterRecord, MASTER_RECORD_VIEW_KEY, []byte(strconv.Itoa(masterRecordViewID))); err != nil {
+		return err
+	}
+	if err := chunker.add(SnapshotSectionMasterRecord, MASTER_RECORD_SYNCED_VIEW_KEY, []byte(strconv.Itoa(syncedViewID))); err != nil {
+		return err
+	}
+	return chunker.finish()
+}
+
+func (s *MemoryStorageEngine) Digest(ranges []protocol.KeyRange) ([]protocol.RangeDigest, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	digests := make([]protocol.RangeDigest, 0, len(ranges))
+	for _, r := range ranges {
+		digests = append(digests, digestRange(r, s.scanData(r)))
+	}
+	return digests, nil
+}
+
+func (s *MemoryStorageEngine) RestoreSnapshot(receive func() (*protocol.SnapshotChunk, error)) error {
+	var sequence uint64
+	data := make(map[string]VersionedValue)
+	masterRecordViewID := 0
+	syncedViewID := 0
+	var masterRecord []RecordEntry
+	err := receiveSnapshot(receive, func(chunk *protocol.SnapshotChunk) error {
+		sequence = chunk.Sequence
+		for _, entry := range chunk.Entries {
+			switch {
+			case entry.Section == SnapshotSectionData:
+				value, err := decodeVersionedValue(entry.Value)
+				if err != nil {
+					return fmt.Errorf("error reading key %s: %w", entry.Key, err)
+				}
+				data[string(entry.Key)] = value
+			case entry.Section == SnapshotSectionMasterRecord && bytes.Equal(entry.Key, MASTER_RECORD_VIEW_KEY):
+				viewID, err := strconv.Atoi(string(entry.Value))
+				if err != nil {
+					return fmt.Errorf("error reading master record view: %w", err)
+				}
+				masterRecordViewID = viewID
+			case entry.Section == SnapshotSectionMasterRecord && bytes.Equal(entry.Key, MASTER_RECORD_SYNCED_VIEW_KEY):
+				viewID, err := strconv.Atoi(string(entry.Value))
+				if err != nil {
+					return fmt.Errorf("error reading master record synced view: %w", err)
+				}
+				syncedViewID = viewID
+			case entry.Section == SnapshotSectionMasterRecord:
+				var recordEntry RecordEntry
+				if err := json.Unmarshal(entry.Value, &recordEntry); err != nil {
+					return fmt.Errorf("error reading master record entry %s: %w", entry.Key, err)
+				}
+				masterRecord = append(masterRecord, recordEntry)
+			default:
+				return fmt.Errorf("unknown snapshot section %s", entry.Section)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.sequence = sequence
+	s.data = data
+	s.masterRecordViewID = masterRecordViewID
+	s.syncedViewID = syncedViewID
+	s.masterRecord = masterRecord
+	return nil
+}
+
+func (s *MemoryStorageEngine) Close() error {
+	return nil
+}
@@ -0,0 +1,492 @@
+package server
+
+import (
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TestProperties server-side properties used for runtime
+// artificial failures
+type TestProperties struct {
+	timeout          time.Duration
+	viewChangePeriod time.Duration
+	drop_ping        atomic.Int32
+	drop_replica     atomic.Int32
+	drop_client      atomic.Int32
+	// dropped counts the messages dropped for each DropReason
+	dropped [dropReasonCount]atomic.Uint64
+	lock    sync.Mutex
+
+	// partitions by name, guarded by lock
+	partitions map[string]PartitionRule
+	// faults of every connection unless overridden for the peer, and the random number generator deciding them,
+	// guarded by lock
+	faults     NetworkFaults
+	peerFaults map[string]NetworkFaults
+	rand       *rand.Rand
+
+	// clock and network are replaced by a simulation, they are set before the replica starts and never change
+	clock   protocol.Clock
+	network protocol.Network
+}
+
+// minReorderDelay is how long a reordered message is held back at least, so that later messages can overtake it
+const minReorderDelay = 10 * time.Millisecond
+
+// JitterDistribution is how the jitter added to the latency of each message is distributed
+type JitterDistribution int
+
+const (
+	// JitterUniform is between 0 and the jitter
+	JitterUniform JitterDistribution = iota
+	// JitterNormal is the absolute value of a normal distribution with the jitter as standard deviation
+	JitterNormal
+	// JitterExponential has the jitter as mean and a long tail of slow messages
+	JitterExponential
+)
+
+var jitterDistributions = []string{"uniform", "normal", "exponential"}
+
+func (d JitterDistribution) String() string {
+	if int(d) < len(jitterDistributions) {
+		return jitterDistributions[d]
+	}
+	return fmt.Sprintf("JitterDistribution(%d)", int(d))
+}
+
+func ParseJitterDistribution(s string) (JitterDistribution, error) {
+	for i, name := range jitterDistributions {
+		if s == name {
+			return JitterDistribution(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid jitter distribution %q, expected one of %s", s, strings.Join(jitterDistributions, ", "))
+}
+
+// DropReason is why a message was dropped
+type DropReason int
+
+const (
+	// DropPing pings dropped by AddDropPing
+	DropPing DropReason = iota
+	// DropReplica messages from peers dropped by AddDropReplica
+	DropReplica
+	// DropClient messages from clients dropped by AddDropClient
+	DropClient
+	// DropPartition messages blocked by a partition rule
+	DropPartition
+	// DropLoss messages lost to the drop rate of the network faults
+	DropLoss
+	dropReasonCount
+)
+
+var dropReasons = []string{"ping", "replica", "client", "partition", "loss"}
+
+func (r DropReason) String() string {
+	if int(r) < len(dropReasons) {
+		return dropReasons[r]
+	}
+	return fmt.Sprintf("DropReason(%d)", int(r))
+}
+
+// Dropped is how many messages were dropped for the reason since the replica started
+func (tp *TestProperties) Dropped(reason DropReason) uint64 {
+	return tp.dropped[reason].Load()
+}
+
+// DropReasons are the reasons messages are dropped for, in order
+func DropReasons() []DropReason {
+	reasons := make([]DropReason, dropReasonCount)
+	for i := range reasons {
+		reasons[i] = DropReason(i)
+	}
+	return reasons
+}
+
+func (tp *TestProperties) drop(reason DropReason) {
+	tp.dropped[reason].Add(1)
+}
+
+// FaultDirection is which messages of a connection the network faults apply to
+type FaultDirection int
+
+const (
+	FaultsInbound FaultDirection = iota
+	FaultsOutbound
+	FaultsBoth
+)
+
+var faultDirections = []string{"inbound", "outbound", "both"}
+
+func (d FaultDirection) String() string {
+	if int(d) < len(faultDirections) {
+		return faultDirections[d]
+	}
+	return fmt.Sprintf("FaultDirection(%d)", int(d))
+}
+
+func ParseFaultDirection(s string) (FaultDirection, error) {
+	for i, name := range faultDirections {
+		if s == name {
+			return FaultDirection(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid direction %q, expected one of %s", s, strings.Join(faultDirections, ", "))
+}
+
+// NetworkFaults are injected into the messages of a connection, to test how IR tolerates an asynchronous network.
+// The zero value delivers every message immediately.
+type NetworkFaults struct {
+	Latency      time.Duration
+	Jitter       time.Duration
+	Distribution JitterDistribution
+	// DropRate is the chance of losing a message
+	DropRate float64
+	// DuplicateRate is the chance of delivering a message twice, each copy with its own delay
+	DuplicateRate float64
+	// ReorderRate is the chance of holding a message back for longer, so that later messages overtake it
+	ReorderRate float64
+	Direction   FaultDirection
+}
+
+func (f NetworkFaults) String() string {
+	return fmt.Sprintf("latency=%s jitter=%s distribution=%s drop=%g duplicate=%g reorder=%g direction=%s",
+		f.Latency, f.Jitter, f.Distribution, f.DropRate, f.DuplicateRate, f.ReorderRate, f.Direction)
+}
+
+func (f NetworkFaults) applies(outbound bool) bool {
+	if f.Direction == FaultsBoth {
+		return true
+	}
+	return outbound == (f.Direction == FaultsOutbound)
+}
+
+// delay of one copy of a message
+func (f NetworkFaults) delay(r *rand.Rand) time.Duration {
+	delay := f.Latency
+	if f.Jitter > 0 {
+		switch f.Distribution {
+		case JitterNormal:
+			delay += time.Duration(math.Abs(r.NormFloat64()) * float64(f.Jitter))
+		case JitterExponential:
+			delay += time.Duration(r.ExpFloat64() * float64(f.Jitter))
+		default:
+			delay += time.Duration(r.Int63n(int64(f.Jitter) + 1))
+		}
+	}
+	if f.ReorderRate > 0 && r.Float64() < f.ReorderRate {
+		delay += max(f.Latency+f.Jitter, minReorderDelay)
+	}
+	return delay
+}
+
+// PartitionRule blocks the messages from the From peers to the To peers, and from To to From unless it is OneWay.
+// A replica can only drop the messages it sends and receives, so a rule has to be added to every replica it affects.
+type PartitionRule struct {
+	From   []string
+	To     []string
+	OneWay bool
+}
+
+// ParsePartitionRule parses "a,b | c" to block both ways, or "a,b -> c" to only block from a and b to c
+func ParsePartitionRule(s string) (PartitionRule, error) {
+	separator, oneWay := "|", false
+	if strings.Contains(s, "->") {
+		separator, oneWay = "->", true
+	}
+	sides := strings.Split(s, separator)
+	if len(sides) != 2 {
+		return PartitionRule{}, fmt.Errorf("invalid partition %q, expected 'a,b | c' or 'a,b -> c'", s)
+	}
+	rule := PartitionRule{From: parsePeers(sides[0]), To: parsePeers(sides[1]), OneWay: oneWay}
+	if len(rule.From) == 0 || len(rule.To) == 0 {
+		return PartitionRule{}, fmt.Errorf("invalid partition %q, both sides need at least one peer", s)
+	}
+	return rule, nil
+}
+
+func parsePeers(s string) []string {
+	peers := make([]string, 0)
+	for _, peer := range strings.Split(s, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+func (r PartitionRule) String() string {
+	separator := "|"
+	if r.OneWay {
+		separator = "->"
+	}
+	return fmt.Sprintf("%s %s %s", strings.Join(r.From, ","), separator, strings.Join(r.To, ","))
+}
+
+// blocks is true if the rule drops messages from one peer to the other
+func (r PartitionRule) blocks(from string, to string) bool {
+	if containsPeer(r.From, from) && containsPeer(r.To, to) {
+		return true
+	}
+	return !r.OneWay && containsPeer(r.To, from) && containsPeer(r.From, to)
+}
+
+func containsPeer(peers []string, peer string) bool {
+	for _, p := range peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// AddPartition adds or replaces the named partition rule
+func (tp *TestProperties) AddPartition(name string, rule PartitionRule) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	if tp.partitions == nil {
+		tp.partitions = make(map[string]PartitionRule)
+	}
+	tp.partitions[name] = rule
+}
+
+// RemovePartition removes the named partition rule, returning false if there was no such rule
+func (tp *TestProperties) RemovePartition(name string) bool {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	_, ok := tp.partitions[name]
+	delete(tp.partitions, name)
+	return ok
+}
+
+// Heal removes every partition rule
+func (tp *TestProperties) Heal() {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	tp.partitions = nil
+}
+
+// Partitions are the names of the partition rules in order
+func (tp *TestProperties) Partitions() []string {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	names := make([]string, 0, len(tp.partitions))
+	for name := range tp.partitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Partition is the named partition rule
+func (tp *TestProperties) Partition(name string) (PartitionRule, bool) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	rule, ok := tp.partitions[name]
+	return rule, ok
+}
+
+// Blocked is true if a partition rule drops the messages from one peer to the other
+func (tp *TestProperties) Blocked(from string, to string) bool {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return tp.blocked(from, to)
+}
+
+func (tp *TestProperties) blocked(from string, to string) bool {
+	for _, rule := range tp.partitions {
+		if rule.blocks(from, to) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetFaults of every connection without faults of its own
+func (tp *TestProperties) SetFaults(faults NetworkFaults) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	tp.faults = faults
+}
+
+func (tp *TestProperties) GetFaults() NetworkFaults {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return tp.faults
+}
+
+// SetPeerFaults overrides the faults of the connections with a peer
+func (tp *TestProperties) SetPeerFaults(peer string, faults NetworkFaults) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	if tp.peerFaults == nil {
+		tp.peerFaults = make(map[string]NetworkFaults)
+	}
+	tp.peerFaults[peer] = faults
+}
+
+// ClearPeerFaults removes the override of the faults of a peer, returning false if there was none
+func (tp *TestProperties) ClearPeerFaults(peer string) bool {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	_, ok := tp.peerFaults[peer]
+	delete(tp.peerFaults, peer)
+	return ok
+}
+
+// GetPeerFaults are the faults of the connections with a peer, and whether they are overridden
+func (tp *TestProperties) GetPeerFaults(peer string) (NetworkFaults, bool) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	faults, ok := tp.peerFaults[peer]
+	if !ok {
+		return tp.faults, false
+	}
+	return faults, true
+}
+
+// FaultyPeers are the peers with faults of their own, in order
+func (tp *TestProperties) FaultyPeers() []string {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	peers := make([]string, 0, len(tp.peerFaults))
+	for peer := range tp.peerFaults {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// deliveries are the delays after which a message sent to (outbound) or received from the peer is delivered, as
+// decided by the partitions and faults. The peer is empty for clients, which partitions don't apply to.
+func (tp *TestProperties) deliveries(self string, peer string, outbound bool) []time.Duration {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	if peer != "" && ((outbound && tp.blocked(self, peer)) || (!outbound && tp.blocked(peer, self))) {
+		tp.drop(DropPartition)
+		return nil
+	}
+	faults, ok := tp.peerFaults[peer]
+	if !ok {
+		faults = tp.faults
+	}
+	if faults == (NetworkFaults{}) || !faults.applies(outbound) {
+		return []time.Duration{0}
+	}
+	if faults.DropRate > 0 && tp.rand.Float64() < faults.DropRate {
+		tp.drop(DropLoss)
+		return nil
+	}
+	copies := 1
+	if faults.DuplicateRate > 0 && tp.rand.Float64() < faults.DuplicateRate {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = faults.delay(tp.rand)
+	}
+	return delays
+}
+
+// SetLatency of the messages of every connection without faults of its own
+func (tp *TestProperties) SetLatency(latency time.Duration) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	tp.faults.Latency = latency
+}
+
+func (tp *TestProperties) GetLatency() time.Duration {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return tp.faults.Latency
+}
+
+func (tp *TestProperties) SetTimeout(timeout time.Duration) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	tp.timeout = timeout
+}
+
+func (tp *TestProperties) GetTimeout() time.Duration {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return tp.timeout
+}
+
+func (tp *TestProperties) SetViewChangePeriod(viewChangePeriod time.Duration) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	tp.viewChangePeriod = viewChangePeriod
+}
+
+func (tp *TestProperties) GetViewChangePeriod() time.Duration {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return tp.viewChangePeriod
+}
+
+func (tp *TestProperties) AddDropPing(drop int) {
+	tp.drop_ping.Add(int32(drop))
+}
+
+// DecDropPing true if a ping message should be dropped
+func (tp *TestProperties) DecDropPing() bool {
+	original := tp.drop_ping.Load()
+	if original <= 0 {
+		return false
+	}
+	newVal := tp.drop_ping.Add(-1)
+	if newVal < 0 {
+		// Fix the race condition
+		tp.drop_ping.Add(1)
+		return false
+	}
+	tp.drop(DropPing)
+	return true
+}
+
+func (tp *TestProperties) AddDropReplica(drop int) {
+	tp.drop_replica.Add(int32(drop))
+}
+
+// DecDropReplica true if a replica message should be dropped
+func (tp *TestProperties) DecDropReplica() bool {
+	original := tp.drop_replica.Load()
+	if original <= 0 {
+		return false
+	}
+	newVal := tp.drop_replica.Add(-1)
+	if newVal < 0 {
+		// Fix the race condition
+		tp.drop_replica.Add(1)
+		return false
+	}
+	tp.drop(DropReplica)
+	return true
+}
+
+func (tp *TestProperties) AddDropClient(drop int) {
+	tp.drop_client.Add(int32(drop))
+}
+
+func (tp *TestProperties) DecDropClient() bool {
+	original := tp.drop_client.Load()
+	if original <= 0 {
+		return false
+	}
+	newVal := tp.drop_client.Add(-1)
+	if newVal < 0 {
+		// Fix the race condition
+		tp.drop_client.Add(1)
+		return false
+	}
+	tp.drop(DropClient)
+	return true
+}
@@ -0,0 +1,444 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/phughk/go-dist-algos/tapir/protocol"
+	"github.com/sirupsen/logrus"
+	"sort"
+)
+
+// errViewChangeSuperseded is returned when a view change failed because a peer accepted a view change to the same or a
+// later view from another replica
+var errViewChangeSuperseded = errors.New("another replica is changing to the same or a later view")
+
+// acceptedViewChange is the response of a peer that accepted a view change
+type acceptedViewChange struct {
+	conn     *protocol.ConnHandler
+	response *protocol.ViewChangeResponse
+}
+
+// acceptViewChange moves to the VIEW-CHANGING state for the view change of the request, unless this replica already
+// accepted a view change to the same or a later view, or is in a later view than the leader. Operations are rejected
+// until the view change completes.
+func (p *InconsistentReplicationProtocol) acceptViewChange(peer string, request *protocol.ViewChangeRequest) *protocol.ViewChangeResponse {
+	p.operationMx.Lock()
+	defer p.operationMx.Unlock()
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	response := &protocol.ViewChangeResponse{
+		ViewID:   p.view.currentViewID,
+		Members:  p.view.members,
+		Promised: p.promised,
+	}
+	if err := p.checkClusterSize(len(request.Members)); err != nil {
+		logrus.Warnf("Rejecting view change to view %d from peer '%s': %s", request.ViewID, peer, err.Error())
+		response.Error = err
+		return response
+	}
+	if request.FromViewID < p.view.currentViewID {
+		response.Error = protocol.NewRetryError(fmt.Sprintf("in view %d, later than view %d", p.view.currentViewID, request.FromViewID))
+		return response
+	}
+	if request.ViewID <= p.promised {
+		response.Error = protocol.NewRetryError(fmt.Sprintf("already accepted a view change to view %d", p.promised))
+		return response
+	}
+	logrus.Debugf("Accepted view change from view %d to view %d from peer '%s'", p.view.currentViewID, request.ViewID, peer)
+	p.promised = request.ViewID
+	response.Promised = request.ViewID
+	p.view.when = p.tp.clock.Now()
+	p.view.leader = peer
+	p.view.ViewState = ViewState{Changing: &ViewStateChanging{
+		FromViewID:      p.view.currentViewID,
+		ToViewID:        request.ViewID,
+		proposedMembers: request.Members,
+	}}
+	return response
+}
+
+// changeView is the part of the leader in a view change. Once a majority of the members of the current view accepted
+// the view change, it merges their records into the master record of the new view, adopts it, and notifies the peers
+// so that they fetch it.
+func (p *InconsistentReplicationProtocol) changeView(view View) error {
+	changing := view.ViewState.Changing
+	accepted, superseded := p.sendViewChangeRequest(&view)
+	voters := 0
+	if containsPeer(view.members, p.self) {
+		voters++
+	}
+	for member, a := range accepted {
+		if a.response.ViewID > view.currentViewID {
+			return fmt.Errorf("peer '%s' is in view %d, later than view %d", member, a.response.ViewID, view.currentViewID)
+		}
+		if containsPeer(view.members, member) {
+			voters++
+		}
+	}
+	quorum := func() error {
+		if protocol.MajorityQuorum(voters, len(view.members)) {
+			return nil
+		}
+		err := fmt.Errorf("%d of the %d members of view %d accepted the view change to view %d", voters, len(view.members), view.currentViewID, changing.ToViewID)
+		if superseded {
+			err = fmt.Errorf("%w: %w", errViewChangeSuperseded, err)
+		}
+		return err
+	}
+	if err := quorum(); err != nil {
+		return err
+	}
+	// The records of replicas that weren't NORMAL in the current view may be missing operations of its master record,
+	// so only the records from the current view are merged
+	own, err := p.mergeableRecord()
+	if err != nil {
+		return err
+	}
+	records := [][]RecordEntry{own}
+	members := make([]string, 0, len(accepted))
+	for member := range accepted {
+		members = append(members, member)
+	}
+	// Fetched one at a time in order, so that a simulation takes the same steps every time
+	sort.Strings(members)
+	for _, member := range members {
+		a := accepted[member]
+		if a.response.ViewID != view.currentViewID {
+			continue
+		}
+		_, _, record, err := fetchRecord(a.conn, SnapshotSectionRecord)
+		if err != nil {
+			// Without its record the peer doesn't count towards the quorum
+			logrus.Warnf("Error fetching the record of peer '%s': %v", member, err)
+			if containsPeer(view.members, member) {
+				voters--
+			}
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := quorum(); err != nil {
+		return err
+	}
+	syncedViewID, err := p.db.SyncedViewID()
+	if err != nil {
+		return err
+	}
+	if synced(view, p.self, accepted) {
+		syncedViewID = view.currentViewID
+	}
+	master := mergeRecords(records, len(view.members), syncedViewID)
+	if err := p.adoptMasterRecord(changing.ToViewID, syncedViewID, master, changing.proposedMembers, p.self); err != nil {
+		return err
+	}
+	p.completedViewID.Store(int64(changing.ToViewID))
+	for _, peer := range p.peerConnections() {
+		err := peer.SendUntracked(&protocol.AnyMessage{
+			RequestID:        uuid.New().String(),
+			ViewNotification: &protocol.ViewNotification{ViewID: changing.ToViewID},
+		})
+		if err != nil {
+			logrus.Warnf("Error notifying peer '%s' of view %d: %v", peer.RemoteAddr(), changing.ToViewID, err)
+		}
+	}
+	return nil
+}
+
+// synced is true if every member of the view is in it, so they all adopted its master record and applied the writes of
+// the operations finalized in earlier views
+func synced(view View, self string, accepted map[string]acceptedViewChange) bool {
+	for _, member := range view.members {
+		if a, ok := accepted[member]; member != self && (!ok || a.response.ViewID != view.currentViewID) {
+			return false
+		}
+	}
+	return true
+}
+
+// abandonViewChange returns to the NORMAL state of the current view after the view change to the view failed. If
+// another replica is changing to the same or a later view this replica stays VIEW-CHANGING, as operations it
+// processes in the current view could be missing from the master record of that view change.
+func (p *InconsistentReplicationProtocol) abandonViewChange(viewID int, superseded bool) {
+	p.operationMx.Lock()
+	defer p.operationMx.Unlock()
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	changing := p.view.ViewState.Changing
+	if changing == nil || changing.ToViewID != viewID || p.promised != viewID || superseded {
+		return
+	}
+	logrus.Infof("Abandoned the view change to view %d, staying in view %d", viewID, p.view.currentViewID)
+	p.view.leader = ""
+	p.view.ViewState = ViewState{Normal: p.view.currentViewID}
+}
+
+// mergeRecords decides the master record from the records of the replicas, like the merge of IR: inconsistent
+// operations and finalized consensus results are kept, and tentative consensus results are kept if they match in a
+// recovery quorum of the records, as they may have been finalized on the fast path. Other consensus operations are
+// aborted, no client can have completed them. Operations from before the synced view are left out, as every member
+// already adopted a master record with them, which keeps the master record from growing with the history. A finalize
+// delayed by more than two view changes would find its operation missing, and execute it again.
+func mergeRecords(records [][]RecordEntry, members int, syncedViewID int) []RecordEntry {
+	byID := make(map[string][]RecordEntry)
+	for _, record := range records {
+		for _, entry := range record {
+			byID[entry.ID] = append(byID[entry.ID], entry)
+		}
+	}
+	ids := make([]string, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	master := make([]RecordEntry, 0, len(ids))
+	for _, id := range ids {
+		entry := mergeEntry(byID[id], members)
+		if entry.ViewID < syncedViewID {
+			continue
+		}
+		entry.State = Finalized
+		// Whether the writes were applied is up to each replica
+		entry.Applied = false
+		master = append(master, entry)
+	}
+	return master
+}
+
+// mergeEntry decides the entry of an operation from its entries in the records
+func mergeEntry(entries []RecordEntry, members int) RecordEntry {
+	for _, entry := range entries {
+		if entry.State == Finalized || entry.Mode == protocol.Inconsistent {
+			return entry
+		}
+	}
+	decided, decidedCount := entries[0], 0
+	for _, candidate := range entries {
+		count := 0
+		for _, other := range entries {
+			if sameResult(candidate, other) {
+				count++
+			}
+		}
+		if count > decidedCount {
+			decided, decidedCount = candidate, count
+		}
+	}
+	if protocol.RecoveryQuorum(decidedCount, members) {
+		return decided
+	}
+	decided.ReadValues = nil
+	decided.ScanResults = nil
+	decided.Error = protocol.NewAbortedError("aborted by a view change")
+	return decided
+}
+
+// sameResult is true if two entries have the same result, regardless of how they were stored
+func sameResult(a RecordEntry, b RecordEntry) bool {
+	result := func(e RecordEntry) string {
+		// Maps are marshalled in key order, so equal results have equal JSON
+		data, _ := json.Marshal(e.response())
+		return string(data)
+	}
+	return result(a) == result(b)
+}
+
+// adoptMasterRecord replaces the record of this replica with the master record of the view, as Sync in IR: the writes of
+// committed operations that this replica hasn't applied are applied, operations from earlier views that are not in the
+// master record never completed and are dropped, and the replica moves to the NORMAL state of the view. Operations
+// from before the synced view were left out of the master record as every member has them, so they are kept for
+// TruncateRecord to reclaim once applied.
+func (p *InconsistentReplicationProtocol) adoptMasterRecord(viewID int, syncedViewID int, master []RecordEntry, members []string, leader string) error {
+	p.operationMx.Lock()
+	defer p.operationMx.Unlock()
+	if current := p.currentView().currentViewID; current >= viewID {
+		logrus.Debugf("Not adopting the master record of view %d in view %d", viewID, current)
+		return nil
+	}
+	// The master record is read first, so that an operation truncated in between is found in one of them
+	_, previous, err := p.db.MasterRecord()
+	if err != nil {
+		return err
+	}
+	local, err := p.db.Record()
+	if err != nil {
+		return err
+	}
+	// Operations truncated from the record stay truncated, as the master record has them and they were applied
+	truncated := make(map[string]bool)
+	for _, entry := range truncatedEntries(previous, local) {
+		truncated[entry.ID] = true
+	}
+	applied := make(map[string]bool)
+	inMaster := make(map[string]bool, len(master))
+	for _, entry := range master {
+		inMaster[entry.ID] = true
+	}
+	record := make([]RecordEntry, 0, len(master))
+	var later, pruned []RecordEntry
+	for _, entry := range local {
+		switch {
+		case !inMaster[entry.ID] && entry.ViewID >= viewID:
+			// Processed in the view after its master record was decided, before this replica restarted
+			later = append(later, entry)
+		case !inMaster[entry.ID] && entry.ViewID < syncedViewID:
+			pruned = append(pruned, entry)
+		case entry.Applied:
+			applied[entry.ID] = true
+		}
+	}
+	var committed []RecordEntry
+	for _, entry := range pruned {
+		if entry.Mode == protocol.Consensus && entry.Error == nil && !entry.Applied {
+			committed = append(committed, entry)
+		}
+	}
+	for _, entry := range master {
+		if truncated[entry.ID] {
+			continue
+		}
+		if entry.Mode == protocol.Consensus && entry.Error == nil {
+			if applied[entry.ID] {
+				entry.Applied = true
+				delete(applied, entry.ID)
+			} else {
+				committed = append(committed, entry)
+			}
+		}
+		record = append(record, entry)
+	}
+	for id := range applied {
+		logrus.Errorf("Operation %s was applied but is not committed in the master record of view %d", id, viewID)
+	}
+	record = append(record, pruned...)
+	record = append(record, later...)
+	if err := p.db.SetMasterRecord(viewID, syncedViewID, master); err != nil {
+		return err
+	}
+	if err := p.db.ReplaceRecord(record); err != nil {
+		return err
+	}
+	p.prepared = make(preparedOperations)
+	p.unapplied = make(preparedOperations)
+	for _, entry := range later {
+		if entry.Mode == protocol.Consensus && entry.State == Tentative && entry.Error == nil {
+			p.prepared[entry.ID] = entry.Operation
+		} else if entry.Mode == protocol.Consensus && entry.Error == nil && !entry.Applied {
+			committed = append(committed, entry)
+		}
+	}
+	for _, entry := range committed {
+		p.commitOperation(entry)
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	logrus.Infof("Changed to view %d with members %v", viewID, members)
+	p.promised = max(p.promised, viewID)
+	p.view.currentViewID = viewID
+	// The members agreed on replace the members of the previous view, so a view that shrank below the minimum
+	// cluster size rejects operations
+	p.view.members = members
+	p.view.leader = leader
+	p.view.when = p.tp.clock.Now()
+	if changing := p.view.ViewState.Changing; changing != nil && p.promised > viewID {
+		// A view change to a later view was accepted in the meantime, which is still in progress
+		p.view.ViewState = ViewState{Changing: &ViewStateChanging{
+			FromViewID:      viewID,
+			ToViewID:        p.promised,
+			proposedMembers: changing.proposedMembers,
+		}}
+	} else {
+		p.view.ViewState = ViewState{Normal: viewID}
+	}
+	return nil
+}
+
+// mergeableRecord is the IR record with the operations that were truncated from it, which the stored master record has,
+// without the operations from before the synced view that mergeRecords leaves out
+func (p *InconsistentReplicationProtocol) mergeableRecord() ([]RecordEntry, error) {
+	_, master, err := p.db.MasterRecord()
+	if err != nil {
+		return nil, err
+	}
+	syncedViewID, err := p.db.SyncedViewID()
+	if err != nil {
+		return nil, err
+	}
+	record, err := p.db.Record()
+	if err != nil {
+		return nil, err
+	}
+	mergeable := make([]RecordEntry, 0, len(record))
+	for _, entry := range append(record, truncatedEntries(master, record)...) {
+		if entry.ViewID >= syncedViewID {
+			mergeable = append(mergeable, entry)
+		}
+	}
+	return mergeable, nil
+}
+
+// truncatedEntries are the entries of the master record that are not in the record
+func truncatedEntries(master []RecordEntry, record []RecordEntry) []RecordEntry {
+	inRecord := make(map[string]bool, len(record))
+	for _, entry := range record {
+		inRecord[entry.ID] = true
+	}
+	var truncated []RecordEntry
+	for _, entry := range master {
+		if !inRecord[entry.ID] {
+			truncated = append(truncated, entry)
+		}
+	}
+	return truncated
+}
+
+// catchupToView adopts the master record of a peer in the view or a later one, trying each of the peers, or every
+// peer if none are given
+func (p *InconsistentReplicationProtocol) catchupToView(viewID int, peers ...*protocol.ConnHandler) {
+	if !p.catchingUp.CompareAndSwap(false, true) {
+		return
+	}
+	defer p.catchingUp.Store(false)
+	if len(peers) == 0 {
+		peers = p.peerConnections()
+	}
+	for _, peer := range peers {
+		if p.currentView().currentViewID >= viewID {
+			return
+		}
+		if err := p.catchupFrom(peer, viewID); err != nil {
+			logrus.Debugf("Error catching up to view %d from peer '%s': %v", viewID, peer.RemoteAddr(), err)
+			continue
+		}
+		return
+	}
+}
+
+// catchupFrom adopts the master record of the peer if it is in the view or a later one
+func (p *InconsistentReplicationProtocol) catchupFrom(peer *protocol.ConnHandler, viewID int) error {
+	view := p.currentView()
+	resp, err := peer.SendRequest(&protocol.AnyMessage{
+		RequestID: uuid.New().String(),
+		Hello:     protocol.NewHelloMessageFromServer(p.self, view.members, view.currentViewID, view.leader),
+	})
+	if err != nil {
+		return err
+	}
+	hello := resp.HelloResponse
+	if hello == nil {
+		return fmt.Errorf("unexpected response to hello: %+v", resp)
+	}
+	if hello.ViewID < viewID {
+		return fmt.Errorf("peer is in view %d", hello.ViewID)
+	}
+	masterViewID, syncedViewID, master, err := fetchRecord(peer, SnapshotSectionMasterRecord)
+	if err != nil {
+		return err
+	}
+	if masterViewID != hello.ViewID {
+		return fmt.Errorf("peer moved from view %d to view %d", hello.ViewID, masterViewID)
+	}
+	logrus.Infof("Catching up to view %d from peer '%s'", masterViewID, peer.RemoteAddr())
+	return p.adoptMasterRecord(masterViewID, syncedViewID, master, hello.Members, hello.Leader)
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/server"
 	"strconv"
+	"strings"
 	"time"
 )
 
-func ServerRepl(ctx context.Context, tp *TestProperties, ir *InconsistentReplicationProtocol) {
+func ServerRepl(ctx context.Context, srv *server.Server) {
+	tp := srv.TestProperties()
 	repl := NewRepl("TAPIR KV Server REPL, type 'help' for list of commands.",
 		[]*Command{
 			{
@@ -15,14 +18,19 @@ func ServerRepl(ctx context.Context, tp *TestProperties, ir *InconsistentReplica
 				Help:    "Display status of replica",
 				MinArgs: 0,
 				Execute: func(args []string) error {
-					fmt.Printf("Self: %s\n", ir.self)
-					fmt.Printf("View: %+v\n", ir.view)
+					status := srv.Status()
+					fmt.Printf("Self: %s\n", status.Self)
+					fmt.Printf("View: %+v\n", status.View)
+					fmt.Printf("Min cluster size: %d\n", status.MinClusterSize)
+					if status.ClusterSizeError != nil {
+						fmt.Printf("Rejecting operations: %s\n", status.ClusterSizeError.Error())
+					}
 					return nil
 				},
 			},
 			{
 				Catches: []string{"latency", "l"},
-				Help:    "Set the latency for incoming requests",
+				Help:    "Set the latency in milliseconds of incoming messages, for connections without faults of their own",
 				MinArgs: 1,
 				Execute: func(args []string) error {
 					latency, err := strconv.Atoi(args[0])
@@ -33,6 +41,48 @@ func ServerRepl(ctx context.Context, tp *TestProperties, ir *InconsistentReplica
 					return nil
 				},
 			},
+			{
+				Catches: []string{"faults"},
+				Help: "Inject network faults with 'faults [peer] latency=ms jitter=ms distribution=uniform|normal|exponential " +
+					"drop=rate duplicate=rate reorder=rate direction=inbound|outbound|both', remove them with 'faults clear [peer]'; " +
+					"without arguments show the faults",
+				MinArgs: 0,
+				Execute: func(args []string) error {
+					if len(args) == 0 {
+						fmt.Printf("default - %s\n", tp.GetFaults())
+						for _, peer := range tp.FaultyPeers() {
+							faults, _ := tp.GetPeerFaults(peer)
+							fmt.Printf("%s - %s\n", peer, faults)
+						}
+						return nil
+					}
+					if args[0] == "clear" {
+						if len(args) == 1 {
+							tp.SetFaults(server.NetworkFaults{})
+							return nil
+						}
+						if !tp.ClearPeerFaults(args[1]) {
+							return fmt.Errorf("no faults for peer '%s'", args[1])
+						}
+						return nil
+					}
+					peer := ""
+					if !strings.Contains(args[0], "=") {
+						peer, args = args[0], args[1:]
+					}
+					faults, _ := tp.GetPeerFaults(peer)
+					faults, err := parseFaults(faults, args)
+					if err != nil {
+						return err
+					}
+					if peer == "" {
+						tp.SetFaults(faults)
+					} else {
+						tp.SetPeerFaults(peer, faults)
+					}
+					return nil
+				},
+			},
 			{
 				Catches: []string{"view_change_period", "vc"},
 				Help:    "Set the view change period",
@@ -104,9 +154,9 @@ func ServerRepl(ctx context.Context, tp *TestProperties, ir *InconsistentReplica
 				MinArgs: 0,
 				Execute: func(args []string) error {
 					fmt.Println("Active peers:")
-					for member, peer := range ir.peers {
-						fmt.Printf("peer - %s\n", member)
-						fmt.Printf("     - Last message time: %s\n", peer.conn.lastMessageTime.Format(time.RFC3339Nano))
+					for _, peer := range srv.Peers() {
+						fmt.Printf("peer - %s\n", peer.Member)
+						fmt.Printf("     - Last message time: %s\n", peer.LastMessageTime.Format(time.RFC3339Nano))
 						fmt.Printf("     - View ID: %d\n", peer.ViewID)
 					}
 					return nil
@@ -117,14 +167,128 @@ func ServerRepl(ctx context.Context, tp *TestProperties, ir *InconsistentReplica
 				Help:    "List the active members",
 				MinArgs: 0,
 				Execute: func(args []string) error {
-					fmt.Printf("Active members for view %d:\n", ir.view.currentViewID)
-					for _, member := range ir.view.members {
+					view := srv.Status().View
+					fmt.Printf("Active members for view %d:\n", view.ViewID())
+					for _, member := range view.Members() {
 						fmt.Printf("member - %s\n", member)
 					}
 					return nil
 				},
 			},
+			{
+				Catches: []string{"compact"},
+				Help:    "Truncate the IR record and collect tombstones now, and show the compaction totals",
+				MinArgs: 0,
+				Execute: func(args []string) error {
+					compaction, err := srv.Compact()
+					if err != nil {
+						return fmt.Errorf("error compacting: %w", err)
+					}
+					fmt.Printf("Compacted in %s (record truncated before view %d):\n", compaction.Duration, srv.Status().CompletedViewID)
+					fmt.Printf("     - Record entries: %d (%d bytes)\n", compaction.RecordEntries.Entries, compaction.RecordEntries.Bytes)
+					fmt.Printf("     - Tombstones: %d (%d bytes)\n", compaction.Tombstones.Entries, compaction.Tombstones.Bytes)
+					stats := srv.CompactorStats()
+					fmt.Printf("Totals over %d compactions (%d errors):\n", stats.Runs, stats.Errors)
+					fmt.Printf("     - Record entries: %d (%d bytes)\n", stats.RecordEntries.Entries, stats.RecordEntries.Bytes)
+					fmt.Printf("     - Tombstones: %d (%d bytes)\n", stats.Tombstones.Entries, stats.Tombstones.Bytes)
+					return nil
+				},
+			},
+			{
+				Catches: []string{"partition"},
+				Help:    "Block messages between peers, both ways with 'partition a,b | c' or one way with 'partition a,b -> c'; without arguments list the partitions",
+				MinArgs: 0,
+				Execute: func(args []string) error {
+					if len(args) == 0 {
+						fmt.Println("Partitions:")
+						for _, name := range tp.Partitions() {
+							fmt.Printf("partition - %s\n", name)
+						}
+						return nil
+					}
+					rule, err := server.ParsePartitionRule(strings.Join(args, " "))
+					if err != nil {
+						return err
+					}
+					// The rule is named after its normalised form, so it can be healed by typing it again
+					tp.AddPartition(rule.String(), rule)
+					fmt.Printf("Added partition '%s'\n", rule.String())
+					return nil
+				},
+			},
+			{
+				Catches: []string{"heal"},
+				Help:    "Remove every partition, or only the partition given as in 'heal a,b | c'",
+				MinArgs: 0,
+				Execute: func(args []string) error {
+					if len(args) == 0 {
+						tp.Heal()
+						return nil
+					}
+					rule, err := server.ParsePartitionRule(strings.Join(args, " "))
+					if err != nil {
+						return err
+					}
+					if !tp.RemovePartition(rule.String()) {
+						return fmt.Errorf("no partition '%s'", rule.String())
+					}
+					return nil
+				},
+			},
 		},
 	)
 	repl.Loop(ctx)
 }
+
+// parseFaults applies the key=value arguments of the faults command to the faults
+func parseFaults(faults server.NetworkFaults, args []string) (server.NetworkFaults, error) {
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return faults, fmt.Errorf("invalid fault %q, expected key=value", arg)
+		}
+		var err error
+		switch key {
+		case "latency", "jitter":
+			var ms int
+			if ms, err = strconv.Atoi(value); err == nil {
+				if key == "latency" {
+					faults.Latency = time.Duration(ms) * time.Millisecond
+				} else {
+					faults.Jitter = time.Duration(ms) * time.Millisecond
+				}
+			}
+		case "distribution":
+			faults.Distribution, err = server.ParseJitterDistribution(value)
+		case "drop":
+			faults.DropRate, err = parseRate(value)
+		case "duplicate":
+			faults.DuplicateRate, err = parseRate(value)
+		case "reorder":
+			faults.ReorderRate, err = parseRate(value)
+		case "direction":
+			faults.Direction, err = server.ParseFaultDirection(value)
+		default:
+			return faults, fmt.Errorf("unknown fault %q", key)
+		}
+		if err != nil {
+			return faults, fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	return faults, nil
+}
+
+func parseRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return rate, checkRate(rate)
+}
+
+func checkRate(rate float64) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("%g is not between 0 and 1", rate)
+	}
+	return nil
+}
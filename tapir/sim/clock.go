@@ -0,0 +1,102 @@
+package sim
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Epoch is the virtual time a simulation starts at
+var Epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Clock is virtual time, which only moves when the simulation advances it to the next timer
+type Clock struct {
+	mx     sync.Mutex
+	now    time.Time
+	timers timerHeap
+	// seq orders timers that fire at the same time by when they were created
+	seq uint64
+}
+
+type timer struct {
+	when time.Time
+	seq  uint64
+	c    chan time.Time
+}
+
+func newClock() *Clock {
+	return &Clock{now: Epoch}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+// After fires once the simulation has advanced the clock by d
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.seq++
+	heap.Push(&c.timers, &timer{when: c.now.Add(d), seq: c.seq, c: ch})
+	return ch
+}
+
+// next is the time of the earliest timer
+func (c *Clock) next() (time.Time, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if len(c.timers) == 0 {
+		return time.Time{}, false
+	}
+	return c.timers[0].when, true
+}
+
+// advance moves the clock to the time
+func (c *Clock) advance(to time.Time) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if to.After(c.now) {
+		c.now = to
+	}
+}
+
+// fire fires the earliest timer if it is due, returning false if none is
+func (c *Clock) fire() bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if len(c.timers) == 0 || c.timers[0].when.After(c.now) {
+		return false
+	}
+	t := heap.Pop(&c.timers).(*timer)
+	t.c <- c.now
+	return true
+}
+
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h timerHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *timerHeap) Push(x any) { *h = append(*h, x.(*timer)) }
+
+func (h *timerHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,66 @@
+package sim
+
+import (
+	"encoding/json"
+	"github.com/phughk/go-dist-algos/tapir/model"
+	"github.com/phughk/go-dist-algos/tapir/server"
+)
+
+// observe the running replicas for the model conformance check, if there is one
+func (s *Simulation) observe() {
+	if s.Model == nil {
+		return
+	}
+	for _, addr := range s.Replicas() {
+		r := s.replicas[addr]
+		if r.Server == nil {
+			continue
+		}
+		o, err := observation(r)
+		if err != nil {
+			s.Logf("error observing %s: %v", addr, err)
+			continue
+		}
+		s.Model.Observe(o)
+	}
+}
+
+// observation of the view and records of a replica, as the model sees them
+func observation(r *Replica) (model.Observation, error) {
+	status := r.Server.Status()
+	record, err := r.Storage.Record()
+	if err != nil {
+		return model.Observation{}, err
+	}
+	masterView, master, err := r.Storage.MasterRecord()
+	if err != nil {
+		return model.Observation{}, err
+	}
+	return model.Observation{
+		Replica:       r.Addr,
+		View:          status.View.ViewID(),
+		Changing:      status.View.ViewState.Changing != nil,
+		CompletedView: status.CompletedViewID,
+		Record:        observedEntries(record),
+		MasterView:    masterView,
+		Master:        observedEntries(master),
+	}, nil
+}
+
+func observedEntries(entries []server.RecordEntry) map[string]model.ObservedEntry {
+	observed := make(map[string]model.ObservedEntry, len(entries))
+	for _, entry := range entries {
+		// Maps are marshalled in key order, so equal results have equal JSON
+		result, _ := json.Marshal(struct {
+			ReadValues  map[string]string
+			ScanResults any
+			Error       any
+		}{entry.ReadValues, entry.ScanResults, entry.Error})
+		observed[entry.ID] = model.ObservedEntry{
+			View:      entry.ViewID,
+			Finalized: entry.State == server.Finalized,
+			Result:    string(result),
+		}
+	}
+	return observed
+}
@@ -0,0 +1,398 @@
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Network is an in-memory network. Writes are queued on the link between two hosts until the simulation
+// delivers them, in order, so that it chooses how the messages of different connections interleave.
+type Network struct {
+	mx        sync.Mutex
+	listeners map[string]*listener
+	links     map[string]*link
+	// down hosts have crashed, they can't be connected to
+	down map[string]bool
+	// groups of the current partition by host, hosts in different groups can't reach each other
+	groups map[string]int
+	// dials counts the connections between each pair of hosts, to name the links
+	dials map[string]int
+	// settle is called after each connection is reset, so that the simulation can wait for the goroutines reading
+	// from it before the next one is
+	settle func()
+}
+
+// link is one direction of a connection
+type link struct {
+	name     string
+	from, to string
+	src, dst *endpoint
+	reverse  *link
+	pending  []packet
+}
+
+type packet struct {
+	data []byte
+	// fin closes the connection after the data before it has been read
+	fin bool
+}
+
+func newNetwork(settle func()) *Network {
+	return &Network{
+		listeners: make(map[string]*listener),
+		links:     make(map[string]*link),
+		down:      make(map[string]bool),
+		dials:     make(map[string]int),
+		settle:    settle,
+	}
+}
+
+// Host is the network seen from the host with the address, which is where the connections it dials come from
+func (n *Network) Host(addr string) *Host {
+	return &Host{network: n, addr: addr}
+}
+
+// Crash disconnects the host, closing its listener and resetting its connections, until it is restarted
+func (n *Network) Crash(host string) {
+	n.mx.Lock()
+	n.down[host] = true
+	if l, ok := n.listeners[host]; ok {
+		l.close()
+		delete(n.listeners, host)
+	}
+	unreachable := n.unreachable()
+	n.mx.Unlock()
+	n.reset(unreachable)
+}
+
+// Restart lets the host listen and connect again
+func (n *Network) Restart(host string) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	delete(n.down, host)
+}
+
+// Partition splits the hosts into groups that can't reach each other, resetting the connections between them.
+// Hosts that aren't in any group can reach every host.
+func (n *Network) Partition(groups [][]string) {
+	n.mx.Lock()
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, host := range group {
+			n.groups[host] = i
+		}
+	}
+	unreachable := n.unreachable()
+	n.mx.Unlock()
+	n.reset(unreachable)
+}
+
+// Heal removes the partition
+func (n *Network) Heal() {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	n.groups = nil
+}
+
+// Partitioned is true if there is a partition
+func (n *Network) Partitioned() bool {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	return n.groups != nil
+}
+
+func (n *Network) reachable(from string, to string) bool {
+	if n.down[from] || n.down[to] {
+		return false
+	}
+	fromGroup, fromOk := n.groups[from]
+	toGroup, toOk := n.groups[to]
+	return !fromOk || !toOk || fromGroup == toGroup
+}
+
+// unreachable removes the links between hosts that can no longer reach each other, dropping the packets that haven't
+// been delivered, and returns the links in order so that their endpoints can be reset
+func (n *Network) unreachable() []*link {
+	var names []string
+	for name, l := range n.links {
+		if !n.reachable(l.from, l.to) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	links := make([]*link, 0, len(names))
+	for _, name := range names {
+		links = append(links, n.links[name])
+	}
+	for _, l := range links {
+		delete(n.links, l.name)
+	}
+	return links
+}
+
+// reset the endpoints that receive from the links one at a time, waking the goroutine reading from each
+func (n *Network) reset(links []*link) {
+	for _, l := range links {
+		l.dst.reset()
+		n.settle()
+	}
+}
+
+func (n *Network) dial(from string, to string) (net.Conn, error) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	l, ok := n.listeners[to]
+	if !ok || !n.reachable(from, to) {
+		return nil, fmt.Errorf("dial %s: connection refused", to)
+	}
+	pair := from + "->" + to
+	n.dials[pair]++
+	id := n.dials[pair]
+	client := &endpoint{network: n, local: simAddr(fmt.Sprintf("%s#%d", from, id)), remote: simAddr(to)}
+	server := &endpoint{network: n, local: simAddr(to), remote: client.local}
+	client.cond = sync.NewCond(&client.mx)
+	server.cond = sync.NewCond(&server.mx)
+	out := &link{name: fmt.Sprintf("%s/%d", pair, id), from: from, to: to, src: client, dst: server}
+	in := &link{name: fmt.Sprintf("%s->%s/%d", to, from, id), from: to, to: from, src: server, dst: client, reverse: out}
+	out.reverse = in
+	client.out, server.out = out, in
+	n.links[out.name] = out
+	n.links[in.name] = in
+	l.accept(server)
+	return client, nil
+}
+
+// pendingLinks are the names of the links with packets to deliver, in a stable order
+func (n *Network) pendingLinks() []string {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	names := make([]string, 0, len(n.links))
+	for name, l := range n.links {
+		if len(l.pending) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deliver the next packet of the link
+func (n *Network) deliver(name string) packet {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	l, ok := n.links[name]
+	if !ok || len(l.pending) == 0 {
+		return packet{}
+	}
+	p := l.pending[0]
+	l.pending = l.pending[1:]
+	if p.fin {
+		delete(n.links, name)
+	}
+	l.dst.receive(p)
+	return p
+}
+
+func (n *Network) send(l *link, p packet) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	if _, ok := n.links[l.name]; !ok {
+		// The connection was reset, the data is lost like in a send buffer of a reset TCP connection
+		return
+	}
+	l.pending = append(l.pending, p)
+}
+
+// Host implements protocol.Network for one host of the simulated network
+type Host struct {
+	network *Network
+	addr    string
+}
+
+// Listen accepts connections to the host, addr must be the address of the host
+func (h *Host) Listen(addr string) (net.Listener, error) {
+	if addr != h.addr {
+		return nil, fmt.Errorf("listen %s: host %s can only listen on its own address", addr, h.addr)
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	h.network.mx.Lock()
+	defer h.network.mx.Unlock()
+	if h.network.down[addr] {
+		return nil, fmt.Errorf("listen %s: host is down", addr)
+	}
+	if _, ok := h.network.listeners[addr]; ok {
+		return nil, fmt.Errorf("listen %s: address already in use", addr)
+	}
+	l := &listener{network: h.network, addr: tcpAddr, name: addr}
+	l.cond = sync.NewCond(&l.mx)
+	h.network.listeners[addr] = l
+	return l, nil
+}
+
+func (h *Host) Dial(addr string) (net.Conn, error) {
+	return h.network.dial(h.addr, addr)
+}
+
+type listener struct {
+	network *Network
+	addr    *net.TCPAddr
+	name    string
+	mx      sync.Mutex
+	cond    *sync.Cond
+	backlog []*endpoint
+	done    bool
+}
+
+func (l *listener) accept(e *endpoint) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.backlog = append(l.backlog, e)
+	l.cond.Broadcast()
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	for len(l.backlog) == 0 && !l.done {
+		l.cond.Wait()
+	}
+	if l.done {
+		return nil, net.ErrClosed
+	}
+	e := l.backlog[0]
+	l.backlog = l.backlog[1:]
+	return e, nil
+}
+
+// close stops accepting, the caller holds the network lock
+func (l *listener) close() {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.done = true
+	l.cond.Broadcast()
+}
+
+func (l *listener) Close() error {
+	l.network.mx.Lock()
+	defer l.network.mx.Unlock()
+	if l.network.listeners[l.name] == l {
+		delete(l.network.listeners, l.name)
+	}
+	l.close()
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// endpoint is one end of a connection
+type endpoint struct {
+	network *Network
+	out     *link
+	local   net.Addr
+	remote  net.Addr
+	mx      sync.Mutex
+	cond    *sync.Cond
+	inbox   bytes.Buffer
+	// eof is set when the peer closed the connection or it was reset, reads fail once the inbox is empty
+	eof bool
+	// closed is set when this end closed the connection, writes fail
+	closed bool
+}
+
+func (e *endpoint) receive(p packet) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	if p.fin {
+		e.eof = true
+	} else if !e.closed {
+		e.inbox.Write(p.data)
+	}
+	e.cond.Broadcast()
+}
+
+func (e *endpoint) reset() {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	e.eof = true
+	e.inbox.Reset()
+	e.cond.Broadcast()
+}
+
+func (e *endpoint) Read(b []byte) (int, error) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	for e.inbox.Len() == 0 && !e.eof && !e.closed {
+		e.cond.Wait()
+	}
+	if e.inbox.Len() == 0 {
+		return 0, io.EOF
+	}
+	return e.inbox.Read(b)
+}
+
+func (e *endpoint) Write(b []byte) (int, error) {
+	e.mx.Lock()
+	closed := e.closed
+	e.mx.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	e.network.send(e.out, packet{data: bytes.Clone(b)})
+	return len(b), nil
+}
+
+func (e *endpoint) Close() error {
+	e.mx.Lock()
+	if e.closed {
+		e.mx.Unlock()
+		return nil
+	}
+	e.closed = true
+	e.cond.Broadcast()
+	e.mx.Unlock()
+	e.network.send(e.out, packet{fin: true})
+	return nil
+}
+
+func (e *endpoint) LocalAddr() net.Addr {
+	return e.local
+}
+
+func (e *endpoint) RemoteAddr() net.Addr {
+	return e.remote
+}
+
+// Deadlines are not supported, timeouts are measured by the virtual clock instead
+
+func (e *endpoint) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (e *endpoint) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (e *endpoint) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// simAddr is the address of a host on the simulated network
+type simAddr string
+
+func (a simAddr) Network() string {
+	return "sim"
+}
+
+func (a simAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,53 @@
+package sim
+
+import (
+	"bytes"
+	"path"
+	"reflect"
+	"runtime"
+)
+
+// modulePrefix is how the traceback of a goroutine names the functions of this module, the goroutines the replicas
+// and clients start are created by one of them
+var modulePrefix = []byte("created by " + path.Dir(reflect.TypeOf(Simulation{}).PkgPath()) + "/")
+
+// busyStates are the states a goroutine is in when it isn't waiting on a channel, lock or connection
+var busyStates = map[string]bool{
+	"running":   true,
+	"runnable":  true,
+	"syscall":   true,
+	"preempted": true,
+	"copystack": true,
+}
+
+// quiescent is true if every goroutine created by the replicas and clients is waiting, which is when they finished
+// reacting to the last step. Only the Go runtime knows whether a goroutine is waiting, so this reads the states from
+// the traceback of every goroutine.
+func quiescent(buf []byte) ([]byte, bool) {
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	// The first goroutine is the one taking the steps
+	goroutines := bytes.Split(buf, []byte("\n\n"))
+	for _, g := range goroutines[1:] {
+		if busy(g) && bytes.Contains(g, modulePrefix) {
+			return buf[:cap(buf)], false
+		}
+	}
+	return buf[:cap(buf)], true
+}
+
+// busy is true if the state in the header of the traceback, "goroutine 1 [chan receive, 2 minutes]:", is a busy state
+func busy(traceback []byte) bool {
+	start := bytes.IndexByte(traceback, '[')
+	end := bytes.IndexAny(traceback, ",]")
+	if start < 0 || end < start {
+		return false
+	}
+	return busyStates[string(traceback[start+1:end])]
+}
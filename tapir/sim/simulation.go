@@ -0,0 +1,333 @@
+// Package sim runs replicas and clients of a TAPIR cluster in one process on a simulated network and a virtual
+// clock, so that an interleaving of messages, view changes, drops and crashes can be reproduced from a seed.
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/client"
+	"github.com/phughk/go-dist-algos/tapir/model"
+	"github.com/phughk/go-dist-algos/tapir/server"
+	"github.com/sirupsen/logrus"
+	"math/rand"
+	"regexp"
+	"runtime"
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultDeliveryProbability is the chance of delivering a packet rather than firing the next timer
+	DefaultDeliveryProbability = 0.9
+	// DefaultMaxSteps is how many steps Do takes before giving up on the function returning
+	DefaultMaxSteps = 100000
+)
+
+// ErrStuck is returned by Do when the function did not return within MaxSteps
+var ErrStuck = errors.New("simulation did not finish")
+
+// idPattern matches the random IDs of clients, transactions and requests
+var idPattern = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+
+// Simulation is a cluster whose messages and timers are run one step at a time, in an order chosen by a random
+// number generator seeded with the seed.
+//
+// Each step wakes one goroutine of the replicas and clients, and the simulation waits until every one of them is blocked
+// again before taking the next step, see quiescent. Time only passes on the virtual clock, so a run with the same seed
+// takes the same steps and has the same trace.
+type Simulation struct {
+	Seed int64
+	// DeliveryProbability is the chance of delivering a packet rather than firing the next timer when both are
+	// possible, lower values make timeouts more likely
+	DeliveryProbability float64
+	// MaxSteps is how many steps Do takes before giving up on the function returning
+	MaxSteps int
+	// Config is the base configuration of the replicas, the address, members, storage, network and clock are set
+	// by the simulation
+	Config server.Config
+	// Faults are injected into the connections of every replica, including replicas that restart
+	Faults server.NetworkFaults
+	// Model checks the transitions of the replicas against the model of IR between steps when set
+	Model    *model.Conformance
+	ctx      context.Context
+	rand     *rand.Rand
+	clock    *Clock
+	network  *Network
+	replicas map[string]*Replica
+	steps    int
+	trace    []string
+	// ids are the names of the random IDs in the trace
+	ids map[string]string
+	// stacks is the buffer the tracebacks of the goroutines are read into
+	stacks []byte
+}
+
+// Replica is a replica of the simulated cluster, its storage survives crashes
+type Replica struct {
+	Addr    string
+	Members []string
+	Storage server.StorageEngine
+	// Server is nil while the replica is crashed
+	Server *server.Server
+	cancel context.CancelFunc
+}
+
+func New(ctx context.Context, seed int64) *Simulation {
+	s := &Simulation{
+		Seed:                seed,
+		DeliveryProbability: DefaultDeliveryProbability,
+		MaxSteps:            DefaultMaxSteps,
+		ctx:                 ctx,
+		rand:                rand.New(rand.NewSource(seed)),
+		replicas:            make(map[string]*Replica),
+		ids:                 make(map[string]string),
+		stacks:              make([]byte, 64<<10),
+	}
+	s.clock = newClock()
+	s.network = newNetwork(s.settle)
+	return s
+}
+
+// Rand is the random number generator of the simulation, workloads should use it to stay reproducible
+func (s *Simulation) Rand() *rand.Rand {
+	return s.rand
+}
+
+func (s *Simulation) Clock() *Clock {
+	return s.clock
+}
+
+func (s *Simulation) Network() *Network {
+	return s.network
+}
+
+// Elapsed is the virtual time since the simulation started
+func (s *Simulation) Elapsed() time.Duration {
+	return s.clock.Now().Sub(Epoch)
+}
+
+// Trace is a line for each step and failure of the simulation
+func (s *Simulation) Trace() []string {
+	return s.trace
+}
+
+// Steps taken so far
+func (s *Simulation) Steps() int {
+	return s.steps
+}
+
+// Logf adds a line to the trace. IDs are random, so they are named by the order they first appear in.
+func (s *Simulation) Logf(format string, args ...any) {
+	line := fmt.Sprintf("%6d %12s ", s.steps, s.Elapsed()) + fmt.Sprintf(format, args...)
+	line = idPattern.ReplaceAllStringFunc(line, func(id string) string {
+		if _, ok := s.ids[id]; !ok {
+			s.ids[id] = fmt.Sprintf("id-%d", len(s.ids)+1)
+		}
+		return s.ids[id]
+	})
+	logrus.Debugf("sim: %s", line)
+	s.trace = append(s.trace, line)
+}
+
+// Replicas are the addresses of the replicas in order
+func (s *Simulation) Replicas() []string {
+	addrs := make([]string, 0, len(s.replicas))
+	for addr := range s.replicas {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Replica by address, nil if there isn't one
+func (s *Simulation) Replica(addr string) *Replica {
+	return s.replicas[addr]
+}
+
+// AddReplica starts a replica with in-memory storage, addr must be an IP address and port
+func (s *Simulation) AddReplica(addr string, members []string) (*Replica, error) {
+	if _, ok := s.replicas[addr]; ok {
+		return nil, fmt.Errorf("replica %s already exists", addr)
+	}
+	r := &Replica{
+		Addr:    addr,
+		Members: append([]string(nil), members...),
+		Storage: server.NewMemoryStorageEngine(),
+	}
+	if err := s.start(r); err != nil {
+		return nil, err
+	}
+	s.replicas[addr] = r
+	s.Logf("start %s", addr)
+	return r, nil
+}
+
+func (s *Simulation) start(r *Replica) error {
+	config := s.Config
+	config.ListenAddress = r.Addr
+	config.Members = r.Members
+	config.Storage = r.Storage
+	config.Network = s.network.Host(r.Addr)
+	config.Clock = s.clock
+	ctx, cancel := context.WithCancel(s.ctx)
+	srv := server.New(config)
+	if err := srv.Start(ctx); err != nil {
+		cancel()
+		return err
+	}
+	srv.TestProperties().SetFaults(s.Faults)
+	r.Server = srv
+	r.cancel = cancel
+	return nil
+}
+
+// Crash stops the replica without shutting it down, its connections are reset and in-flight messages are lost
+func (s *Simulation) Crash(addr string) error {
+	r, ok := s.replicas[addr]
+	if !ok || r.Server == nil {
+		return fmt.Errorf("replica %s is not running", addr)
+	}
+	s.network.Crash(addr)
+	r.cancel()
+	s.settle()
+	r.Server = nil
+	s.Logf("crash %s", addr)
+	return nil
+}
+
+// Restart starts a crashed replica again with the storage it had when it crashed
+func (s *Simulation) Restart(addr string) error {
+	r, ok := s.replicas[addr]
+	if !ok || r.Server != nil {
+		return fmt.Errorf("replica %s is not crashed", addr)
+	}
+	s.network.Restart(addr)
+	if err := s.start(r); err != nil {
+		return err
+	}
+	if s.Model != nil {
+		s.Model.Restarted(addr)
+	}
+	s.Logf("restart %s", addr)
+	return nil
+}
+
+// Partition splits the hosts into groups that can't reach each other
+func (s *Simulation) Partition(groups ...[]string) {
+	s.network.Partition(groups)
+	s.Logf("partition %v", groups)
+}
+
+// Heal removes the partition
+func (s *Simulation) Heal() {
+	s.network.Heal()
+	s.Logf("heal")
+}
+
+// Dial connects a client with the name to the replicas
+func (s *Simulation) Dial(name string, addrs []string) (*client.Client, error) {
+	c, err := client.DialNetwork(s.ctx, s.network.Host(name), s.clock, addrs)
+	if err != nil {
+		return nil, err
+	}
+	s.settle()
+	return c, nil
+}
+
+// Step delivers a packet or advances the clock to the next timer, returning false if there was nothing to do
+func (s *Simulation) Step() bool {
+	return s.step(time.Time{})
+}
+
+// step is Step ignoring timers after the limit, unless it is zero
+func (s *Simulation) step(limit time.Time) bool {
+	s.settle()
+	s.observe()
+	links := s.network.pendingLinks()
+	next, hasTimer := s.clock.next()
+	if hasTimer && !limit.IsZero() && next.After(limit) {
+		hasTimer = false
+	}
+	if len(links) == 0 && !hasTimer {
+		return false
+	}
+	s.steps++
+	if len(links) > 0 && (!hasTimer || s.rand.Float64() < s.DeliveryProbability) {
+		name := links[s.rand.Intn(len(links))]
+		if p := s.network.deliver(name); p.fin {
+			s.Logf("close %s", name)
+		} else {
+			s.Logf("deliver %s (%d bytes)", name, len(p.data))
+		}
+		s.settle()
+	} else {
+		// Timers are fired one at a time, so that the goroutines waiting on them run in the order they were created
+		s.clock.advance(next)
+		fired := 0
+		for s.clock.fire() {
+			fired++
+			s.settle()
+		}
+		s.Logf("timers %d", fired)
+	}
+	return true
+}
+
+// Run takes steps until the virtual time has advanced by d
+func (s *Simulation) Run(d time.Duration) {
+	until := s.clock.Now().Add(d)
+	for s.clock.Now().Before(until) {
+		if !s.step(until) {
+			s.clock.advance(until)
+		}
+	}
+	s.settle()
+	s.observe()
+}
+
+// Do calls the function, taking steps until it returns
+func (s *Simulation) Do(fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	s.settle()
+	for i := 0; i < s.MaxSteps; i++ {
+		select {
+		case err := <-done:
+			return err
+		default:
+		}
+		if !s.Step() {
+			// Nothing to deliver or fire, so nothing can wake the function up
+			break
+		}
+	}
+	select {
+	case err := <-done:
+		return err
+	default:
+		return ErrStuck
+	}
+}
+
+// Close crashes every replica, the simulation can't be used afterwards
+func (s *Simulation) Close() {
+	for _, addr := range s.Replicas() {
+		if s.replicas[addr].Server != nil {
+			_ = s.Crash(addr)
+		}
+	}
+}
+
+// settle waits until the goroutines of the replicas and clients stopped reacting to the last step
+func (s *Simulation) settle() {
+	for {
+		var done bool
+		if s.stacks, done = quiescent(s.stacks); done {
+			return
+		}
+		runtime.Gosched()
+	}
+}
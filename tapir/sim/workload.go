@@ -0,0 +1,288 @@
+package sim
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/client"
+	"github.com/phughk/go-dist-algos/tapir/history"
+	"github.com/phughk/go-dist-algos/tapir/model"
+	"github.com/phughk/go-dist-algos/tapir/server"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	// counterKey is incremented by the transactions of the workload
+	counterKey = "counter"
+	// checkAttempts is how many times the counter is read after recovering before giving up
+	checkAttempts = 10
+)
+
+// Options of a randomised workload, each iteration fails something or runs a transaction
+type Options struct {
+	Seed     int64
+	Replicas int
+	// Duration of virtual time to run the workload for
+	Duration time.Duration
+	// CrashProbability is the chance of each iteration crashing or restarting a replica
+	CrashProbability float64
+	// PartitionProbability is the chance of each iteration partitioning or healing the network
+	PartitionProbability float64
+	// DropProbability is the chance of each iteration dropping the next few messages to a replica
+	DropProbability float64
+	// Faults are injected into the connections of every replica
+	Faults server.NetworkFaults
+	// History receives the history of the transactions when set, the history is checked either way
+	History io.Writer
+	// Model checks the transitions of the replicas against the model of IR
+	Model bool
+}
+
+// Result of a workload. Transactions that failed after sending the commit may or may not have committed, so
+// the final counter must be between Committed and Committed+Unknown.
+type Result struct {
+	Steps     int
+	Elapsed   time.Duration
+	Committed int
+	Aborted   int
+	// Failed transactions did not get as far as committing
+	Failed  int
+	Unknown int
+	Final   int
+	// Violations of the expected outcome, including the anomalies the history checker found
+	Violations []string
+	// ModelViolations are the transitions of the replicas the model of IR doesn't allow
+	ModelViolations []model.Violation
+	Trace           []string
+}
+
+// RunWorkload runs a cluster of replicas and a client incrementing a counter while replicas crash and restart,
+// the network partitions and heals and messages are dropped, all chosen by the seed
+func RunWorkload(ctx context.Context, opts Options) (*Result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s := New(ctx, opts.Seed)
+	s.Faults = opts.Faults
+	if opts.Model {
+		s.Model = model.NewConformance()
+	}
+	defer s.Close()
+	members := make([]string, opts.Replicas)
+	for i := range members {
+		members[i] = fmt.Sprintf("10.0.0.%d:7000", i+1)
+	}
+	for _, addr := range members {
+		if _, err := s.AddReplica(addr, members); err != nil {
+			return nil, err
+		}
+	}
+	// Let the replicas connect and agree on a view
+	s.Run(3 * server.DefaultViewChangePeriod)
+	var recorded bytes.Buffer
+	var recorder *history.Recorder
+	if opts.History != nil {
+		recorder = history.NewRecorder(io.MultiWriter(&recorded, opts.History))
+	} else {
+		recorder = history.NewRecorder(&recorded)
+	}
+	c, err := s.Dial("client", members)
+	if err != nil {
+		return nil, err
+	}
+	c.History = recorder
+	w := &workload{s: s, opts: opts, members: members, client: c, result: &Result{}}
+	for s.Elapsed() < opts.Duration {
+		w.iteration()
+		s.Run(time.Duration(s.Rand().Int63n(int64(500 * time.Millisecond))))
+	}
+	// Recover from every failure and check the counter
+	s.Heal()
+	for _, addr := range members {
+		if s.Replica(addr).Server == nil {
+			if err := s.Restart(addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	s.Run(3 * server.DefaultViewChangePeriod)
+	w.redial()
+	w.check()
+	w.client.Close()
+	if err := recorder.Err(); err != nil {
+		return nil, err
+	}
+	events, err := history.Read(&recorded)
+	if err != nil {
+		return nil, err
+	}
+	for _, anomaly := range history.Check(events, history.Options{}).Anomalies {
+		w.result.Violations = append(w.result.Violations, anomaly.String())
+	}
+	if s.Model != nil {
+		w.result.ModelViolations = s.Model.Violations()
+	}
+	w.result.Steps = s.Steps()
+	w.result.Elapsed = s.Elapsed()
+	w.result.Trace = s.Trace()
+	return w.result, nil
+}
+
+type workload struct {
+	s       *Simulation
+	opts    Options
+	members []string
+	client  *client.Client
+	crashed []string
+	result  *Result
+}
+
+func (w *workload) iteration() {
+	r := w.s.Rand().Float64()
+	switch {
+	case r < w.opts.CrashProbability:
+		// Restart a replica, or crash one while a majority is still running
+		if len(w.crashed) > 0 && (len(w.crashed) >= (len(w.members)-1)/2 || w.s.Rand().Intn(2) == 0) {
+			i := w.s.Rand().Intn(len(w.crashed))
+			addr := w.crashed[i]
+			if err := w.s.Restart(addr); err != nil {
+				w.s.Logf("error restarting %s: %v", addr, err)
+				return
+			}
+			w.crashed = append(w.crashed[:i], w.crashed[i+1:]...)
+			w.s.Run(server.DefaultViewChangePeriod)
+			w.redial()
+		} else if len(w.crashed) < (len(w.members)-1)/2 {
+			addr := w.running()[w.s.Rand().Intn(len(w.running()))]
+			if err := w.s.Crash(addr); err == nil {
+				w.crashed = append(w.crashed, addr)
+			}
+		}
+	case r < w.opts.CrashProbability+w.opts.PartitionProbability:
+		if w.s.Network().Partitioned() {
+			w.s.Heal()
+			w.s.Run(server.DefaultViewChangePeriod)
+			w.redial()
+		} else if len(w.members) > 2 {
+			// Cut off a minority, the client stays with the majority
+			shuffled := append([]string(nil), w.members...)
+			w.s.Rand().Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+			minority := 1 + w.s.Rand().Intn((len(w.members)-1)/2)
+			w.s.Partition(shuffled[:minority], append(shuffled[minority:], "client"))
+		}
+	case r < w.opts.CrashProbability+w.opts.PartitionProbability+w.opts.DropProbability:
+		running := w.running()
+		addr := running[w.s.Rand().Intn(len(running))]
+		count := 1 + w.s.Rand().Intn(3)
+		if w.s.Rand().Intn(2) == 0 {
+			w.s.Replica(addr).Server.TestProperties().AddDropClient(count)
+			w.s.Logf("drop %d client messages to %s", count, addr)
+		} else {
+			w.s.Replica(addr).Server.TestProperties().AddDropReplica(count)
+			w.s.Logf("drop %d replica messages to %s", count, addr)
+		}
+	default:
+		w.increment()
+	}
+}
+
+// running replicas in order
+func (w *workload) running() []string {
+	running := make([]string, 0, len(w.members))
+	for _, addr := range w.members {
+		if w.s.Replica(addr).Server != nil {
+			running = append(running, addr)
+		}
+	}
+	return running
+}
+
+// redial replaces the client so that it is connected to replicas that were restarted or reachable again
+func (w *workload) redial() {
+	c, err := w.s.Dial("client", w.members)
+	if err != nil {
+		w.s.Logf("keeping the old client: %v", err)
+		return
+	}
+	c.History = w.client.History
+	w.client.Close()
+	w.client = c
+}
+
+func (w *workload) increment() {
+	committing := false
+	err := w.s.Do(func() error {
+		txn := w.client.Begin()
+		defer txn.Abort()
+		value, err := txn.Get(counterKey)
+		if err != nil {
+			return err
+		}
+		n := 0
+		if value != "" {
+			if n, err = strconv.Atoi(value); err != nil {
+				return err
+			}
+		}
+		if err := txn.Put(counterKey, strconv.Itoa(n+1)); err != nil {
+			return err
+		}
+		committing = true
+		return txn.Commit()
+	})
+	switch {
+	case err == nil:
+		w.result.Committed++
+		w.s.Logf("increment committed")
+	case errors.Is(err, client.ErrAborted):
+		w.result.Aborted++
+		w.s.Logf("increment aborted: %v", err)
+	case !committing:
+		w.result.Failed++
+		w.s.Logf("increment failed: %v", err)
+	default:
+		w.result.Unknown++
+		w.s.Logf("increment unknown: %v", err)
+	}
+}
+
+// check reads the counter after recovering, and compares it with the outcomes of the transactions
+func (w *workload) check() {
+	var value string
+	var err error
+	// Reads fail while a view change is in progress and abort if a replica was behind, so give the cluster a few view
+	// change periods to settle
+	for attempt := 0; attempt < checkAttempts; attempt++ {
+		err = w.s.Do(func() error {
+			txn := w.client.Begin()
+			defer txn.Abort()
+			var err error
+			if value, err = txn.Get(counterKey); err != nil {
+				return err
+			}
+			// Committing validates that the value read was not stale
+			return txn.Commit()
+		})
+		if err == nil {
+			break
+		}
+		w.s.Logf("error reading the counter: %v", err)
+		w.s.Run(server.DefaultViewChangePeriod)
+	}
+	if err != nil {
+		w.result.Violations = append(w.result.Violations, fmt.Sprintf("error reading the counter after recovering: %v", err))
+		return
+	}
+	if value != "" {
+		if w.result.Final, err = strconv.Atoi(value); err != nil {
+			w.result.Violations = append(w.result.Violations, fmt.Sprintf("invalid counter %q", value))
+			return
+		}
+	}
+	if w.result.Final < w.result.Committed || w.result.Final > w.result.Committed+w.result.Unknown {
+		w.result.Violations = append(w.result.Violations, fmt.Sprintf("counter is %d, expected between %d committed and %d including unknown outcomes",
+			w.result.Final, w.result.Committed, w.result.Committed+w.result.Unknown))
+	}
+}
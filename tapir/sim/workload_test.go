@@ -0,0 +1,77 @@
+package sim
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// regressionSeeds run the workload of `tapir simulate --model`. They crash, partition and drop messages during view
+// changes in ways that found violations, for example seed 4 made the client decide a success on the slow path that
+// only a minority of the replicas returned, and seed 29 left a replica changing views until the end of the run.
+var regressionSeeds = []int64{1, 3, 4, 8, 9, 10, 11, 29}
+
+// regressionOptions are the options of `tapir simulate --model` for the seed
+func regressionOptions(seed int64) Options {
+	return Options{
+		Seed:                 seed,
+		Replicas:             3,
+		Duration:             20 * time.Second,
+		CrashProbability:     0.05,
+		PartitionProbability: 0.05,
+		DropProbability:      0.05,
+		Model:                true,
+	}
+}
+
+func TestRegressionSeeds(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulating seeds takes seconds each")
+	}
+	for _, seed := range regressionSeeds {
+		seed := seed
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			t.Parallel()
+			result, err := RunWorkload(context.Background(), regressionOptions(seed))
+			if err != nil {
+				t.Fatalf("seed %d: %v", seed, err)
+			}
+			for _, violation := range result.Violations {
+				t.Errorf("seed %d: %s", seed, violation)
+			}
+			for _, violation := range result.ModelViolations {
+				t.Errorf("seed %d: model violation %+v", seed, violation)
+			}
+			if result.Committed == 0 {
+				t.Errorf("seed %d: no transaction committed in %s of virtual time", seed, result.Elapsed)
+			}
+		})
+	}
+}
+
+// TestDeterministic runs a seed that crashes, partitions and changes views twice, and checks that both runs have the
+// same trace
+func TestDeterministic(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulating seeds takes seconds each")
+	}
+	var traces [2][]string
+	for i := range traces {
+		result, err := RunWorkload(context.Background(), regressionOptions(9))
+		if err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+		traces[i] = result.Trace
+	}
+	if strings.Join(traces[0], "\n") == strings.Join(traces[1], "\n") {
+		return
+	}
+	for i := 0; i < len(traces[0]) && i < len(traces[1]); i++ {
+		if traces[0][i] != traces[1][i] {
+			t.Fatalf("runs diverged at line %d of the trace:\n%s\n%s", i+1, traces[0][i], traces[1][i])
+		}
+	}
+	t.Fatalf("traces have %d and %d lines", len(traces[0]), len(traces[1]))
+}
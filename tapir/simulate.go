@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/server"
+	"github.com/phughk/go-dist-algos/tapir/sim"
+	"github.com/urfave/cli/v2"
+	"os"
+)
+
+// simulate runs a randomised workload on a simulated cluster and checks the outcome
+func simulate(c *cli.Context) error {
+	opts := sim.Options{
+		Seed:                 c.Int64("seed"),
+		Replicas:             c.Int("replicas"),
+		Duration:             c.Duration("duration"),
+		CrashProbability:     c.Float64("crash"),
+		PartitionProbability: c.Float64("partition"),
+		DropProbability:      c.Float64("drop"),
+		Faults: server.NetworkFaults{
+			Latency:       c.Duration("latency"),
+			Jitter:        c.Duration("jitter"),
+			DropRate:      c.Float64("loss"),
+			DuplicateRate: c.Float64("duplicate"),
+			ReorderRate:   c.Float64("reorder"),
+		},
+		Model: c.Bool("model"),
+	}
+	if path := c.String("history"); path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("error creating history file: %w", err)
+		}
+		defer file.Close()
+		opts.History = file
+	}
+	result, err := sim.RunWorkload(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	if c.Bool("trace") {
+		for _, line := range result.Trace {
+			fmt.Println(line)
+		}
+	}
+	fmt.Printf("Seed %d: %d steps in %s of virtual time\n", c.Int64("seed"), result.Steps, result.Elapsed)
+	fmt.Printf("Transactions: %d committed, %d aborted, %d failed, %d unknown, counter %d\n",
+		result.Committed, result.Aborted, result.Failed, result.Unknown, result.Final)
+	printModelViolations(result.ModelViolations)
+	if len(result.Violations) > 0 {
+		for _, violation := range result.Violations {
+			fmt.Printf("Violation: %s\n", violation)
+		}
+		return fmt.Errorf("seed %d found %d violations", c.Int64("seed"), len(result.Violations))
+	}
+	if len(result.ModelViolations) > 0 {
+		return fmt.Errorf("seed %d found %d violations of the model", c.Int64("seed"), len(result.ModelViolations))
+	}
+	return nil
+}
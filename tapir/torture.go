@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/torture"
+	"github.com/urfave/cli/v2"
+	"os"
+	"sort"
+	"time"
+)
+
+// runTorture runs randomised workloads on a local cluster of replica processes while a nemesis injects faults
+func runTorture(c *cli.Context) error {
+	binary, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error finding the tapir executable: %w", err)
+	}
+	seed := c.Int64("seed")
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	opts := torture.Options{
+		Binary:          binary,
+		Dir:             c.String("dir"),
+		Replicas:        c.Int("replicas"),
+		BasePort:        c.Int("base-port"),
+		Duration:        c.Duration("duration"),
+		Concurrency:     c.Int("concurrency"),
+		Workloads:       c.StringSlice("workload"),
+		Nemeses:         nemeses(c.StringSlice("nemesis")),
+		NemesisInterval: c.Duration("nemesis-interval"),
+		Seed:            seed,
+		Realtime:        c.Bool("realtime"),
+	}
+	if path := c.String("history"); path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("error creating history file: %w", err)
+		}
+		defer file.Close()
+		opts.History = file
+	}
+	result, err := torture.Run(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Seed %d, replica databases and logs are in %s\n", seed, result.Dir)
+	fmt.Println("Nemesis:")
+	for _, line := range result.Timeline {
+		fmt.Printf("     %s\n", line)
+	}
+	workloads := make([]string, 0, len(result.Transactions))
+	for workload := range result.Transactions {
+		workloads = append(workloads, workload)
+	}
+	sort.Strings(workloads)
+	fmt.Println("Transactions:")
+	for _, workload := range workloads {
+		counts := result.Transactions[workload]
+		fmt.Printf("     %s: %d committed, %d failed, %d unknown\n", workload, counts.Ok, counts.Fail, counts.Info)
+	}
+	printCheckReport(result.Check)
+	for _, violation := range result.Violations {
+		fmt.Printf("Violation: %s\n", violation)
+	}
+	if !result.Valid() {
+		return fmt.Errorf("seed %d found %d violations and %d anomalies", seed, len(result.Violations), len(result.Check.Anomalies))
+	}
+	fmt.Println("No violations or anomalies found")
+	return nil
+}
+
+// nemeses without "none", which disables the nemesis
+func nemeses(values []string) []string {
+	nemeses := make([]string, 0, len(values))
+	for _, value := range values {
+		if value != "none" {
+			nemeses = append(nemeses, value)
+		}
+	}
+	return nemeses
+}
@@ -0,0 +1,186 @@
+package torture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/client"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stopTimeout is how long a replica has to shut down after its REPL is closed before it is killed
+const stopTimeout = 10 * time.Second
+
+// cluster of replica processes listening on loopback ports
+type cluster struct {
+	binary   string
+	members  []string
+	replicas []*replica
+	// generation increases whenever a replica starts, so that clients know to reconnect
+	generation atomic.Int64
+}
+
+// replica process, controlled through the REPL on its standard input
+type replica struct {
+	addr string
+	port int
+	path string
+	log  string
+	mx   sync.Mutex
+	cmd  *exec.Cmd
+	repl io.WriteCloser
+	// exited is closed once the process has been waited for
+	exited chan struct{}
+}
+
+func newCluster(binary string, dir string, replicas int, basePort int) *cluster {
+	c := &cluster{binary: binary}
+	for i := 0; i < replicas; i++ {
+		port := basePort + i
+		c.members = append(c.members, fmt.Sprintf("127.0.0.1:%d", port))
+		c.replicas = append(c.replicas, &replica{
+			addr: c.members[i],
+			port: port,
+			path: filepath.Join(dir, fmt.Sprintf("replica-%d.db", i)),
+			log:  filepath.Join(dir, fmt.Sprintf("replica-%d.log", i)),
+		})
+	}
+	return c
+}
+
+// start the replica process, its database survives restarts
+func (c *cluster) start(i int) error {
+	r := c.replicas[i]
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.cmd != nil {
+		return fmt.Errorf("replica %s is already running", r.addr)
+	}
+	log, err := os.OpenFile(r.log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening log of replica %s: %w", r.addr, err)
+	}
+	cmd := exec.Command(c.binary, "serve",
+		"--cluster", strings.Join(c.members, ","),
+		"--port", strconv.Itoa(r.port),
+		"--filepath", r.path)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	repl, err := cmd.StdinPipe()
+	if err != nil {
+		log.Close()
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		log.Close()
+		return fmt.Errorf("error starting replica %s: %w", r.addr, err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		defer log.Close()
+		defer close(exited)
+		if err := cmd.Wait(); err != nil {
+			logrus.Debugf("Replica %s exited: %v", r.addr, err)
+		}
+	}()
+	r.cmd, r.repl, r.exited = cmd, repl, exited
+	c.generation.Add(1)
+	return nil
+}
+
+// kill the replica process without letting it shut down
+func (c *cluster) kill(i int) error {
+	r := c.replicas[i]
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.cmd == nil {
+		return fmt.Errorf("replica %s is not running", r.addr)
+	}
+	if err := r.cmd.Process.Kill(); err != nil {
+		return fmt.Errorf("error killing replica %s: %w", r.addr, err)
+	}
+	<-r.exited
+	r.cmd, r.repl = nil, nil
+	return nil
+}
+
+// stop every replica, closing the REPL shuts a replica down gracefully
+func (c *cluster) stop() {
+	for _, r := range c.replicas {
+		r.mx.Lock()
+		if r.cmd != nil {
+			_ = r.repl.Close()
+			select {
+			case <-r.exited:
+			case <-time.After(stopTimeout):
+				logrus.Warnf("Replica %s did not shut down in %s, killing it", r.addr, stopTimeout)
+				_ = r.cmd.Process.Kill()
+				<-r.exited
+			}
+			r.cmd, r.repl = nil, nil
+		}
+		r.mx.Unlock()
+	}
+}
+
+func (c *cluster) running(i int) bool {
+	r := c.replicas[i]
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.cmd != nil
+}
+
+// command runs a line of the server REPL of the replica, the output goes to its log
+func (c *cluster) command(i int, line string) error {
+	r := c.replicas[i]
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.cmd == nil {
+		return fmt.Errorf("replica %s is not running", r.addr)
+	}
+	if _, err := io.WriteString(r.repl, line+"\n"); err != nil {
+		return fmt.Errorf("error sending %q to replica %s: %w", line, r.addr, err)
+	}
+	return nil
+}
+
+// broadcast runs a line of the server REPL of every running replica
+func (c *cluster) broadcast(line string) error {
+	var err error
+	for i := range c.replicas {
+		if c.running(i) {
+			err = errors.Join(err, c.command(i, line))
+		}
+	}
+	return err
+}
+
+// dial a client, which only succeeds while every replica is running as the client needs all of them
+func (c *cluster) dial(ctx context.Context) (*client.Client, error) {
+	return client.Dial(ctx, c.members)
+}
+
+// awaitDial dials until it succeeds or the timeout expires
+func (c *cluster) awaitDial(ctx context.Context, timeout time.Duration) (*client.Client, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		cl, err := c.dial(ctx)
+		if err == nil || time.Now().After(deadline) {
+			return cl, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
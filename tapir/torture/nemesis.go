@@ -0,0 +1,112 @@
+package torture
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	// NemesisKill kills a replica and restarts it when healing
+	NemesisKill = "kill"
+	// NemesisPartition cuts off a minority of the replicas from the others
+	NemesisPartition = "partition"
+	// NemesisLatency slows down the messages of a replica
+	NemesisLatency = "latency"
+)
+
+// Nemeses are the faults the nemesis can inject
+var Nemeses = []string{NemesisKill, NemesisPartition, NemesisLatency}
+
+// nemesis injects one fault at a time into the cluster, healing it before the next
+type nemesis struct {
+	cluster *cluster
+	rand    *rand.Rand
+	faults  []string
+	// heal the current fault, nil if there is none
+	heal func() error
+	// timeline of the faults
+	timeline []string
+	started  time.Time
+}
+
+func (n *nemesis) logf(format string, args ...any) {
+	line := fmt.Sprintf("%8s ", time.Since(n.started).Round(time.Millisecond)) + fmt.Sprintf(format, args...)
+	n.timeline = append(n.timeline, line)
+}
+
+// step heals the current fault and injects the next one
+func (n *nemesis) step() {
+	n.recover()
+	if len(n.faults) == 0 {
+		return
+	}
+	replicas := len(n.cluster.replicas)
+	switch fault := n.faults[n.rand.Intn(len(n.faults))]; fault {
+	case NemesisKill:
+		i := n.rand.Intn(replicas)
+		if err := n.cluster.kill(i); err != nil {
+			n.logf("error killing %s: %v", n.cluster.members[i], err)
+			return
+		}
+		n.logf("kill %s", n.cluster.members[i])
+		n.heal = func() error {
+			if err := n.cluster.start(i); err != nil {
+				return err
+			}
+			n.logf("restart %s", n.cluster.members[i])
+			return nil
+		}
+	case NemesisPartition:
+		if replicas < 3 {
+			return
+		}
+		shuffled := append([]string(nil), n.cluster.members...)
+		n.rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		minority := 1 + n.rand.Intn((replicas-1)/2)
+		rule := fmt.Sprintf("%s | %s", strings.Join(shuffled[:minority], ","), strings.Join(shuffled[minority:], ","))
+		if err := n.cluster.broadcast("partition " + rule); err != nil {
+			n.logf("error partitioning %s: %v", rule, err)
+		}
+		n.logf("partition %s", rule)
+		n.heal = func() error {
+			n.logf("heal")
+			return n.cluster.broadcast("heal")
+		}
+	case NemesisLatency:
+		i := n.rand.Intn(replicas)
+		latency := 10 + n.rand.Intn(200)
+		jitter := n.rand.Intn(latency)
+		faults := fmt.Sprintf("latency=%d jitter=%d distribution=exponential direction=both", latency, jitter)
+		if err := n.cluster.command(i, "faults "+faults); err != nil {
+			n.logf("error slowing down %s: %v", n.cluster.members[i], err)
+			return
+		}
+		n.logf("slow down %s: %s", n.cluster.members[i], faults)
+		n.heal = func() error {
+			n.logf("speed up %s", n.cluster.members[i])
+			return n.cluster.command(i, "faults clear")
+		}
+	}
+}
+
+// recover from the current fault, and restart replicas that failed to restart earlier
+func (n *nemesis) recover() {
+	if n.heal != nil {
+		if err := n.heal(); err != nil {
+			n.logf("error healing: %v", err)
+		}
+		n.heal = nil
+	}
+	for i, member := range n.cluster.members {
+		if n.cluster.running(i) {
+			continue
+		}
+		if err := n.cluster.start(i); err != nil {
+			n.logf("error restarting %s: %v", member, err)
+		} else {
+			n.logf("restart %s", member)
+		}
+	}
+}
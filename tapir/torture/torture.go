@@ -0,0 +1,290 @@
+// Package torture runs a cluster of replica processes on loopback ports, with clients running randomised
+// transactions while a nemesis kills, partitions and slows down replicas, and then checks the history of the
+// transactions and the invariants of the workloads.
+package torture
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/client"
+	"github.com/phughk/go-dist-algos/tapir/history"
+	"github.com/phughk/go-dist-algos/tapir/server"
+	"github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// readyTimeout is how long the replicas have to accept connections after starting
+	readyTimeout = 10 * time.Second
+	// attempts is how many times the accounts are opened and the final values read before giving up, as the cluster
+	// may still be changing views
+	attempts = 10
+)
+
+// Options of a torture run
+type Options struct {
+	// Binary is the tapir executable the replicas are run with
+	Binary string
+	// Dir keeps the databases and logs of the replicas, a temporary directory is created if it is empty
+	Dir         string
+	Replicas    int
+	BasePort    int
+	Duration    time.Duration
+	Concurrency int
+	// Workloads the clients choose transactions from, every workload if empty
+	Workloads []string
+	// Nemeses the nemesis chooses faults from, none if empty
+	Nemeses         []string
+	NemesisInterval time.Duration
+	Seed            int64
+	// Realtime checks for strict serializability instead of serializability
+	Realtime bool
+	// History receives the history of the transactions when set
+	History io.Writer
+}
+
+// Result of a torture run
+type Result struct {
+	// Dir has the databases and logs of the replicas
+	Dir string
+	// Transactions are the outcomes by workload
+	Transactions map[string]*Counts
+	// Timeline of the faults injected by the nemesis
+	Timeline []string
+	// Final values of the keys after recovering
+	Final map[string]string
+	Check *history.Report
+	// Violations of the invariants of the workloads
+	Violations []string
+}
+
+func (r *Result) Valid() bool {
+	return len(r.Violations) == 0 && r.Check.Valid()
+}
+
+// Run starts the cluster, runs the workloads and the nemesis for the duration, recovers and checks the outcome
+func Run(ctx context.Context, opts Options) (*Result, error) {
+	if len(opts.Workloads) == 0 {
+		opts.Workloads = Workloads
+	}
+	for _, workload := range opts.Workloads {
+		if !contains(Workloads, workload) {
+			return nil, fmt.Errorf("unknown workload %q, expected %s", workload, strings.Join(Workloads, ", "))
+		}
+	}
+	for _, fault := range opts.Nemeses {
+		if !contains(Nemeses, fault) {
+			return nil, fmt.Errorf("unknown nemesis %q, expected %s", fault, strings.Join(Nemeses, ", "))
+		}
+	}
+	if opts.Dir == "" {
+		dir, err := os.MkdirTemp("", "tapir-torture")
+		if err != nil {
+			return nil, err
+		}
+		opts.Dir = dir
+	} else if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	result := &Result{Dir: opts.Dir}
+	c := newCluster(opts.Binary, opts.Dir, opts.Replicas, opts.BasePort)
+	defer c.stop()
+	for i := range c.members {
+		if err := c.start(i); err != nil {
+			return nil, err
+		}
+	}
+	logrus.Infof("Started %d replicas, logs are in %s", opts.Replicas, opts.Dir)
+
+	var recorded bytes.Buffer
+	var recorder *history.Recorder
+	if opts.History != nil {
+		recorder = history.NewRecorder(io.MultiWriter(&recorded, opts.History))
+	} else {
+		recorder = history.NewRecorder(&recorded)
+	}
+	setup, err := c.awaitDial(ctx, readyTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("replicas did not start: %w", err)
+	}
+	setup.History = recorder
+	defer setup.Close()
+	// Let the replicas connect and agree on a view
+	time.Sleep(3 * server.DefaultViewChangePeriod)
+	if contains(opts.Workloads, WorkloadBank) {
+		if err := openAccounts(setup); err != nil {
+			return nil, err
+		}
+	}
+
+	w := &workers{
+		cluster:   c,
+		workloads: opts.Workloads,
+		counts:    make(map[string]*Counts),
+		recorder:  recorder,
+	}
+	r := rand.New(rand.NewSource(opts.Seed))
+	n := &nemesis{cluster: c, rand: r, faults: opts.Nemeses, started: time.Now()}
+	workCtx, stopWork := context.WithTimeout(ctx, opts.Duration)
+	defer stopWork()
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			w.run(workCtx, seed)
+		}(r.Int63())
+	}
+	ticker := time.NewTicker(opts.NemesisInterval)
+nemesis:
+	for {
+		select {
+		case <-workCtx.Done():
+			break nemesis
+		case <-ticker.C:
+			n.step()
+		}
+	}
+	ticker.Stop()
+	wg.Wait()
+	n.recover()
+	result.Timeline = n.timeline
+	result.Transactions = w.counts
+	result.Violations = w.violations
+
+	// Recover and read every key
+	time.Sleep(3 * server.DefaultViewChangePeriod)
+	final, err := c.awaitDial(ctx, readyTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("replicas did not recover: %w", err)
+	}
+	final.History = recorder
+	result.Final, err = readFinal(final, keys(opts.Workloads))
+	final.Close()
+	if err != nil {
+		result.Violations = append(result.Violations, fmt.Sprintf("error reading the final values after recovering: %v", err))
+	}
+	if err := recorder.Err(); err != nil {
+		return nil, err
+	}
+	events, err := history.Read(&recorded)
+	if err != nil {
+		return nil, err
+	}
+	result.Check = history.Check(events, history.Options{Realtime: opts.Realtime})
+	if result.Final != nil {
+		result.Violations = append(result.Violations, checkFinal(opts.Workloads, result.Final, result.Check)...)
+	}
+	return result, nil
+}
+
+// openAccounts writes the initial balance of every account
+func openAccounts(c *client.Client) error {
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		txn := c.Begin()
+		for i := 0; i < keysPerWorkload; i++ {
+			_ = txn.Put(account(i), strconv.Itoa(initialBalance))
+		}
+		if err = txn.Commit(); err == nil {
+			return nil
+		}
+		time.Sleep(server.DefaultViewChangePeriod)
+	}
+	return fmt.Errorf("error opening accounts: %w", err)
+}
+
+// readFinal reads every key in one transaction, retrying while the cluster recovers
+func readFinal(c *client.Client, keys []string) (map[string]string, error) {
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		values := make(map[string]string, len(keys))
+		txn := c.Begin()
+		for _, key := range keys {
+			if values[key], err = txn.Get(key); err != nil {
+				_ = txn.Abort()
+				break
+			}
+		}
+		if err == nil {
+			if err = txn.Commit(); err == nil {
+				return values, nil
+			}
+		}
+		logrus.Warnf("Error reading the final values: %v", err)
+		time.Sleep(server.DefaultViewChangePeriod)
+	}
+	return nil, err
+}
+
+// checkFinal checks the final values against the invariants of the workloads and the outcomes of the transactions
+func checkFinal(workloads []string, final map[string]string, report *history.Report) []string {
+	violations := make([]string, 0)
+	if contains(workloads, WorkloadBank) {
+		total := 0
+		for i := 0; i < keysPerWorkload; i++ {
+			balance, err := strconv.Atoi(final[account(i)])
+			if err != nil {
+				violations = append(violations, fmt.Sprintf("bank: invalid balance of %s %q", account(i), final[account(i)]))
+				continue
+			}
+			if balance < 0 {
+				violations = append(violations, fmt.Sprintf("bank: negative balance of %s %d", account(i), balance))
+			}
+			total += balance
+		}
+		if total != keysPerWorkload*initialBalance {
+			violations = append(violations, fmt.Sprintf("bank: final total is %d, expected %d", total, keysPerWorkload*initialBalance))
+		}
+	}
+	if contains(workloads, WorkloadAppend) {
+		ids := make([]int, 0, len(report.Transactions))
+		for id := range report.Transactions {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for i := 0; i < keysPerWorkload; i++ {
+			key := list(i)
+			present := make(map[string]bool)
+			for _, element := range elements(final[key]) {
+				if present[element] {
+					violations = append(violations, fmt.Sprintf("append: element %s is in %s twice", element, key))
+				}
+				present[element] = true
+			}
+			for _, id := range ids {
+				t := report.Transactions[id]
+				written, ok := t.Writes[key]
+				if !ok {
+					continue
+				}
+				appended := elements(written)
+				element := appended[len(appended)-1]
+				switch {
+				case t.Type == history.Ok && !present[element]:
+					violations = append(violations, fmt.Sprintf("append: element %s committed by T%d is missing from %s", element, id, key))
+				case t.Type == history.Fail && present[element]:
+					violations = append(violations, fmt.Sprintf("append: element %s of failed T%d is in %s", element, id, key))
+				}
+			}
+		}
+	}
+	return violations
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
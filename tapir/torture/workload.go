@@ -0,0 +1,263 @@
+package torture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/client"
+	"github.com/phughk/go-dist-algos/tapir/history"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// WorkloadBank transfers money between accounts, the total must never change
+	WorkloadBank = "bank"
+	// WorkloadAppend appends unique elements to lists, committed elements must never be lost
+	WorkloadAppend = "append"
+	// WorkloadRegister overwrites registers with unique values after reading them
+	WorkloadRegister = "register"
+)
+
+// Workloads are the kinds of transactions the clients can run
+var Workloads = []string{WorkloadBank, WorkloadAppend, WorkloadRegister}
+
+const (
+	// keysPerWorkload is how many accounts, lists and registers there are, few enough for transactions to conflict
+	keysPerWorkload = 5
+	initialBalance  = 100
+	maxTransfer     = 20
+	// backoff after a transaction that didn't commit, so that clients don't spin while the cluster is unavailable
+	backoff = 50 * time.Millisecond
+)
+
+func account(i int) string {
+	return fmt.Sprintf("account/%d", i)
+}
+
+func list(i int) string {
+	return fmt.Sprintf("list/%d", i)
+}
+
+func register(i int) string {
+	return fmt.Sprintf("register/%d", i)
+}
+
+// Counts of transaction outcomes
+type Counts struct {
+	Ok   int
+	Fail int
+	// Info transactions may or may not have committed
+	Info int
+}
+
+// errAbandoned is the outcome of a transaction the workload chose not to commit
+var errAbandoned = errors.New("abandoned")
+
+// workers run transactions concurrently until the context is done
+type workers struct {
+	cluster   *cluster
+	workloads []string
+	// unique is the last value written by any worker, so that every write is unique
+	unique atomic.Int64
+	mx     sync.Mutex
+	counts map[string]*Counts
+	// violations of the invariants of the workloads seen while running
+	violations []string
+	recorder   *history.Recorder
+}
+
+func (w *workers) count(workload string, err error) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	counts, ok := w.counts[workload]
+	if !ok {
+		counts = &Counts{}
+		w.counts[workload] = counts
+	}
+	switch {
+	case err == nil:
+		counts.Ok++
+	case !errors.Is(err, errCommitting) || errors.Is(err, client.ErrAborted):
+		counts.Fail++
+	default:
+		counts.Info++
+	}
+}
+
+func (w *workers) violation(format string, args ...any) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	w.violations = append(w.violations, fmt.Sprintf(format, args...))
+}
+
+// errCommitting wraps the errors of commits, whose transactions may have committed anyway
+var errCommitting = errors.New("error committing")
+
+func commit(txn *client.Txn) error {
+	if err := txn.Commit(); err != nil {
+		if errors.Is(err, client.ErrRetry) {
+			_ = txn.Abort()
+			return err
+		}
+		return fmt.Errorf("%w: %w", errCommitting, err)
+	}
+	return nil
+}
+
+// run a worker until the context is done
+func (w *workers) run(ctx context.Context, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	var c *client.Client
+	generation := int64(-1)
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+	for ctx.Err() == nil {
+		// Reconnect after replicas restart, the client needs a connection to every replica
+		if current := w.cluster.generation.Load(); current != generation {
+			generation = current
+			if fresh, err := w.cluster.dial(ctx); err == nil {
+				if c != nil {
+					c.Close()
+				}
+				fresh.History = w.recorder
+				c = fresh
+			}
+		}
+		if c == nil {
+			time.Sleep(backoff)
+			continue
+		}
+		workload := w.workloads[r.Intn(len(w.workloads))]
+		var err error
+		switch workload {
+		case WorkloadBank:
+			err = w.bank(c, r)
+		case WorkloadAppend:
+			err = w.append(c, r)
+		case WorkloadRegister:
+			err = w.register(c, r)
+		}
+		w.count(workload, err)
+		if err != nil {
+			time.Sleep(backoff)
+		}
+	}
+}
+
+// bank transfers between two accounts, or reads every account and checks the total
+func (w *workers) bank(c *client.Client, r *rand.Rand) error {
+	txn := c.Begin()
+	if r.Intn(5) == 0 {
+		total := 0
+		for i := 0; i < keysPerWorkload; i++ {
+			balance, err := readBalance(txn, account(i))
+			if err != nil {
+				_ = txn.Abort()
+				return err
+			}
+			total += balance
+		}
+		err := commit(txn)
+		if err == nil && total != keysPerWorkload*initialBalance {
+			w.violation("bank: read a total of %d, expected %d", total, keysPerWorkload*initialBalance)
+		}
+		return err
+	}
+	from, to := r.Intn(keysPerWorkload), r.Intn(keysPerWorkload-1)
+	if to >= from {
+		to++
+	}
+	amount := 1 + r.Intn(maxTransfer)
+	fromBalance, err := readBalance(txn, account(from))
+	if err != nil {
+		_ = txn.Abort()
+		return err
+	}
+	toBalance, err := readBalance(txn, account(to))
+	if err != nil {
+		_ = txn.Abort()
+		return err
+	}
+	if fromBalance < amount {
+		_ = txn.Abort()
+		return errAbandoned
+	}
+	_ = txn.Put(account(from), strconv.Itoa(fromBalance-amount))
+	_ = txn.Put(account(to), strconv.Itoa(toBalance+amount))
+	return commit(txn)
+}
+
+func readBalance(txn *client.Txn, key string) (int, error) {
+	value, err := txn.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	balance, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid balance of %s %q: %w", key, value, err)
+	}
+	return balance, nil
+}
+
+// append a unique element to a list
+func (w *workers) append(c *client.Client, r *rand.Rand) error {
+	txn := c.Begin()
+	key := list(r.Intn(keysPerWorkload))
+	value, err := txn.Get(key)
+	if err != nil {
+		_ = txn.Abort()
+		return err
+	}
+	element := strconv.FormatInt(w.unique.Add(1), 10)
+	if value != "" {
+		element = value + "," + element
+	}
+	_ = txn.Put(key, element)
+	return commit(txn)
+}
+
+// register overwrites a register with a unique value after reading it
+func (w *workers) register(c *client.Client, r *rand.Rand) error {
+	txn := c.Begin()
+	key := register(r.Intn(keysPerWorkload))
+	if _, err := txn.Get(key); err != nil {
+		_ = txn.Abort()
+		return err
+	}
+	_ = txn.Put(key, strconv.FormatInt(w.unique.Add(1), 10))
+	return commit(txn)
+}
+
+// keys of the workloads, which are all read at the end
+func keys(workloads []string) []string {
+	keys := make([]string, 0)
+	for _, workload := range workloads {
+		for i := 0; i < keysPerWorkload; i++ {
+			switch workload {
+			case WorkloadBank:
+				keys = append(keys, account(i))
+			case WorkloadAppend:
+				keys = append(keys, list(i))
+			case WorkloadRegister:
+				keys = append(keys, register(i))
+			}
+		}
+	}
+	return keys
+}
+
+// elements of a list
+func elements(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
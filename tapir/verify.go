@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/phughk/go-dist-algos/tapir/client"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"sort"
+)
+
+// verify compares the committed values of every replica, optionally repairing the replicas that diverge
+func verify(c *cli.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tapirClient, err := client.Dial(ctx, processMembers(c.String("cluster")))
+	if err != nil {
+		return err
+	}
+	defer tapirClient.Close()
+	report, err := tapirClient.Verify(c.Int("depth"))
+	if err != nil {
+		return err
+	}
+	printVerifyReport(report)
+	if len(report.Divergences) == 0 || !c.Bool("repair") {
+		return nil
+	}
+	from, err := report.RepairSource()
+	if err != nil {
+		return fmt.Errorf("refusing to repair: %w", err)
+	}
+	// Each replica is repaired at most once, as the repair replaces all of its data
+	repairs := make(map[string]bool)
+	for _, divergence := range report.Divergences {
+		for addr := range divergence.Digests {
+			if !contains(divergence.Majority, addr) {
+				repairs[addr] = true
+			}
+		}
+	}
+	for addr := range repairs {
+		fmt.Printf("Repairing %s from %s\n", addr, from)
+		if err := tapirClient.Repair(addr, from); err != nil {
+			logrus.Errorf("Error repairing %s: %v", addr, err)
+		}
+	}
+	report, err = tapirClient.Verify(c.Int("depth"))
+	if err != nil {
+		return err
+	}
+	printVerifyReport(report)
+	if len(report.Divergences) > 0 {
+		return fmt.Errorf("replicas still diverge after repair")
+	}
+	return nil
+}
+
+func printVerifyReport(report *client.VerifyReport) {
+	for addr, err := range report.Unreachable {
+		fmt.Printf("Unreachable replica %s: %v\n", addr, err)
+	}
+	if len(report.Divergences) == 0 {
+		fmt.Printf("Replicas %v are consistent\n", report.Replicas)
+		return
+	}
+	fmt.Printf("Found %d diverging ranges:\n", len(report.Divergences))
+	for _, divergence := range report.Divergences {
+		fmt.Printf("range - [%q, %q)\n", divergence.Range.Start, divergence.Range.End)
+		if len(divergence.Majority) == 0 {
+			fmt.Printf("      no majority of the %d replicas agree\n", len(report.Replicas))
+		}
+		addrs := make([]string, 0, len(divergence.Digests))
+		for addr := range divergence.Digests {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			digest := divergence.Digests[addr]
+			majority := ""
+			if contains(divergence.Majority, addr) {
+				majority = " (majority)"
+			}
+			fmt.Printf("      - %s: %d keys, hash %s%s\n", addr, digest.Keys, digest.Hash[:12], majority)
+		}
+	}
+}
+
+func contains(items []string, item string) bool {
+	for _, candidate := range items {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}